@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"net"
+)
+
+// AllocateFor binds an address of the subnet to mac without a DHCP exchange, for
+// callers embedding the server (e.g. to address a container). The lease behaves like
+// one acknowledged by a REQUEST: a reservation of mac is honored, the previous address
+// of mac is renewed when possible, and the lease lasts the lease duration that
+// applies to mac, without classes. Call AllocateFor again before the lease expires to
+// renew it; an expired lease is reclaimed like any other. A DHCP client using the same
+// MAC is given the same address. It fails with ErrPoolExhausted or ErrInvalidReservation.
+func (s *DHCPServer) AllocateFor(mac net.HardwareAddr) (net.IP, error) {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+
+	bound := s.boundAddress(mac)
+	a, err := s.getIPForClient(mac, nil, "", nil, nil, s.isKnownMAC(mac), false)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	if lease, exists := s.leases.Get(mac.String()); exists {
+		if bound.Equal(a.ip) {
+			s.publishLease(LeaseRenewed, lease)
+		} else {
+			s.publishLease(LeaseAssigned, lease)
+		}
+	}
+	s.mutex.Unlock()
+	s.saveLeases()
+	log.Printf("Allocated IP %s to %s without DHCP", a.ip, mac)
+	return a.ip, nil
+}
+
+// Release ends the lease of mac at once and returns its address to the pool, unless
+// the address is reserved. A reservation of mac itself is kept. Releasing a MAC
+// without a lease does nothing.
+func (s *DHCPServer) Release(mac net.HardwareAddr) {
+	s.release(mac, nil)
+}
+
+// release is Release for the lease of mac on ip, or on any address if ip is nil. It
+// reports whether a lease ended.
+func (s *DHCPServer) release(mac net.HardwareAddr, ip net.IP) bool {
+	s.mutex.Lock()
+	macStr := mac.String()
+	lease, exists := s.leases.Get(macStr)
+	if exists && ip != nil && !lease.IP.Equal(ip) {
+		exists = false
+	}
+	if exists {
+		s.leases.Delete(macStr)
+		bound := !lease.offered()
+		s.leaseEnded("release", lease)
+		if bound {
+			s.rememberAddress(macStr, lease.IP, s.clock.Now())
+		}
+		if !s.ownerOf(lease.IP).isReservedIP(lease.IP) {
+			s.releaseIP(lease.IP)
+		}
+	}
+	s.checkUtilization()
+	s.mutex.Unlock()
+
+	if exists {
+		s.saveLeases()
+		log.Printf("Released IP %s of %s", lease.IP, macStr)
+	}
+	return exists
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// apiServer exposes the management HTTP API of a DHCPServer
+type apiServer struct {
+	server           *DHCPServer
+	token            string
+	reservationsFile string     // Where runtime reservations are persisted, empty to keep them in memory only
+	fileMutex        sync.Mutex // Serializes updates of reservationsFile
+}
+
+// newAPIHandler returns the HTTP handler for the management API. Every request except
+// the GET /healthz probe must carry "Authorization: Bearer <token>".
+func newAPIHandler(server *DHCPServer, token, reservationsFile string) http.Handler {
+	api := &apiServer{server: server, token: token, reservationsFile: reservationsFile}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /reservations", api.handleAddReservation)
+	mux.HandleFunc("DELETE /reservations/{mac}", api.handleRemoveReservation)
+	mux.HandleFunc("POST /leases/{mac}/expire", api.handleExpireLease)
+	mux.HandleFunc("POST /leases/{mac}/pin", api.handlePinLease)
+	mux.HandleFunc("POST /leases/compact", api.handleCompactLeases)
+	mux.HandleFunc("GET /quarantine", api.handleListQuarantine)
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", api.handleHealth)
+	root.Handle("/", api.authenticate(mux))
+	return root
+}
+
+// authenticate rejects requests without a valid bearer token
+func (api *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reservationRequest is the JSON body of POST /reservations
+type reservationRequest struct {
+	MAC string `json:"mac"`
+	IP  string `json:"ip"`
+}
+
+func (api *apiServer) handleAddReservation(w http.ResponseWriter, r *http.Request) {
+	var req reservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	mac, err := net.ParseMAC(req.MAC)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid mac")
+		return
+	}
+	ip := net.ParseIP(req.IP)
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, "invalid ip")
+		return
+	}
+
+	if err := api.server.AddReservation(mac, ip); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errReservationConflict) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	api.persist(func(reservations map[string]ReservationConfig) {
+		reservations[mac.String()] = ReservationConfig{IP: ip.String()}
+	})
+	writeJSON(w, http.StatusCreated, reservationRequest{MAC: mac.String(), IP: ip.String()})
+}
+
+func (api *apiServer) handleRemoveReservation(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid mac")
+		return
+	}
+	if _, exists := api.server.RemoveReservation(mac); !exists {
+		writeError(w, http.StatusNotFound, "no reservation for "+mac.String())
+		return
+	}
+	api.persist(func(reservations map[string]ReservationConfig) {
+		delete(reservations, mac.String())
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// leaseExpiry is the JSON response of POST /leases/{mac}/expire
+type leaseExpiry struct {
+	MAC string `json:"mac"`
+	IP  string `json:"ip"` // Address that will be reclaimed
+}
+
+func (api *apiServer) handleExpireLease(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid mac")
+		return
+	}
+	ip, err := api.server.ExpireLease(mac)
+	switch {
+	case errors.Is(err, errLeaseNotFound):
+		writeError(w, http.StatusNotFound, "no lease for "+mac.String())
+		return
+	case errors.Is(err, errLeaseReserved):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	api.server.saveLeases()
+	writeJSON(w, http.StatusOK, leaseExpiry{MAC: mac.String(), IP: ip.String()})
+}
+
+func (api *apiServer) handlePinLease(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid mac")
+		return
+	}
+	ip, err := api.server.PinLease(mac)
+	switch {
+	case errors.Is(err, errLeaseNotFound):
+		writeError(w, http.StatusNotFound, "no active lease for "+mac.String())
+		return
+	case errors.Is(err, errReservationConflict):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	api.server.saveLeases()
+	api.persist(func(reservations map[string]ReservationConfig) {
+		reservations[mac.String()] = ReservationConfig{IP: ip.String()}
+	})
+	writeJSON(w, http.StatusCreated, reservationRequest{MAC: mac.String(), IP: ip.String()})
+}
+
+// leaseCompaction is the JSON response of POST /leases/compact
+type leaseCompaction struct {
+	Leases int `json:"leases"` // Leases kept
+}
+
+func (api *apiServer) handleCompactLeases(w http.ResponseWriter, r *http.Request) {
+	kept, err := api.server.CompactLeases()
+	switch {
+	case errors.Is(err, errNoLeaseStore):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, leaseCompaction{Leases: kept})
+}
+
+func (api *apiServer) handleListQuarantine(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.server.Quarantined())
+}
+
+// persist applies update to the reservations file, if one is configured. Failures are
+// logged; the in-memory change has already taken effect.
+func (api *apiServer) persist(update func(map[string]ReservationConfig)) {
+	if api.reservationsFile == "" {
+		return
+	}
+	api.fileMutex.Lock()
+	defer api.fileMutex.Unlock()
+
+	reservations, err := loadReservationsFile(api.reservationsFile)
+	if err == nil {
+		update(reservations)
+		err = saveReservationsFile(api.reservationsFile, reservations)
+	}
+	if err != nil {
+		log.Printf("Failed to persist reservations: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testAPIToken = "secret"
+
+// apiRequest sends a request with a body to the API handler of s and returns the response
+func apiRequest(t testing.TB, s *DHCPServer, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIToken)
+	rec := httptest.NewRecorder()
+	newAPIHandler(s, testAPIToken, "").ServeHTTP(rec, req)
+	return rec
+}
+
+// TestAPIAddReservationChecks checks that runtime reservations are validated like
+// those of the config
+func TestAPIAddReservationChecks(t *testing.T) {
+	cfg := testSubnetConfig()
+	cfg.Network = "10.0.0.0/16"
+	cfg.Exclusions = []string{"10.0.0.150-10.0.0.159"}
+	cfg.ReservedAddresses = map[string]ReservationConfig{
+		testMAC(9).String(): {IP: "10.0.0.240"},
+		"02:00:00:aa:bb:*":  {IP: "10.0.5.<byte6>"},
+	}
+	s := newTestServer(t, cfg)
+
+	for _, tc := range []struct {
+		name   string
+		ip     string
+		status int
+		want   string
+	}{
+		{"gateway", "10.0.0.1", http.StatusBadRequest, "is the gateway"},
+		{"network address", "10.0.0.0", http.StatusBadRequest, "network or broadcast"},
+		{"broadcast address", "10.0.255.255", http.StatusBadRequest, "network or broadcast"},
+		{"excluded address", "10.0.0.155", http.StatusBadRequest, "exclusion 10.0.0.150-10.0.0.159"},
+		{"outside the network", "10.1.0.1", http.StatusBadRequest, "not inside network"},
+		{"pattern address", "10.0.5.7", http.StatusConflict, "pattern reservation 02:00:00:aa:bb:*"},
+		{"reserved for another client", "10.0.0.240", http.StatusConflict, "already reserved"},
+		{"free address", "10.0.0.250", http.StatusCreated, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"mac": "` + testMAC(1).String() + `", "ip": "` + tc.ip + `"}`
+			rec := apiRequest(t, s, http.MethodPost, "/reservations", body)
+			if rec.Code != tc.status || !strings.Contains(rec.Body.String(), tc.want) {
+				t.Fatalf("got %d %s, want %d with %q", rec.Code, strings.TrimSpace(rec.Body.String()), tc.status, tc.want)
+			}
+			res, reserved := s.reservations[testMAC(1).String()]
+			if accepted := reserved && res.ip.String() == tc.ip; accepted != (tc.status == http.StatusCreated) {
+				t.Errorf("reservation of %s is %v after a %d", tc.ip, accepted, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	bolterrors "go.etcd.io/bbolt/errors"
+)
+
+// Bucket names of the bbolt lease database
+var (
+	boltLeasesBucket   = []byte("leases")   // MAC string to JSON-encoded Lease
+	boltDeclinedBucket = []byte("declined") // IP string to RFC 3339 time of decline
+	boltHistoryBucket  = []byte("history")  // MAC string to JSON-encoded addresses held before
+	boltMetaBucket     = []byte("meta")     // Database properties
+	boltVersionKey     = []byte("version")  // Format version in decimal, absent in version 1
+)
+
+// boltBackend keeps leases in a bbolt database. Each sync writes only the entries
+// that changed since the previous one, in a single transaction.
+type boltBackend struct {
+	db              *bolt.DB
+	written         map[string]Lease         // Leases as of the last sync
+	writtenDeclined map[string]time.Time     // Declined addresses as of the last sync
+	writtenHistory  map[string][]pastAddress // Address history as of the last sync
+}
+
+// openBoltBackend opens or creates the database at path and drops expired leases
+func openBoltBackend(path string) (*boltBackend, error) {
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolterrors.ErrTimeout) {
+		return nil, fmt.Errorf("%s is in use by another instance of the server", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lease database: %w", err)
+	}
+
+	dropped := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		version := 1
+		if data := meta.Get(boltVersionKey); data != nil {
+			if version, err = strconv.Atoi(string(data)); err != nil {
+				return fmt.Errorf("invalid format version %q", data)
+			}
+		} else if tx.Bucket(boltLeasesBucket) == nil {
+			version = leaseStoreVersion // A new database
+		}
+		// Leases of version 1 get their state from the offered flag as they are decoded
+		if err := checkStoreVersion("lease database "+path, version); err != nil {
+			return err
+		}
+		if err := meta.Put(boltVersionKey, []byte(strconv.Itoa(leaseStoreVersion))); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(boltDeclinedBucket); err != nil {
+			return err
+		}
+		history, err := tx.CreateBucketIfNotExists(boltHistoryBucket)
+		if err != nil {
+			return err
+		}
+		leases, err := tx.CreateBucketIfNotExists(boltLeasesBucket)
+		if err != nil {
+			return err
+		}
+
+		// Compact away leases that expired while the server was down, keeping their
+		// addresses in the history of the client
+		now := time.Now()
+		expired := [][]byte{}
+		pastAddresses := make(map[string]pastAddress)
+		err = leases.ForEach(func(mac, data []byte) error {
+			var lease Lease
+			err := json.Unmarshal(data, &lease)
+			if err == nil && !now.After(lease.ExpiresAt) {
+				return nil
+			}
+			expired = append(expired, mac)
+			if err == nil && !lease.offered() && lease.IP != nil {
+				pastAddresses[string(mac)] = pastAddress{IP: lease.IP, ReleasedAt: lease.ExpiresAt}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, mac := range expired {
+			if err := leases.Delete(mac); err != nil {
+				return err
+			}
+		}
+		for mac, entry := range pastAddresses {
+			var past []pastAddress
+			if data := history.Get([]byte(mac)); data != nil {
+				if err := json.Unmarshal(data, &past); err != nil {
+					past = nil
+				}
+			}
+			data, err := json.Marshal(append([]pastAddress{entry}, past...))
+			if err != nil {
+				return err
+			}
+			if err := history.Put([]byte(mac), data); err != nil {
+				return err
+			}
+		}
+		dropped = len(expired)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize lease database: %w", err)
+	}
+	if dropped > 0 {
+		log.Printf("Dropped %d expired lease(s) from %s", dropped, path)
+	}
+	return &boltBackend{db: db}, nil
+}
+
+// load implements leaseBackend
+func (b *boltBackend) load() (leaseData, error) {
+	leases := make(map[string]Lease)
+	declined := make(map[string]time.Time)
+	history := make(map[string][]pastAddress)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltLeasesBucket).ForEach(func(mac, data []byte) error {
+			var lease Lease
+			if err := json.Unmarshal(data, &lease); err != nil {
+				return fmt.Errorf("lease of %s: %w", mac, err)
+			}
+			leases[string(mac)] = lease
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(boltDeclinedBucket).ForEach(func(ip, data []byte) error {
+			var declinedAt time.Time
+			if err := declinedAt.UnmarshalText(data); err != nil {
+				return fmt.Errorf("declined address %s: %w", ip, err)
+			}
+			declined[string(ip)] = declinedAt
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltHistoryBucket).ForEach(func(mac, data []byte) error {
+			var past []pastAddress
+			if err := json.Unmarshal(data, &past); err != nil {
+				return fmt.Errorf("address history of %s: %w", mac, err)
+			}
+			history[string(mac)] = past
+			return nil
+		})
+	})
+	if err != nil {
+		return leaseData{}, fmt.Errorf("failed to read lease database: %w", err)
+	}
+	b.written = leases
+	b.writtenDeclined = declined
+	b.writtenHistory = history
+	return leaseData{leases: leases, declined: declined, history: history}, nil
+}
+
+// sync implements leaseBackend
+func (b *boltBackend) sync(state leaseData) error {
+	leases, declined, history := state.leases, state.declined, state.history
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		leaseBucket := tx.Bucket(boltLeasesBucket)
+		for mac, lease := range leases {
+			if old, exists := b.written[mac]; exists && reflect.DeepEqual(old, lease) {
+				continue
+			}
+			data, err := json.Marshal(lease)
+			if err != nil {
+				return err
+			}
+			if err := leaseBucket.Put([]byte(mac), data); err != nil {
+				return err
+			}
+		}
+		for mac := range b.written {
+			if _, exists := leases[mac]; !exists {
+				if err := leaseBucket.Delete([]byte(mac)); err != nil {
+					return err
+				}
+			}
+		}
+
+		declinedBucket := tx.Bucket(boltDeclinedBucket)
+		for ip, declinedAt := range declined {
+			if old, exists := b.writtenDeclined[ip]; exists && old.Equal(declinedAt) {
+				continue
+			}
+			data, err := declinedAt.MarshalText()
+			if err != nil {
+				return err
+			}
+			if err := declinedBucket.Put([]byte(ip), data); err != nil {
+				return err
+			}
+		}
+		for ip := range b.writtenDeclined {
+			if _, exists := declined[ip]; !exists {
+				if err := declinedBucket.Delete([]byte(ip)); err != nil {
+					return err
+				}
+			}
+		}
+
+		historyBucket := tx.Bucket(boltHistoryBucket)
+		for mac, past := range history {
+			if old, exists := b.writtenHistory[mac]; exists && reflect.DeepEqual(old, past) {
+				continue
+			}
+			data, err := json.Marshal(past)
+			if err != nil {
+				return err
+			}
+			if err := historyBucket.Put([]byte(mac), data); err != nil {
+				return err
+			}
+		}
+		for mac := range b.writtenHistory {
+			if _, exists := history[mac]; !exists {
+				if err := historyBucket.Delete([]byte(mac)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write lease database: %w", err)
+	}
+	b.written = leases
+	b.writtenDeclined = declined
+	b.writtenHistory = history
+	return nil
+}
+
+// compact implements leaseBackend, recreating the buckets in one transaction
+func (b *boltBackend) compact(state leaseData) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltLeasesBucket, boltDeclinedBucket, boltHistoryBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		leaseBucket := tx.Bucket(boltLeasesBucket)
+		for mac, lease := range state.leases {
+			data, err := json.Marshal(lease)
+			if err != nil {
+				return err
+			}
+			if err := leaseBucket.Put([]byte(mac), data); err != nil {
+				return err
+			}
+		}
+		declinedBucket := tx.Bucket(boltDeclinedBucket)
+		for ip, declinedAt := range state.declined {
+			data, err := declinedAt.MarshalText()
+			if err != nil {
+				return err
+			}
+			if err := declinedBucket.Put([]byte(ip), data); err != nil {
+				return err
+			}
+		}
+		historyBucket := tx.Bucket(boltHistoryBucket)
+		for mac, past := range state.history {
+			data, err := json.Marshal(past)
+			if err != nil {
+				return err
+			}
+			if err := historyBucket.Put([]byte(mac), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write lease database: %w", err)
+	}
+	b.written = state.leases
+	b.writtenDeclined = state.declined
+	b.writtenHistory = state.history
+	return nil
+}
+
+// close implements leaseBackend
+func (b *boltBackend) close() error {
+	return b.db.Close()
+}
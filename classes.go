@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// ClassConfig defines a group of clients identified by their vendor class (option 60),
+// user class (option 77) and/or MAC prefix that receive their own settings and,
+// optionally, a dedicated address range. When several matches are set, a client must
+// satisfy all of them.
+type ClassConfig struct {
+	Name             string               `yaml:"name"`
+	VendorClassMatch string               `yaml:"vendor_class_match,omitempty"`
+	UserClassMatch   string               `yaml:"user_class_match,omitempty"`
+	MACPrefixMatch   string               `yaml:"mac_prefix_match,omitempty"` // 3 to 5 octets, such as an OUI
+	Match            string               `yaml:"match,omitempty"`            // substring (default) or exact
+	Range            string               `yaml:"range,omitempty"`
+	LeaseDuration    int                  `yaml:"lease_duration,omitempty"`
+	DNSServers       []string             `yaml:"dns_servers,omitempty"`
+	Options          []CustomOptionConfig `yaml:"options,omitempty"`
+	NextServer       string               `yaml:"next_server,omitempty"`
+	BootFilename     string               `yaml:"boot_filename,omitempty"`
+	Deny             bool                 `yaml:"deny,omitempty"` // Refuse service to matching clients
+}
+
+// clientClass is a parsed ClassConfig
+type clientClass struct {
+	name          string
+	match         string // Vendor class pattern, empty to match any
+	userMatch     string // User class pattern, empty to match any
+	macPrefix     string // Normalized MAC prefix, empty to match any
+	exact         bool
+	pool          *addressPool // Dedicated range, nil to allocate from the subnet pool
+	leaseDuration time.Duration
+	dnsServers    []net.IP
+	options       []dhcpv4.Option
+	nextServer    net.IP
+	bootFile      string
+	deny          bool
+	denied        atomic.Uint64 // Number of packets refused by this class
+}
+
+// parseClasses validates the configured client classes. Dedicated ranges must lie
+// inside network; reserved addresses are left out of them.
+func parseClasses(configs []ClassConfig, network *net.IPNet, reserved []net.IP) ([]*clientClass, error) {
+	classes := []*clientClass{}
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("class with vendor_class_match %q and user_class_match %q has no name", cfg.VendorClassMatch, cfg.UserClassMatch)
+		}
+		if cfg.VendorClassMatch == "" && cfg.UserClassMatch == "" && cfg.MACPrefixMatch == "" {
+			return nil, fmt.Errorf("class %s: vendor_class_match, user_class_match or mac_prefix_match is required", cfg.Name)
+		}
+		var macPrefix string
+		if cfg.MACPrefixMatch != "" {
+			var ok bool
+			if macPrefix, ok = parseMACPrefix(cfg.MACPrefixMatch); !ok {
+				return nil, fmt.Errorf("class %s: invalid mac_prefix_match %q: expected 3 to 5 octets", cfg.Name, cfg.MACPrefixMatch)
+			}
+		}
+		if cfg.Match != "" && cfg.Match != "substring" && cfg.Match != "exact" {
+			return nil, fmt.Errorf("class %s: match must be substring or exact, got %q", cfg.Name, cfg.Match)
+		}
+		if cfg.LeaseDuration < 0 {
+			return nil, fmt.Errorf("class %s: lease_duration must not be negative", cfg.Name)
+		}
+		options, err := parseCustomOptions(cfg.Options)
+		if err != nil {
+			return nil, fmt.Errorf("class %s: %w", cfg.Name, err)
+		}
+
+		class := &clientClass{
+			name:          cfg.Name,
+			match:         cfg.VendorClassMatch,
+			userMatch:     cfg.UserClassMatch,
+			macPrefix:     macPrefix,
+			exact:         cfg.Match == "exact",
+			leaseDuration: time.Duration(cfg.LeaseDuration) * time.Second,
+			dnsServers:    parseIPs(cfg.DNSServers),
+			options:       options,
+			bootFile:      cfg.BootFilename,
+			deny:          cfg.Deny,
+		}
+		if cfg.NextServer != "" {
+			if class.nextServer = net.ParseIP(cfg.NextServer).To4(); class.nextServer == nil {
+				return nil, fmt.Errorf("class %s: invalid next_server %s", cfg.Name, cfg.NextServer)
+			}
+		}
+		if cfg.Range != "" {
+			startIP, endIP, err := parseRange(cfg.Range)
+			if err != nil {
+				return nil, fmt.Errorf("class %s: %w", cfg.Name, err)
+			}
+			if !network.Contains(startIP) || !network.Contains(endIP) {
+				return nil, fmt.Errorf("class %s: range %s is outside network %s", cfg.Name, cfg.Range, network)
+			}
+			class.pool = newAddressPool(startIP, endIP, reserved, nil)
+			for _, other := range classes {
+				if other.pool != nil && other.pool.overlaps(class.pool) {
+					return nil, fmt.Errorf("class %s: range %s overlaps the range of class %s", cfg.Name, cfg.Range, other.name)
+				}
+			}
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+// matches reports whether a client with the given MAC, vendor class and user classes
+// belongs to c. Any one of the client's user classes may satisfy the user class match.
+func (c *clientClass) matches(mac, vendorClass string, userClasses []string) bool {
+	if !strings.HasPrefix(mac, c.macPrefix) {
+		return false
+	}
+	if c.match != "" && !c.matchString(vendorClass, c.match) {
+		return false
+	}
+	if c.userMatch == "" {
+		return true
+	}
+	for _, userClass := range userClasses {
+		if c.matchString(userClass, c.userMatch) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchString applies the class's match mode to a single value
+func (c *clientClass) matchString(value, pattern string) bool {
+	if c.exact {
+		return value == pattern
+	}
+	return strings.Contains(value, pattern)
+}
+
+// classify returns the class matching the packet's MAC, vendor and user classes, or
+// nil. Among matching classes the one with the longest MAC prefix wins, and the first
+// one configured among those.
+func (s *DHCPServer) classify(p *dhcpv4.DHCPv4) *clientClass {
+	mac := p.ClientHWAddr.String()
+	vendorClass := p.ClassIdentifier()
+	userClasses := p.UserClass()
+	var best *clientClass
+	for _, class := range s.classes {
+		if class.matches(mac, vendorClass, userClasses) && (best == nil || len(class.macPrefix) > len(best.macPrefix)) {
+			best = class
+		}
+	}
+	return best
+}
+
+// className returns the class name for logging and leases, empty for no class
+func className(c *clientClass) string {
+	if c == nil {
+		return ""
+	}
+	return c.name
+}
+
+// setOptions returns the codes of the reply options the class sets that custom
+// options could also set, through its settings or its options
+func (c *clientClass) setOptions() map[uint8]bool {
+	codes := map[uint8]bool{}
+	if c == nil {
+		return codes
+	}
+	if c.bootFile != "" {
+		codes[dhcpv4.OptionBootfileName.Code()] = true
+	}
+	for _, opt := range c.options {
+		codes[opt.Code.Code()] = true
+	}
+	return codes
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// optionLayer is a configuration layer that can set a reply option to the n-th of
+// its test values
+type optionLayer struct {
+	name string
+	set  func(cfg *SubnetConfig, n int)
+}
+
+// TestOptionPrecedence sets one option in every combination of the layers that can
+// set it, each layer with its own value, and checks that the ACK carries the value of
+// the most specific one. The layers are listed from the least specific: the subnet,
+// the subnet's custom options overriding its settings, the class, lease_overrides and
+// the host reservation.
+func TestOptionPrecedence(t *testing.T) {
+	mac := testMAC(1)
+	ip := func(n int) string { return fmt.Sprintf("10.0.0.%d", 50+n) }
+	for _, opt := range []struct {
+		name   string
+		code   dhcpv4.OptionCode
+		layers []optionLayer
+		encode func(n int) []byte
+	}{
+		{
+			name: "lease time",
+			code: dhcpv4.OptionIPAddressLeaseTime,
+			layers: []optionLayer{
+				{"subnet", func(cfg *SubnetConfig, n int) { cfg.LeaseDuration = 1000 * n }},
+				{"class", func(cfg *SubnetConfig, n int) { cfg.Classes[0].LeaseDuration = 1000 * n }},
+				{"override", func(cfg *SubnetConfig, n int) { cfg.LeaseOverrides = map[string]int{mac.String(): 1000 * n} }},
+				{"host", func(cfg *SubnetConfig, n int) { setHost(cfg, func(r *ReservationConfig) { r.LeaseDuration = 1000 * n }) }},
+			},
+			encode: func(n int) []byte { return dhcpv4.Duration(time.Duration(1000*n) * time.Second).ToBytes() },
+		},
+		{
+			name: "DNS servers",
+			code: dhcpv4.OptionDomainNameServer,
+			layers: []optionLayer{
+				{"subnet", func(cfg *SubnetConfig, n int) { cfg.DNSServers = []string{ip(n)} }},
+				{"class", func(cfg *SubnetConfig, n int) { cfg.Classes[0].DNSServers = []string{ip(n)} }},
+				{"host", func(cfg *SubnetConfig, n int) { setHost(cfg, func(r *ReservationConfig) { r.DNSServers = []string{ip(n)} }) }},
+			},
+			encode: func(n int) []byte { return net.ParseIP(ip(n)).To4() },
+		},
+		{
+			name: "boot file",
+			code: dhcpv4.OptionBootfileName,
+			layers: []optionLayer{
+				{"subnet", func(cfg *SubnetConfig, n int) { cfg.BootFilename = fmt.Sprintf("boot%d", n) }},
+				{"subnet options", func(cfg *SubnetConfig, n int) { cfg.Options = []CustomOptionConfig{stringOption(67, "boot%d", n)} }},
+				{"class", func(cfg *SubnetConfig, n int) { cfg.Classes[0].BootFilename = fmt.Sprintf("boot%d", n) }},
+				{"class options", func(cfg *SubnetConfig, n int) { cfg.Classes[0].Options = []CustomOptionConfig{stringOption(67, "boot%d", n)} }},
+				{"host", func(cfg *SubnetConfig, n int) {
+					setHost(cfg, func(r *ReservationConfig) { r.BootFile = fmt.Sprintf("boot%d", n) })
+				}},
+				{"host options", func(cfg *SubnetConfig, n int) {
+					setHost(cfg, func(r *ReservationConfig) { r.Options = []CustomOptionConfig{stringOption(67, "boot%d", n)} })
+				}},
+			},
+			encode: func(n int) []byte { return []byte(fmt.Sprintf("boot%d", n)) },
+		},
+		{
+			name: "domain name",
+			code: dhcpv4.OptionDomainName,
+			layers: []optionLayer{
+				{"subnet", func(cfg *SubnetConfig, n int) { domain := fmt.Sprintf("d%d.example", n); cfg.DomainName = &domain }},
+				{"subnet options", func(cfg *SubnetConfig, n int) { cfg.Options = []CustomOptionConfig{stringOption(15, "d%d.example", n)} }},
+				{"class options", func(cfg *SubnetConfig, n int) { cfg.Classes[0].Options = []CustomOptionConfig{stringOption(15, "d%d.example", n)} }},
+				{"host", func(cfg *SubnetConfig, n int) {
+					setHost(cfg, func(r *ReservationConfig) { r.Domain = fmt.Sprintf("d%d.example", n) })
+				}},
+			},
+			encode: func(n int) []byte { return []byte(fmt.Sprintf("d%d.example", n)) },
+		},
+		{
+			name: "custom option",
+			code: dhcpv4.OptionNTPServers,
+			layers: []optionLayer{
+				{"subnet", func(cfg *SubnetConfig, n int) { cfg.Options = []CustomOptionConfig{ipOption(42, ip(n))} }},
+				{"class", func(cfg *SubnetConfig, n int) { cfg.Classes[0].Options = []CustomOptionConfig{ipOption(42, ip(n))} }},
+				{"host", func(cfg *SubnetConfig, n int) {
+					setHost(cfg, func(r *ReservationConfig) { r.Options = []CustomOptionConfig{ipOption(42, ip(n))} })
+				}},
+			},
+			encode: func(n int) []byte { return net.ParseIP(ip(n)).To4() },
+		},
+	} {
+		for set := 1; set < 1<<len(opt.layers); set++ {
+			var names []string
+			want := 0
+			for i, layer := range opt.layers {
+				if set&(1<<i) != 0 {
+					names, want = append(names, layer.name), i+1
+				}
+			}
+			t.Run(opt.name+" by "+strings.Join(names, ", "), func(t *testing.T) {
+				cfg := testSubnetConfig()
+				cfg.DNSServers = nil
+				cfg.Classes = []ClassConfig{{Name: "all", MACPrefixMatch: "02:00:00"}}
+				for i, layer := range opt.layers {
+					if set&(1<<i) != 0 {
+						layer.set(&cfg, i+1)
+					}
+				}
+				s := newTestServer(t, cfg)
+				addr := net.IPv4(10, 0, 0, 20).To4()
+				if res, ok := cfg.ReservedAddresses[mac.String()]; ok {
+					addr = net.ParseIP(res.IP).To4()
+				}
+				ack := bind(t, s, mac, addr)
+				if got := ack.Options.Get(opt.code); !bytes.Equal(got, opt.encode(want)) {
+					t.Errorf("option %d = %v, want %v from the %s", opt.code.Code(), got, opt.encode(want), opt.layers[want-1].name)
+				}
+			})
+		}
+	}
+}
+
+// setHost applies set to the reservation of testMAC(1) in cfg, creating it
+func setHost(cfg *SubnetConfig, set func(*ReservationConfig)) {
+	key := testMAC(1).String()
+	if cfg.ReservedAddresses == nil {
+		cfg.ReservedAddresses = map[string]ReservationConfig{}
+	}
+	res, ok := cfg.ReservedAddresses[key]
+	if !ok {
+		res.IP = "10.0.0.5"
+	}
+	set(&res)
+	cfg.ReservedAddresses[key] = res
+}
+
+// stringOption returns a custom option of code whose value is format applied to n
+func stringOption(code int, format string, n int) CustomOptionConfig {
+	return CustomOptionConfig{Code: code, Type: "string", Value: StringList{fmt.Sprintf(format, n)}}
+}
+
+// ipOption returns a custom option of code holding ip
+func ipOption(code int, ip string) CustomOptionConfig {
+	return CustomOptionConfig{Code: code, Type: "ip", Value: StringList{ip}}
+}
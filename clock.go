@@ -0,0 +1,46 @@
+package main
+
+import "time"
+
+// Clock is the source of time of a DHCPServer. Lease expiry, offer and decline
+// timeouts, reuse delays and the background loops all read it, so a fake clock can
+// drive them without waiting.
+type Clock interface {
+	Now() time.Time
+	// After delivers the time on the channel once d has passed
+	After(d time.Duration) <-chan time.Time
+	// NewTicker delivers the time every d until stopped
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is a ticker made by a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the Clock of the system
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+// realTicker is a time.Ticker as a Ticker
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// SetClock replaces the clock of the server, the subnets sharing its leases and its
+// webhook. Call it before the server handles packets or runs its background loops.
+func (s *DHCPServer) SetClock(clock Clock) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clock = clock
+	s.health.startedAt = clock.Now()
+	if s.webhook != nil {
+		s.webhook.clock = clock
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+
+	"dhcp_server/internal/testutil"
+)
+
+// fakeClock adapts a testutil.FakeClock to the Clock interface
+type fakeClock struct {
+	*testutil.FakeClock
+}
+
+func (c fakeClock) NewTicker(d time.Duration) Ticker { return c.FakeClock.NewTicker(d) }
+
+// testEpoch is the time fake clocks start at
+var testEpoch = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// newClockedServer returns a test server for cfg driven by a fake clock
+func newClockedServer(t testing.TB, cfg SubnetConfig) (*DHCPServer, fakeClock) {
+	t.Helper()
+	s := newTestServer(t, cfg)
+	clock := fakeClock{testutil.NewFakeClock(testEpoch)}
+	s.SetClock(clock)
+	return s, clock
+}
+
+// bind leases ip to mac through a DISCOVER and a REQUEST and returns the ACK
+func bind(t testing.TB, s *DHCPServer, mac net.HardwareAddr, ip net.IP) *dhcpv4.DHCPv4 {
+	t.Helper()
+	serve(t, s, newDiscover(t, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip))))
+	ack := serve(t, s, newRequest(t, mac, ip, testServerIP))
+	if ack == nil || ack.MessageType() != dhcpv4.MessageTypeAck || !ack.YourIPAddr.Equal(ip) {
+		t.Fatalf("binding %s to %s: got %v", ip, mac, ack)
+	}
+	return ack
+}
+
+// poolOffset returns the offset of ip in the subnet pool of s
+func poolOffset(t testing.TB, s *DHCPServer, ip net.IP) uint32 {
+	t.Helper()
+	off, ok := s.pool.offset(ip)
+	if !ok {
+		t.Fatalf("%s is not in the pool", ip)
+	}
+	return off
+}
+
+// isFree reports whether ip is free in the subnet pool of s
+func isFree(t testing.TB, s *DHCPServer, ip net.IP) bool {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.pool.isFree(poolOffset(t, s, ip))
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	s, clock := newClockedServer(t, testSubnetConfig())
+	mac, ip := testMAC(1), net.IPv4(10, 0, 0, 50).To4()
+	bind(t, s, mac, ip)
+
+	lease, _ := s.Lease(mac)
+	if want := testEpoch.Add(time.Hour); !lease.ExpiresAt.Equal(want) {
+		t.Fatalf("lease expires at %s, want %s", lease.ExpiresAt, want)
+	}
+
+	clock.Advance(time.Hour - time.Second)
+	s.reapExpired(clock.Now())
+	if _, ok := s.Lease(mac); !ok {
+		t.Fatal("lease reaped a second before it expires")
+	}
+	clock.Advance(2 * time.Second)
+	if expired := s.reapExpired(clock.Now()); len(expired) != 1 {
+		t.Fatalf("reaped %d leases, want 1", len(expired))
+	}
+	if _, ok := s.Lease(mac); ok {
+		t.Fatal("expired lease is still held")
+	}
+	if !isFree(t, s, ip) {
+		t.Errorf("%s did not return to the pool", ip)
+	}
+}
+
+func TestOfferTimeout(t *testing.T) {
+	s, clock := newClockedServer(t, testSubnetConfig())
+	mac := testMAC(1)
+	offer := serve(t, s, newDiscover(t, mac))
+	if offer == nil {
+		t.Fatal("got no OFFER")
+	}
+	if lease, _ := s.Lease(mac); lease.State != StateOffered {
+		t.Fatalf("lease is %s, want offered", lease.State)
+	}
+
+	clock.Advance(s.offerTimeout + time.Second)
+	s.reapExpired(clock.Now())
+	if _, ok := s.Lease(mac); ok {
+		t.Fatal("lapsed offer is still held")
+	}
+	if !isFree(t, s, offer.YourIPAddr) {
+		t.Errorf("offered %s did not return to the pool", offer.YourIPAddr)
+	}
+}
+
+func TestReaperRunsOnTicker(t *testing.T) {
+	s, clock := newClockedServer(t, testSubnetConfig())
+	mac := testMAC(1)
+	bind(t, s, mac, net.IPv4(10, 0, 0, 50))
+	clock.Advance(time.Hour + time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.RunReaper(ctx, time.Minute)
+	clock.BlockUntil(1)
+
+	// A tick a receiver is not ready for is dropped, so deliver only one
+	clock.Advance(time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := s.Lease(mac); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("reaper did not expire the lease after its tick")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReuseDelay(t *testing.T) {
+	cfg := testSubnetConfig()
+	cfg.ReuseDelay = 600
+	s, clock := newClockedServer(t, cfg)
+	ip := net.IPv4(10, 0, 0, 50).To4()
+	bind(t, s, testMAC(1), ip)
+
+	clock.Advance(time.Hour + time.Second)
+	s.reapExpired(clock.Now())
+	s.mutex.Lock()
+	cooling := s.pool.isCooling(poolOffset(t, s, ip))
+	s.mutex.Unlock()
+	if !cooling || isFree(t, s, ip) {
+		t.Fatalf("expired %s is not cooling down", ip)
+	}
+
+	warm := func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.pool.warm(clock.Now())
+	}
+	clock.Advance(599 * time.Second)
+	warm()
+	if isFree(t, s, ip) {
+		t.Fatalf("%s was freed a second before its reuse delay ended", ip)
+	}
+	clock.Advance(time.Second)
+	warm()
+	if !isFree(t, s, ip) {
+		t.Fatalf("%s is not free after its reuse delay", ip)
+	}
+}
+
+func TestDeclineQuarantine(t *testing.T) {
+	cfg := testSubnetConfig()
+	cfg.DeclineCooldown = 300
+	s, clock := newClockedServer(t, cfg)
+	mac, ip := testMAC(1), net.IPv4(10, 0, 0, 50).To4()
+	bind(t, s, mac, ip)
+
+	serve(t, s, newDecline(t, mac, ip))
+	if q := s.Quarantined(); len(q) != 1 || q[0].IP != ip.String() || !q[0].DeclinedAt.Equal(testEpoch) {
+		t.Fatalf("quarantined %v, want %s declined at %s", q, ip, testEpoch)
+	}
+
+	clock.Advance(299 * time.Second)
+	s.reapExpired(clock.Now())
+	if len(s.Quarantined()) != 1 || isFree(t, s, ip) {
+		t.Fatalf("%s left quarantine a second before its cooldown ended", ip)
+	}
+	clock.Advance(time.Second)
+	s.reapExpired(clock.Now())
+	if q := s.Quarantined(); len(q) != 0 {
+		t.Fatalf("still quarantined after the cooldown: %v", q)
+	}
+	if !isFree(t, s, ip) {
+		t.Errorf("%s did not return to the pool after its cooldown", ip)
+	}
+}
+
+func TestRenewalTimes(t *testing.T) {
+	for _, jitter := range []int{0, 10} {
+		cfg := testSubnetConfig()
+		cfg.LeaseJitterPercent = jitter
+		s, clock := newClockedServer(t, cfg)
+		clock.Advance(90 * time.Second)
+		ack := bind(t, s, testMAC(1), net.IPv4(10, 0, 0, 50))
+
+		leaseTime := ack.IPAddressLeaseTime(0)
+		lease, _ := s.Lease(testMAC(1))
+		if want := clock.Now().Add(leaseTime); !lease.ExpiresAt.Equal(want) {
+			t.Errorf("jitter %d%%: lease expires at %s, want %s", jitter, lease.ExpiresAt, want)
+		}
+		if jitter == 0 {
+			if leaseTime != time.Hour {
+				t.Errorf("lease time %s, want 1h", leaseTime)
+			}
+			if ack.Options.Has(dhcpv4.OptionRenewTimeValue) || ack.Options.Has(dhcpv4.OptionRebindingTimeValue) {
+				t.Error("T1 and T2 sent without jitter; clients derive them")
+			}
+			continue
+		}
+		if leaseTime < 54*time.Minute || leaseTime > 66*time.Minute {
+			t.Errorf("jittered lease time %s is more than 10%% off 1h", leaseTime)
+		}
+		// Options carry whole seconds
+		if t1, want := ack.IPAddressRenewalTime(0), (leaseTime / 2).Truncate(time.Second); t1 != want {
+			t.Errorf("T1 %s, want %s", t1, want)
+		}
+		if t2, want := ack.IPAddressRebindingTime(0), (leaseTime * 7 / 8).Truncate(time.Second); t2 != want {
+			t.Errorf("T2 %s, want %s", t2, want)
+		}
+	}
+}
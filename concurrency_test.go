@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// TestConcurrentServeAndAPI runs DHCP traffic on two subnets sharing their lease state
+// alongside the public lease and reservation API, the reaper and reloads. It is meant
+// for go test -race, which reports any access that misses the shared mutex or a
+// subnet's configMutex.
+func TestConcurrentServeAndAPI(t *testing.T) {
+	first := testSubnetConfig()
+	second := testSubnetConfig()
+	second.Network = "10.0.1.0/24"
+	second.Gateway = StringList{"10.0.1.1"}
+	second.Range = StringList{"10.0.1.10-10.0.1.200"}
+	second.DNSServers = []string{"10.0.1.53"}
+
+	build := func() []*DHCPServer {
+		servers := []*DHCPServer{}
+		for _, cfg := range []SubnetConfig{first, second} {
+			s, err := NewDHCPServer(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			servers = append(servers, s)
+		}
+		return servers
+	}
+	subnets := build()
+	if err := joinSubnets(subnets); err != nil {
+		t.Fatal(err)
+	}
+	subnets[0].serverIP = testServerIP
+	subnets[1].serverIP = net.IPv4(10, 0, 1, 1).To4()
+	s := subnets[0]
+	handler := subnetHandler("test0", subnets, s)
+	logs := captureLog(t)
+
+	const clients, rounds = 8, 40
+	var clientsDone, backgroundDone sync.WaitGroup
+	var acks atomic.Int32
+	done := make(chan struct{})
+
+	// Clients on both subnets run DISCOVER, REQUEST and RELEASE, the second subnet's
+	// through a relay
+	for c := range clients {
+		clientsDone.Add(1)
+		go func() {
+			defer clientsDone.Done()
+			mac := testMAC(byte(1 + c))
+			serverID, relay := testServerIP, net.IP(nil)
+			if c%2 == 1 {
+				serverID, relay = subnets[1].serverIP, net.IPv4(10, 0, 1, 1).To4()
+			}
+			send := func(modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+				if relay != nil {
+					modifiers = append(modifiers, dhcpv4.WithRelay(relay))
+				}
+				p, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithHwAddr(mac)}, modifiers...)...)
+				if err != nil {
+					t.Error(err)
+					return nil
+				}
+				conn := &fakeConn{}
+				handler(conn, clientPeer, p)
+				if len(conn.writes) == 0 {
+					return nil
+				}
+				reply, err := dhcpv4.FromBytes(conn.writes[0])
+				if err != nil {
+					t.Error(err)
+					return nil
+				}
+				return reply
+			}
+			for range rounds {
+				offer := send(dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+				if offer == nil {
+					continue
+				}
+				ack := send(dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+					dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offer.YourIPAddr)),
+					dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)))
+				if ack != nil && ack.MessageType() == dhcpv4.MessageTypeAck {
+					acks.Add(1)
+				}
+				send(dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+					dhcpv4.WithClientIP(offer.YourIPAddr),
+					dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)))
+			}
+		}()
+	}
+
+	// API callers, the reaper and reloads run until the clients are done, pausing
+	// between rounds so they do not starve the clients of the mutex
+	background := func(work func(i int)) {
+		backgroundDone.Add(1)
+		go func() {
+			defer backgroundDone.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				case <-time.After(100 * time.Microsecond):
+				}
+				work(i)
+			}
+		}()
+	}
+	background(func(i int) {
+		for _, lease := range s.Leases() {
+			s.Lease(lease.MAC)
+		}
+		s.Quarantined()
+	})
+	background(func(i int) {
+		s.Reservations()
+	})
+	background(func(i int) {
+		mac, ip := testMAC(byte(100+i%4)), net.IPv4(10, 0, byte(i%2), byte(220+i%4)).To4()
+		if err := s.AddReservation(mac, ip); err == nil {
+			s.RemoveReservation(mac)
+		}
+		s.ReleaseLease(testMAC(byte(1 + i%clients)))
+		s.ExpireLease(testMAC(byte(1 + i%clients)))
+		s.PinLease(testMAC(byte(1 + i%clients)))
+		s.RemoveReservation(testMAC(byte(1 + i%clients)))
+	})
+	background(func(i int) {
+		mac := testMAC(byte(200 + i%4))
+		if _, err := s.AllocateFor(mac); err == nil {
+			s.Release(mac)
+		}
+	})
+	background(func(i int) {
+		events := s.Subscribe()
+		s.reapExpired(time.Now())
+		s.Unsubscribe(events)
+	})
+	background(func(i int) {
+		next := build()
+		subnets[i%2].Reload(next[i%2])
+	})
+
+	clientsDone.Wait()
+	close(done)
+	backgroundDone.Wait()
+
+	if bytes.Contains(logs.Bytes(), []byte("Recovered from panic")) {
+		t.Fatalf("a handler panicked:\n%s", logs)
+	}
+	if n := acks.Load(); n < clients*rounds/2 {
+		t.Errorf("only %d of %d exchanges were acknowledged", n, clients*rounds)
+	}
+}
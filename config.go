@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SubnetDefaults holds settings inherited by every subnet that does not set them itself
+type SubnetDefaults struct {
+	LeaseDuration int                  `yaml:"lease_duration,omitempty"`
+	DNSServers    []string             `yaml:"dns_servers,omitempty"`
+	DomainName    *string              `yaml:"domain_name,omitempty"`
+	VendorOptions []VendorOptionConfig `yaml:"vendor_options,omitempty"`
+	VIVSO         VIVSOList            `yaml:"vivso,omitempty"`
+	Options       []CustomOptionConfig `yaml:"options,omitempty"`
+	AllowMACs     []string             `yaml:"allow_macs,omitempty"`
+	DenyMACs      []string             `yaml:"deny_macs,omitempty"`
+}
+
+// loadConfig reads and parses the configuration file and resolves secrets and subnet
+// defaults
+func loadConfig(path string) (*Config, error) {
+	configData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if err := config.resolveSecrets(); err != nil {
+		return nil, err
+	}
+
+	// Merge reservations added at runtime through the API into their subnets
+	if config.ReservationsFile != "" {
+		saved, err := loadReservationsFile(config.ReservationsFile)
+		if err != nil {
+			return nil, err
+		}
+		for mac, res := range saved {
+			subnet := config.subnetFor(net.ParseIP(res.IP))
+			if subnet.ReservedAddresses == nil {
+				subnet.ReservedAddresses = make(map[string]ReservationConfig)
+			}
+			subnet.ReservedAddresses[mac] = res
+		}
+	}
+
+	config.SubnetConfig = applyDefaults(config.SubnetConfig, config.Defaults)
+	for i := range config.Subnets {
+		config.Subnets[i] = applyDefaults(config.Subnets[i], config.Defaults)
+	}
+	return &config, nil
+}
+
+// subnetFor returns the configured subnet whose network contains ip, falling back to
+// the top-level one
+func (c *Config) subnetFor(ip net.IP) *SubnetConfig {
+	for i := range c.Subnets {
+		if _, network, err := net.ParseCIDR(c.Subnets[i].Network); err == nil && ip != nil && network.Contains(ip) {
+			return &c.Subnets[i]
+		}
+	}
+	return &c.SubnetConfig
+}
+
+// applyDefaults fills the settings a subnet leaves unset from defaults. A list set to
+// an explicit empty value in the subnet is kept empty rather than inherited.
+func applyDefaults(subnet SubnetConfig, defaults SubnetDefaults) SubnetConfig {
+	if subnet.LeaseDuration == 0 {
+		subnet.LeaseDuration = defaults.LeaseDuration
+	}
+	if subnet.DNSServers == nil {
+		subnet.DNSServers = defaults.DNSServers
+	}
+	if subnet.DomainName == nil {
+		subnet.DomainName = defaults.DomainName
+	}
+	if subnet.VendorOptions == nil {
+		subnet.VendorOptions = defaults.VendorOptions
+	}
+	if subnet.VIVSO == nil {
+		subnet.VIVSO = defaults.VIVSO
+	}
+	if subnet.Options == nil {
+		subnet.Options = defaults.Options
+	}
+	if subnet.AllowMACs == nil {
+		subnet.AllowMACs = defaults.AllowMACs
+	}
+	if subnet.DenyMACs == nil {
+		subnet.DenyMACs = defaults.DenyMACs
+	}
+	return subnet
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"gopkg.in/yaml.v3"
+)
+
+// FuzzConfig feeds arbitrary YAML through the config parser and NewDHCPServer. Every
+// input must either be rejected or give pools that are bounded and consistent with
+// the network.
+func FuzzConfig(f *testing.F) {
+	seeds := []string{
+		"network: 10.0.0.0/24\nrange: 10.0.0.10-10.0.0.200\ngateway: 10.0.0.1\nlease_duration: 3600\n",
+		"network: 10.0.0.0/24\nrange: 10.0.0.200-10.0.0.10\n",
+		"network: 10.0.0.0/24\nrange: 10.0.0.128/26\n",
+		"network: 0.0.0.0/0\nrange: 0.0.0.0-255.255.255.255\n",
+		"network: 10.0.0.0/8\nrange: 10.0.0.0/8\n",
+		"network: 10.0.0.0/24\nrange: [\"10.0.0.10-10.0.0.20\", \"10.0.0.15-10.0.0.30\"]\n",
+		"network: 10.0.0.0/24\nrange: 010.0.0.1-10.0.0.9\n",
+		"network: 10.0.0.0/24\nrange: ::ffff:10.0.0.1-::ffff:10.0.0.9\n",
+		"network: 10.0.0.0/31\nrange: 10.0.0.0/31\n",
+		"network: 10.0.0.0/24\nrange: 10.0.0.10-10.0.0.200\nreserved_addresses:\n  aa:bb:cc:dd:ee:ff: 10.0.0.255\n",
+		"network: 10.0.0.0/24\nrange: 10.0.0.10-10.0.0.200\nclasses:\n  - name: phones\n    vendor_class: phone\n    range: 10.0.0.100-10.0.0.120\n",
+		"network: 10.0.0.0/24\nrange: 10.0.0.10-10.0.0.200\nsubnets:\n  - network: 10.1.0.0/16\n    range: 10.1.0.0/16\n",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		var config Config
+		if err := yaml.Unmarshal([]byte(data), &config); err != nil {
+			return
+		}
+		subnets := []SubnetConfig{applyDefaults(config.SubnetConfig, config.Defaults)}
+		for _, subnet := range config.Subnets {
+			subnets = append(subnets, applyDefaults(subnet, config.Defaults))
+		}
+		for _, subnet := range subnets {
+			s, err := NewDHCPServer(subnet)
+			if err != nil {
+				continue
+			}
+			for _, pool := range s.pools() {
+				if pool.size == 0 || pool.size > maxPoolSize {
+					t.Fatalf("pool %s-%s holds %d addresses, want 1 to %d", pool.start, pool.end, pool.size, maxPoolSize)
+				}
+				if uint64(pool.capacity) > pool.size || pool.available > pool.capacity || pool.available < 0 {
+					t.Fatalf("pool %s-%s: %d available of %d usable in %d addresses", pool.start, pool.end, pool.available, pool.capacity, pool.size)
+				}
+				if uint64(len(pool.taken))*64 < pool.size {
+					t.Fatalf("pool %s-%s: bitmap of %d words for %d addresses", pool.start, pool.end, len(pool.taken), pool.size)
+				}
+				if !s.network.Contains(pool.start) || !s.network.Contains(pool.end) {
+					t.Fatalf("pool %s-%s lies outside network %s", pool.start, pool.end, s.network)
+				}
+				if ipToUint32(pool.end)-ipToUint32(pool.start)+1 != uint32(pool.size) && pool.size != 1<<32 {
+					t.Fatalf("pool %s-%s has size %d", pool.start, pool.end, pool.size)
+				}
+			}
+		}
+	})
+}
+
+// TestDNSServersDefault loads a config whose defaults name a DNS server and checks
+// option 6 in the ACK of each subnet: one that omits dns_servers inherits the default,
+// one that sets it keeps its own, and one that sets it to [] sends no option 6
+func TestDNSServersDefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := `defaults:
+  dns_servers: ["10.9.9.9"]
+  lease_duration: 3600
+network: 10.0.0.0/24
+range: 10.0.0.10-10.0.0.200
+subnets:
+  - network: 10.0.1.0/24
+    range: 10.0.1.10-10.0.1.200
+    dns_servers: ["10.0.1.53"]
+  - network: 10.0.2.0/24
+    range: 10.0.2.10-10.0.2.200
+    dns_servers: []
+`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Subnets) != 2 {
+		t.Fatalf("loaded %d extra subnets, want 2", len(loaded.Subnets))
+	}
+	for _, tc := range []struct {
+		subnet SubnetConfig
+		ip     net.IP
+		want   []byte // Value of option 6, nil for none
+	}{
+		{loaded.SubnetConfig, net.IPv4(10, 0, 0, 20), []byte{10, 9, 9, 9}},
+		{loaded.Subnets[0], net.IPv4(10, 0, 1, 20), []byte{10, 0, 1, 53}},
+		{loaded.Subnets[1], net.IPv4(10, 0, 2, 20), nil},
+	} {
+		t.Run(tc.subnet.Network, func(t *testing.T) {
+			ack := bind(t, newTestServer(t, tc.subnet), testMAC(1), tc.ip.To4())
+			if got := ack.Options.Get(dhcpv4.OptionDomainNameServer); !bytes.Equal(got, tc.want) {
+				t.Errorf("option 6 = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Conflict detection modes
+const (
+	conflictDetectionOff    = "off"
+	conflictDetectionAlways = "always"
+	conflictDetectionLazy   = "lazy" // Probe only addresses not seen in use recently
+)
+
+// defaultConflictRecheckInterval is how long an address seen in use by one of our
+// clients, or probed clear, is trusted without another probe in lazy mode
+const defaultConflictRecheckInterval = 24 * time.Hour
+
+// parseConflictDetection returns the conflict detection mode of the subnet. An unset
+// conflict_detection follows ping_check.
+func parseConflictDetection(mode string, pingCheck bool) (string, error) {
+	switch mode {
+	case "":
+		if pingCheck {
+			return conflictDetectionAlways, nil
+		}
+		return conflictDetectionOff, nil
+	case conflictDetectionOff:
+		if pingCheck {
+			return "", fmt.Errorf("ping_check conflicts with conflict_detection: off")
+		}
+	case conflictDetectionAlways, conflictDetectionLazy:
+	default:
+		return "", fmt.Errorf("invalid conflict_detection %q: must be off, always or lazy", mode)
+	}
+	return mode, nil
+}
+
+// shouldProbe reports whether ip, newly taken from the pool, needs a conflict probe
+func (s *DHCPServer) shouldProbe(ip net.IP, now time.Time) bool {
+	switch s.conflictDetection {
+	case conflictDetectionAlways:
+		return true
+	case conflictDetectionLazy:
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		seen, exists := s.addressSeen[ip.String()]
+		return !exists || now.Sub(seen) >= s.conflictRecheck
+	}
+	return false
+}
+
+// markSeen records that ip was in use by one of our clients, or probed clear, at now.
+// The caller must hold s.mutex.
+func (s *DHCPServer) markSeen(ip net.IP, now time.Time) {
+	s.addressSeen[ip.String()] = now
+}
+
+// pruneSeen forgets addresses that were last seen longer ago than the recheck
+// interval of their subnet. The caller must hold s.mutex.
+func (s *DHCPServer) pruneSeen(now time.Time) {
+	for ipStr, seen := range s.addressSeen {
+		if now.Sub(seen) >= s.ownerOf(net.ParseIP(ipStr)).conflictRecheck {
+			delete(s.addressSeen, ipStr)
+		}
+	}
+}
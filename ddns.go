@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DDNSConfig enables dynamic DNS updates (RFC 2136) for bound leases
+type DDNSConfig struct {
+	Server      string         `yaml:"server"`                 // Name server accepting updates, host or host:port
+	Zone        string         `yaml:"zone"`                   // Forward zone of the A records
+	ReverseZone string         `yaml:"reverse_zone,omitempty"` // Zone of the PTR records, empty for the /24 of each address
+	TTL         int            `yaml:"ttl,omitempty"`          // Seconds, 0 for the default
+	Key         *DDNSKeyConfig `yaml:"key,omitempty"`          // TSIG key, nil for unsigned updates
+}
+
+// DDNSKeyConfig is a TSIG key for signing updates
+type DDNSKeyConfig struct {
+	Name      string `yaml:"name"`
+	Algorithm string `yaml:"algorithm,omitempty"` // e.g. hmac-sha256 (the default) or hmac-sha512
+	Secret    string `yaml:"secret"`              // Base64, as in a BIND key statement
+}
+
+// Defaults of the DDNS updater
+const (
+	defaultDDNSTTL     = 300
+	ddnsTimeout        = 5 * time.Second
+	ddnsQueueSize      = 256
+	ddnsTSIGFudge      = 300
+	defaultDDNSKeyAlgo = dns.HmacSHA256
+)
+
+// ddnsUpdate adds or deletes the records of one address
+type ddnsUpdate struct {
+	add  bool
+	name string // Fully qualified host name
+	ip   net.IP
+}
+
+// ddnsUpdater sends updates to the name server one at a time, in the order they were
+// queued, so the DHCP handlers never wait for DNS
+type ddnsUpdater struct {
+	server      string
+	zone        string
+	reverseZone string
+	ttl         uint32
+	keyName     string
+	keyAlgo     string
+	client      *dns.Client
+	queue       chan ddnsUpdate
+}
+
+// newDDNSUpdater validates cfg and returns an updater for it
+func newDDNSUpdater(cfg *DDNSConfig) (*ddnsUpdater, error) {
+	if cfg.Server == "" || cfg.Zone == "" {
+		return nil, fmt.Errorf("ddns: server and zone are required")
+	}
+	if cfg.TTL < 0 {
+		return nil, fmt.Errorf("ddns: ttl must not be negative")
+	}
+	server := cfg.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	u := &ddnsUpdater{
+		server: server,
+		zone:   dns.Fqdn(strings.ToLower(cfg.Zone)),
+		ttl:    defaultDDNSTTL,
+		client: &dns.Client{Timeout: ddnsTimeout},
+		queue:  make(chan ddnsUpdate, ddnsQueueSize),
+	}
+	if cfg.ReverseZone != "" {
+		u.reverseZone = dns.Fqdn(strings.ToLower(cfg.ReverseZone))
+	}
+	if cfg.TTL > 0 {
+		u.ttl = uint32(cfg.TTL)
+	}
+	if cfg.Key != nil {
+		if cfg.Key.Name == "" || cfg.Key.Secret == "" {
+			return nil, fmt.Errorf("ddns: key name and secret are required")
+		}
+		u.keyName = dns.Fqdn(strings.ToLower(cfg.Key.Name))
+		u.keyAlgo = defaultDDNSKeyAlgo
+		if cfg.Key.Algorithm != "" {
+			u.keyAlgo = dns.Fqdn(strings.ToLower(cfg.Key.Algorithm))
+		}
+		switch u.keyAlgo {
+		case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		default:
+			return nil, fmt.Errorf("ddns: unsupported key algorithm %s", cfg.Key.Algorithm)
+		}
+		u.client.TsigSecret = map[string]string{u.keyName: cfg.Key.Secret}
+	}
+	return u, nil
+}
+
+// Run sends queued updates until ctx is canceled
+func (u *ddnsUpdater) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update := <-u.queue:
+			action := "delete"
+			if update.add {
+				action = "add"
+			}
+			if err := u.apply(update); err != nil {
+				log.Printf("DDNS %s of %s (%s) failed: %v", action, update.name, update.ip, err)
+			} else {
+				log.Printf("DDNS %s of %s (%s) done", action, update.name, update.ip)
+			}
+		}
+	}
+}
+
+// enqueue queues update without blocking, dropping it if the queue is full
+func (u *ddnsUpdater) enqueue(update ddnsUpdate) {
+	select {
+	case u.queue <- update:
+	default:
+		log.Printf("DDNS queue full, dropping update of %s (%s)", update.name, update.ip)
+	}
+}
+
+// hostFQDN returns the fully qualified name of hostname in the forward zone
+func (u *ddnsUpdater) hostFQDN(hostname string) string {
+	return dns.Fqdn(strings.ToLower(hostname)) + u.zone
+}
+
+// apply sends the A record update to the forward zone and the PTR update to the
+// reverse zone
+func (u *ddnsUpdater) apply(update ddnsUpdate) error {
+	arpa, err := dns.ReverseAddr(update.ip.String())
+	if err != nil {
+		return err
+	}
+	a := &dns.A{Hdr: dns.RR_Header{Name: update.name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: u.ttl}, A: update.ip.To4()}
+	ptr := &dns.PTR{Hdr: dns.RR_Header{Name: arpa, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: u.ttl}, Ptr: update.name}
+
+	forward := new(dns.Msg)
+	forward.SetUpdate(u.zone)
+	reverse := new(dns.Msg)
+	reverse.SetUpdate(u.reverseZoneOf(arpa))
+	if update.add {
+		// Replace whatever the name and the address pointed to before
+		forward.RemoveRRset([]dns.RR{a})
+		forward.Insert([]dns.RR{a})
+		reverse.RemoveRRset([]dns.RR{ptr})
+		reverse.Insert([]dns.RR{ptr})
+	} else {
+		// Only remove records that still point at this binding
+		forward.Remove([]dns.RR{a})
+		reverse.Remove([]dns.RR{ptr})
+	}
+	if err := u.send(forward); err != nil {
+		return fmt.Errorf("A record: %w", err)
+	}
+	if err := u.send(reverse); err != nil {
+		return fmt.Errorf("PTR record: %w", err)
+	}
+	return nil
+}
+
+// reverseZoneOf returns the zone holding the PTR record arpa: the configured reverse
+// zone, or the /24 reverse zone of the address
+func (u *ddnsUpdater) reverseZoneOf(arpa string) string {
+	if u.reverseZone != "" {
+		return u.reverseZone
+	}
+	return arpa[strings.Index(arpa, ".")+1:]
+}
+
+// send signs m if a key is configured and sends it, checking the response code
+func (u *ddnsUpdater) send(m *dns.Msg) error {
+	if u.keyName != "" {
+		m.SetTsig(u.keyName, u.keyAlgo, ddnsTSIGFudge, time.Now().Unix())
+	}
+	r, _, err := u.client.Exchange(m, u.server)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("server answered %s", dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
+
+// registerDNS queues adding the A and PTR records of a bound lease. The caller must
+// hold s.mutex.
+func (s *DHCPServer) registerDNS(lease *Lease) {
+	if s.ddns == nil {
+		return
+	}
+	if hostname := s.leaseHostname(lease); hostname != "" {
+		s.ddns.enqueue(ddnsUpdate{add: true, name: s.ddns.hostFQDN(hostname), ip: lease.IP})
+	}
+}
+
+// unregisterDNS queues removing the records of a bound lease that ended. The caller
+// must hold s.mutex.
+func (s *DHCPServer) unregisterDNS(lease *Lease) {
+	if s.ddns == nil {
+		return
+	}
+	if hostname := s.leaseHostname(lease); hostname != "" {
+		s.ddns.enqueue(ddnsUpdate{name: s.ddns.hostFQDN(hostname), ip: lease.IP})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// defaultRequestTimeout bounds the handling of one packet, well below the few seconds
+// after which clients retransmit
+const defaultRequestTimeout = 2 * time.Second
+
+// requestContext returns the context bounding the handling of one packet
+func (s *DHCPServer) requestContext() (context.Context, context.CancelFunc) {
+	timeout := s.requestTimeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// replyExpired reports whether ctx ended before the reply to p could be sent, logging
+// that the reply is dropped
+func replyExpired(ctx context.Context, p *dhcpv4.DHCPv4) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	log.Printf("Timed out handling %s from %s; dropping the reply", p.MessageType(), p.ClientHWAddr)
+	return true
+}
+
+// isTimeout reports whether err comes from an expired request context
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// saveLeasesWithin is saveLeases bounded by ctx. A write still running when ctx ends
+// is left to finish in the background.
+func (s *DHCPServer) saveLeasesWithin(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.saveLeases()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Saving leases did not finish within the request deadline; continuing in the background")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// declineIP handles a DHCPDECLINE: the client found ip already in use, so its lease
+// is dropped and the address is kept out of the pool for the decline cooldown. Only
+// the holder of the lease or offer on ip may decline it; a DECLINE from anyone else
+// would take the address away from its holder.
+func (s *DHCPServer) declineIP(mac net.HardwareAddr, ip net.IP) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	macStr := mac.String()
+	lease, exists := s.leases.Get(macStr)
+	if !exists || !lease.IP.Equal(ip) {
+		log.Printf("Ignoring DECLINE of %s from %s: it holds no lease or offer on it", ip, macStr)
+		return
+	}
+	defer s.checkUtilization()
+	s.leaseEnded("decline", lease)
+	s.leases.Delete(macStr)
+	if s.isReservedIP(ip) {
+		s.journalDeclined(mac, ip, false)
+		log.Printf("Warning: %s declined reserved address %s; check for a conflicting host", macStr, ip)
+		return
+	}
+	if s.poolFor(ip) == nil {
+		s.journalDeclined(mac, ip, false)
+		return
+	}
+	s.journalDeclined(mac, ip, true)
+	s.markDeclined(ip)
+	log.Printf("%s declined %s; withholding it for %s", macStr, ip, s.declineCooldown)
+}
+
+// markDeclined takes ip out of service until its quarantine ends, warning once it
+// reaches the decline threshold. The caller must hold s.mutex.
+func (s *DHCPServer) markDeclined(ip net.IP) {
+	if pool := s.ownerOf(ip).poolFor(ip); pool != nil {
+		pool.takeIP(ip)
+	}
+	ipStr := ip.String()
+	delete(s.addressSeen, ipStr)
+	s.declined[ipStr] = s.clock.Now()
+	s.declineCounts[ipStr]++
+	if s.declineThreshold > 0 && s.declineCounts[ipStr] == s.declineThreshold {
+		log.Printf("Warning: %s was declined %d times and stays quarantined; check for a misconfigured static host", ipStr, s.declineCounts[ipStr])
+	}
+}
+
+// reclaimDeclined returns declined addresses whose quarantine has ended to the pool.
+// The caller must hold s.mutex.
+func (s *DHCPServer) reclaimDeclined() {
+	now := s.clock.Now()
+	for ipStr, declinedAt := range s.declined {
+		if s.ownerOf(net.ParseIP(ipStr)).quarantineEnded(ipStr, declinedAt, now) {
+			s.endQuarantine(ipStr, now)
+		}
+	}
+}
+
+// endQuarantine drops ipStr from the declined addresses and returns it to the pool,
+// unless a live lease holds it again, whose address must stay taken. The caller must
+// hold s.mutex.
+func (s *DHCPServer) endQuarantine(ipStr string, now time.Time) {
+	delete(s.declined, ipStr)
+	ip := net.ParseIP(ipStr)
+	for _, lease := range s.leases.ByIP(ip) {
+		if now.Before(lease.ExpiresAt) {
+			return
+		}
+	}
+	s.releaseIP(ip)
+}
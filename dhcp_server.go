@@ -1,56 +1,210 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
-	"github.com/insomniacslk/dhcp/dhcpv4/server4"
-	"gopkg.in/yaml.v3"
 )
 
 // Config defines the configuration file structure
 type SubnetConfig struct {
-	Network           string            `yaml:"network"`
-	Gateway           string            `yaml:"gateway,omitempty"`
-	Range             string            `yaml:"range"`
-	LeaseDuration     int               `yaml:"lease_duration"`
-	DNSServers        []string          `yaml:"dns_servers,omitempty"`
-	ReservedAddresses map[string]string `yaml:"reserved_addresses,omitempty"`
+	Network                 string                       `yaml:"network"`
+	Gateway                 StringList                   `yaml:"gateway,omitempty"`    // One router or a list
+	Range                   StringList                   `yaml:"range"`                // One start-end range or a list of disjoint ones
+	Exclusions              []string                     `yaml:"exclusions,omitempty"` // Addresses and start-end ranges never handed out
+	LeaseDuration           int                          `yaml:"lease_duration"`
+	SubnetMask              string                       `yaml:"subnet_mask,omitempty"` // Option 1, overriding the mask of network
+	DNSServers              []string                     `yaml:"dns_servers,omitempty"`
+	ReservedAddresses       map[string]ReservationConfig `yaml:"reserved_addresses,omitempty"`
+	VendorOptions           []VendorOptionConfig         `yaml:"vendor_options,omitempty"`
+	VIVSO                   VIVSOList                    `yaml:"vivso,omitempty"`
+	Options                 []CustomOptionConfig         `yaml:"options,omitempty"`
+	StaticRoutes            []StaticRouteConfig          `yaml:"static_routes,omitempty"`
+	DomainName              *string                      `yaml:"domain_name,omitempty"`
+	Classes                 []ClassConfig                `yaml:"classes,omitempty"`
+	NextServer              string                       `yaml:"next_server,omitempty"`
+	BootFilename            string                       `yaml:"boot_filename,omitempty"`
+	KnownLeaseDuration      int                          `yaml:"known_lease_duration,omitempty"`
+	UnknownLeaseDuration    int                          `yaml:"unknown_lease_duration,omitempty"`
+	KnownClients            []string                     `yaml:"known_clients,omitempty"`
+	LeaseOverrides          map[string]int               `yaml:"lease_overrides,omitempty"` // MAC or prefix to lease seconds, for clients without a reservation
+	AllowMACs               []string                     `yaml:"allow_macs,omitempty"`      // MACs and OUI prefixes served; when set, all others are denied
+	DenyMACs                []string                     `yaml:"deny_macs,omitempty"`       // MACs and OUI prefixes refused service
+	MTU                     int                          `yaml:"mtu,omitempty"`             // Interface MTU (option 26), 0 to omit
+	WINSServers             []string                     `yaml:"wins_servers,omitempty"`
+	NetBIOSNodeType         int                          `yaml:"netbios_node_type,omitempty"`         // Option 46: 1, 2, 4 or 8, 0 to omit
+	ServerName              string                       `yaml:"server_name,omitempty"`               // BOOTP sname header field
+	BootfileName            string                       `yaml:"bootfile_name,omitempty"`             // BOOTP file header field, overriding boot_filename there
+	TimeServers             []string                     `yaml:"time_servers,omitempty"`              // RFC 868 time servers (option 4)
+	LogServers              []string                     `yaml:"log_servers,omitempty"`               // Syslog servers (option 7)
+	CompatOption33          bool                         `yaml:"compat_option33,omitempty"`           // Also send host routes in option 33
+	OfferTimeout            int                          `yaml:"offer_timeout,omitempty"`             // Seconds an offered address is held, 0 for the default
+	Authoritative           bool                         `yaml:"authoritative,omitempty"`             // NAK REQUESTs from denied clients
+	DenyUnknownClients      bool                         `yaml:"deny_unknown_clients,omitempty"`      // Serve only reserved and known clients
+	UnknownClientPolicy     string                       `yaml:"unknown_client_policy,omitempty"`     // allocate, ignore or reject; unset follows deny_unknown_clients
+	TrustHostnames          bool                         `yaml:"trust_hostnames,omitempty"`           // Honor reservations keyed by the client's hostname
+	Enabled                 *bool                        `yaml:"enabled,omitempty"`                   // Serve the subnet, nil for true
+	ReplySourceIP           string                       `yaml:"reply_source_ip,omitempty"`           // Source address of replies, empty to let the kernel choose
+	DeclineCooldown         int                          `yaml:"decline_cooldown,omitempty"`          // Seconds a declined address is withheld, 0 for the default
+	ServerHostname          string                       `yaml:"server_hostname,omitempty"`           // Alias of server_name
+	PingCheck               bool                         `yaml:"ping_check,omitempty"`                // Probe new addresses before offering them
+	PingTimeout             int                          `yaml:"ping_timeout,omitempty"`              // Probe timeout in milliseconds, 0 for the default
+	ConflictDetection       string                       `yaml:"conflict_detection,omitempty"`        // off, always or lazy; unset follows ping_check
+	ConflictRecheckInterval int                          `yaml:"conflict_recheck_interval,omitempty"` // Seconds an address seen in use stays trusted in lazy mode, 0 for the default
+	QuarantineProbeInterval int                          `yaml:"quarantine_probe_interval,omitempty"` // Seconds between re-probes of quarantined addresses, 0 to disable
+	QuarantineMaxAge        int                          `yaml:"quarantine_max_age,omitempty"`        // Seconds after which a quarantined address is released unprobed, 0 for never
+	DeclineThreshold        int                          `yaml:"decline_threshold,omitempty"`         // Declines after which an address stays quarantined, 0 for no limit
+	AllocationPolicy        string                       `yaml:"allocation_policy,omitempty"`         // sequential (default), random or hash
+	ReuseDelay              int                          `yaml:"reuse_delay,omitempty"`               // Seconds an expired address cools down before new clients get it, 0 to reuse at once
+	ReusePressure           int                          `yaml:"reuse_pressure,omitempty"`            // Percentage of the pool in use at which cooling addresses are reused early, 0 for 100
+	LeaseJitterPercent      int                          `yaml:"lease_jitter_percent,omitempty"`      // Spread of granted lease times around the configured one, 0 for none
+	EmergencyFreePercent    int                          `yaml:"emergency_free_percent,omitempty"`    // Free share of a pool below which short leases are granted, 0 to disable
+	EmergencyLeaseDuration  int                          `yaml:"emergency_lease_duration,omitempty"`  // Seconds of an emergency lease, 0 for the default
+	UtilizationWarnings     []int                        `yaml:"utilization_warnings,omitempty"`      // Percentages in use at which to warn, ascending
 }
 
 type Config struct {
-	Interface     string        `yaml:"interface,omitempty"`
-	Network       string        `yaml:"network"`
-	Gateway       string        `yaml:"gateway,omitempty"`
-	Range         string        `yaml:"range"`
-	LeaseDuration int           `yaml:"lease_duration"`
-	DNSServers    []string      `yaml:"dns_servers,omitempty"`
-	ReservedAddresses map[string]string `yaml:"reserved_addresses,omitempty"`
+	Interface             string   `yaml:"interface,omitempty"`
+	Interfaces            []string `yaml:"interfaces,omitempty"` // Serve several interfaces, overriding interface
+	SubnetConfig          `yaml:",inline"`
+	Defaults              SubnetDefaults `yaml:"defaults,omitempty"`
+	APIListen             string         `yaml:"api_listen,omitempty"`
+	APIToken              string         `yaml:"api_token,omitempty"`
+	ReservationsFile      string         `yaml:"reservations_file,omitempty"`
+	DetectRogueServers    bool           `yaml:"detect_rogue_servers,omitempty"`
+	LeaseFile             string         `yaml:"lease_file,omitempty"`
+	DebugOptions          bool           `yaml:"debug_options,omitempty"`
+	LeaseStore            string         `yaml:"lease_store,omitempty"`   // file (default), sqlite or bolt
+	LeaseJournal          string         `yaml:"lease_journal,omitempty"` // Append-only lease event journal, empty to disable
+	JournalFsync          string         `yaml:"journal_fsync,omitempty"` // always (default), interval or never
+	LeaseDBPath           string         `yaml:"lease_db_path,omitempty"`
+	ReapInterval          int            `yaml:"reap_interval,omitempty"`           // Seconds between expired lease sweeps, 0 for the default
+	RebindRetries         int            `yaml:"rebind_retries,omitempty"`          // Rebind attempts after a listener fails, 0 for the default, negative to exit at once
+	RebindMaxBackoff      int            `yaml:"rebind_max_backoff,omitempty"`      // Seconds between rebind attempts at most, 0 for the default
+	Subnets               []SubnetConfig `yaml:"subnets,omitempty"`                 // Further subnets, reached through interfaces or relays
+	RequestTimeout        int            `yaml:"request_timeout,omitempty"`         // Milliseconds to handle one packet, 0 for the default
+	AddressHistory        int            `yaml:"address_history,omitempty"`         // Past addresses remembered per client, 0 for the default
+	AddressHistoryMaxAge  int            `yaml:"address_history_max_age,omitempty"` // Seconds a past address is remembered, 0 for the default
+	DDNS                  *DDNSConfig    `yaml:"ddns,omitempty"`                    // Dynamic DNS updates, nil to disable
+	WebhookURL            string         `yaml:"webhook_url,omitempty"`             // Receives lease events as JSON, empty to disable
+	ExpiryWarningFraction float64        `yaml:"expiry_warning_fraction,omitempty"` // Announce leases not renewed by this fraction of their term, 0 to disable
+	LogDest               string         `yaml:"log_dest,omitempty"`                // stderr (default) or syslog
+	SyslogAddr            string         `yaml:"syslog_addr,omitempty"`             // Remote syslog host:port, empty for the local daemon
 }
 
 // Lease represents a DHCP lease
 type Lease struct {
-	IP        net.IP
-	MAC       net.HardwareAddr
-	ExpiresAt time.Time
+	IP          net.IP           `json:"ip"`
+	MAC         net.HardwareAddr `json:"-"` // Stored as the key of the lease file
+	ExpiresAt   time.Time        `json:"expires_at"`
+	Class       string           `json:"class,omitempty"`       // Name of the client class, empty if none matched
+	State       LeaseState       `json:"state"`                 // Offered or bound while in the store
+	Fingerprint string           `json:"fingerprint,omitempty"` // Option 55 codes in request order, comma-separated
+	Hostname    string           `json:"hostname,omitempty"`    // Sanitized client hostname (option 12), empty if not sent
+	FQDN        string           `json:"fqdn,omitempty"`        // Name from the Client FQDN option (81), empty if not sent
+	StartedAt   time.Time        `json:"started_at"`            // When the client was first given this address
+	LeaseTime   int              `json:"lease_time,omitempty"`  // Seconds granted per renewal, after jitter
+	Reservation string           `json:"reservation,omitempty"` // Key of the reservation that matched: the MAC, "id:" and the client identifier, or "hostname:" and the hostname
 }
 
+// granted returns the lease time given to the client with its last OFFER or ACK
+func (l *Lease) granted() time.Duration {
+	return time.Duration(l.LeaseTime) * time.Second
+}
+
+// reservationKey returns the key under which the lease's reservation, if any, is found
+func (l *Lease) reservationKey() string {
+	if l.Reservation != "" {
+		return l.Reservation
+	}
+	return l.MAC.String()
+}
+
+// allocation is the address chosen for a client together with the settings that apply to it
+type allocation struct {
+	ip            net.IP
+	leaseDuration time.Duration
+	host          *reservation // Per-host overrides, nil for dynamic clients
+	class         *clientClass // Matched client class, nil if none
+	fresh         bool         // Newly taken from the pool rather than renewed
+}
+
+// minLeaseDuration is the shortest lease_duration in seconds accepted without a warning
+const minLeaseDuration = 60
+
+// defaultOfferTimeout is how long an offered address is held waiting for a REQUEST
+const defaultOfferTimeout = 60 * time.Second
+
+// defaultDeclineCooldown is how long a declined address is kept out of the pool
+const defaultDeclineCooldown = time.Hour
+
+// Errors returned by getIPForClient, wrapped with details. NewDHCPServer and
+// AddReservation also wrap ErrInvalidReservation around a broken reservation.
+var (
+	ErrPoolExhausted      = errors.New("no available IPs")
+	ErrInvalidReservation = errors.New("invalid reservation")
+)
+
 // DHCPServer defines the DHCP server
 type DHCPServer struct {
-	subnetConfig SubnetConfig
-	leases       map[string]*Lease // MAC string to Lease
-	availableIPs []net.IP
-	mutex        sync.Mutex
-	subnetMask   net.IPMask
-	gateway      net.IP
-	dnsServers   []net.IP
+	*leaseState         // Shared with the other subnets
+	subnetConfig        SubnetConfig
+	pool                *addressPool
+	configMutex         sync.RWMutex // Held for reading while serving, for writing by Reload
+	network             *net.IPNet
+	subnetMask          net.IPMask
+	gateway             net.IP // First router, used for the default route and as siaddr fallback
+	routers             []net.IP
+	serverIP            net.IP // Address of the bound interface, nil if unknown
+	replySource         net.IP // Source address of replies, nil to let the kernel choose
+	dnsServers          []net.IP
+	vendorOptions       []vendorOption
+	vivso               []byte // Encoded option 125 data, nil if not configured
+	customOptions       []dhcpv4.Option
+	reservations        map[string]*reservation // MAC string to reservation
+	prefixReservations  []*prefixReservation    // Longest prefix first
+	leaseOverrides      []leaseOverride         // Longest prefix first
+	patternReservations []*patternReservation   // Most specific first
+	exclusions          [][2]net.IP             // Ranges never handed out dynamically
+	staticRoutes        []*dhcpv4.Route
+	classes             []*clientClass
+	nextServer          net.IP              // Configured siaddr, nil to use nextServerIP
+	knownClients        map[string]struct{} // Normalized MACs and client identifiers
+	macFilter           *macFilter          // nil to serve every MAC
+	winsServers         []net.IP
+	serverName          string // sname header field, empty to leave it blank
+	headerBootFile      string // file header field, empty to use the boot file
+	timeServers         []net.IP
+	logServers          []net.IP
+	offerTimeout        time.Duration
+	declineCooldown     time.Duration
+
+	quarantineProbeInterval time.Duration
+	quarantineMaxAge        time.Duration
+	declineThreshold        int
+	conflictDetection       string        // off, always or lazy
+	conflictRecheck         time.Duration // How long a seen address is not probed in lazy mode
+	unknownClientPolicy     string        // allocate, ignore or reject
+	debugOptions            bool          // Log the options of every OFFER and ACK
+	iface                   string        // Interface the subnet is served on, used for conflict probes
+	requestTimeout          time.Duration // Deadline for handling one packet, 0 for the default
+	utilizationWarnings     []int         // Percentages in use at which to warn, ascending
+	utilizationLevel        int           // Number of warning thresholds reached at the last check
+	unknownDenials          unknownDenials
 }
 
 // NewDHCPServer creates a new DHCP server instance from a subnet configuration
@@ -60,139 +214,990 @@ func NewDHCPServer(subnetConfig SubnetConfig) (*DHCPServer, error) {
 		return nil, fmt.Errorf("invalid network CIDR: %w", err)
 	}
 
-	// Parse the IP range
-	rangeParts := strings.Split(subnetConfig.Range, "-")
-	if len(rangeParts) != 2 {
-		return nil, fmt.Errorf("invalid range format: %s", subnetConfig.Range)
+	// Parse the IP ranges
+	startIP, endIP, ranges, err := parseRanges(subnetConfig.Range)
+	if err != nil {
+		return nil, err
 	}
-	startIP := net.ParseIP(rangeParts[0])
-	endIP := net.ParseIP(rangeParts[1])
-	if startIP == nil || endIP == nil {
-		return nil, fmt.Errorf("invalid start or end IP in range: %s", subnetConfig.Range)
+	if !ipNet.Contains(startIP) || !ipNet.Contains(endIP) {
+		return nil, fmt.Errorf("range %s is outside network %s", strings.Join(subnetConfig.Range, ", "), ipNet)
+	}
+
+	routers, err := parseRouters(subnetConfig.Gateway, ipNet)
+	if err != nil {
+		return nil, err
+	}
+	var gateway net.IP
+	if len(routers) > 0 {
+		gateway = routers[0]
+	}
+
+	reservations, err := parseReservations(subnetConfig.ReservedAddresses, ipNet)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidReservation, err)
+	}
+	if !subnetConfig.TrustHostnames {
+		for key := range reservations {
+			if strings.HasPrefix(key, hostnameKeyPrefix) {
+				return nil, fmt.Errorf("%w: reservation for %s requires trust_hostnames: true", ErrInvalidReservation, key)
+			}
+		}
 	}
 
 	// Collect reserved IPs
-	reservedIPs := make(map[string]struct{})
-	for _, ip := range subnetConfig.ReservedAddresses {
-		reservedIPs[ip] = struct{}{}
+	reservedIPs := make([]net.IP, 0, len(reservations))
+	for _, res := range reservations {
+		reservedIPs = append(reservedIPs, res.ip)
+	}
+
+	// Dedicated class ranges are carved out of the subnet pool
+	classes, err := parseClasses(subnetConfig.Classes, ipNet, reservedIPs)
+	if err != nil {
+		return nil, err
+	}
+	carved := []*addressPool{}
+	for _, class := range classes {
+		if class.pool != nil {
+			carved = append(carved, class.pool)
+		}
+	}
+	prefixReservations, err := parsePrefixReservations(subnetConfig.ReservedAddresses, ipNet, reservedIPs, carved)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidReservation, err)
+	}
+	for _, pr := range prefixReservations {
+		carved = append(carved, pr.pool)
 	}
 
 	// Initialize available IPs from the range
-	availableIPs := []net.IP{}
-	for ip := startIP; !ip.Equal(endIP); ip = incIP(ip) {
-		if _, exists := reservedIPs[ip.String()]; !exists {
-			availableIPs = append(availableIPs, ip)
+	pool := newRangesPool(ranges, reservedIPs, carved)
+	patternReservations, err := parsePatternReservations(subnetConfig.ReservedAddresses, ipNet, append([]*addressPool{pool}, carved...))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidReservation, err)
+	}
+	exclusions, err := parseExclusions(subnetConfig.Exclusions, ipNet)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReservations(reservations, ipNet, routers, exclusions, patternReservations); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidReservation, err)
+	}
+	if err := checkExclusions(exclusions, patternReservations); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidReservation, err)
+	}
+	policy, err := parseAllocationPolicy(subnetConfig.AllocationPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if subnetConfig.ReuseDelay < 0 {
+		return nil, fmt.Errorf("reuse_delay must not be negative")
+	}
+	if subnetConfig.ReusePressure < 0 || subnetConfig.ReusePressure > 100 {
+		return nil, fmt.Errorf("reuse_pressure must be between 1 and 100, got %d", subnetConfig.ReusePressure)
+	}
+	reusePressure := 100
+	if subnetConfig.ReusePressure > 0 {
+		reusePressure = subnetConfig.ReusePressure
+	}
+	if subnetConfig.EmergencyFreePercent < 0 || subnetConfig.EmergencyFreePercent > 50 {
+		return nil, fmt.Errorf("emergency_free_percent must be between 0 and 50, got %d", subnetConfig.EmergencyFreePercent)
+	}
+	utilizationWarnings, err := parseUtilizationWarnings(subnetConfig.UtilizationWarnings)
+	if err != nil {
+		return nil, err
+	}
+	if subnetConfig.EmergencyLeaseDuration < 0 {
+		return nil, fmt.Errorf("emergency_lease_duration must not be negative")
+	}
+	emergencyLeaseTime := defaultEmergencyLeaseDuration
+	if subnetConfig.EmergencyLeaseDuration > 0 {
+		emergencyLeaseTime = time.Duration(subnetConfig.EmergencyLeaseDuration) * time.Second
+	}
+	for _, p := range append([]*addressPool{pool}, carved...) {
+		p.policy = policy
+		p.reuseDelay = time.Duration(subnetConfig.ReuseDelay) * time.Second
+		p.reusePressure = reusePressure
+		p.emergencyPercent = subnetConfig.EmergencyFreePercent
+		p.emergencyLeaseTime = emergencyLeaseTime
+		for _, r := range exclusions {
+			p.excludeSpan(uint64(ipToUint32(r[0])), uint64(ipToUint32(r[1]))+1)
 		}
 	}
-	if _, exists := reservedIPs[endIP.String()]; !exists {
-		availableIPs = append(availableIPs, endIP)
+	excludeInfrastructure(append([]*addressPool{pool}, carved...), ipNet, routers, parseIPs(subnetConfig.DNSServers))
+
+	vendorOptions, err := parseVendorOptions(subnetConfig.VendorOptions)
+	if err != nil {
+		return nil, err
 	}
 
-	// Parse DNS servers
-	dnsServers := []net.IP{}
-	for _, dnsStr := range subnetConfig.DNSServers {
-		ip := net.ParseIP(dnsStr)
-		if ip != nil {
-			dnsServers = append(dnsServers, ip)
+	var vivso []byte
+	if len(subnetConfig.VIVSO) > 0 {
+		if vivso, err = encodeVIVSO(subnetConfig.VIVSO); err != nil {
+			return nil, err
 		}
 	}
 
-	return &DHCPServer{
-		subnetConfig: subnetConfig,
-		leases:       make(map[string]*Lease),
-		availableIPs: availableIPs,
-		subnetMask:   ipNet.Mask,
-		gateway:      net.ParseIP(subnetConfig.Gateway),
-		dnsServers:   dnsServers,
-	}, nil
+	customOptions, err := parseCustomOptions(subnetConfig.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	staticRoutes, err := parseStaticRoutes(subnetConfig.StaticRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	if subnetConfig.LeaseDuration <= 0 {
+		return nil, fmt.Errorf("invalid lease_duration %d for %s: must be a positive number of seconds", subnetConfig.LeaseDuration, ipNet)
+	}
+	if subnetConfig.LeaseDuration < minLeaseDuration {
+		log.Printf("Warning: lease_duration of %s is only %d seconds; clients will renew constantly", ipNet, subnetConfig.LeaseDuration)
+	}
+	if subnetConfig.LeaseJitterPercent < 0 || subnetConfig.LeaseJitterPercent > maxLeaseJitterPercent {
+		return nil, fmt.Errorf("lease_jitter_percent must be between 0 and %d, got %d", maxLeaseJitterPercent, subnetConfig.LeaseJitterPercent)
+	}
+	if subnetConfig.KnownLeaseDuration < 0 || subnetConfig.UnknownLeaseDuration < 0 {
+		return nil, fmt.Errorf("known_lease_duration and unknown_lease_duration must not be negative")
+	}
+	if subnetConfig.MTU != 0 && (subnetConfig.MTU < 68 || subnetConfig.MTU > 65535) {
+		return nil, fmt.Errorf("invalid mtu %d: must be between 68 and 65535", subnetConfig.MTU)
+	}
+
+	switch subnetConfig.NetBIOSNodeType {
+	case 0, 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("invalid netbios_node_type %d: must be 1 (B), 2 (P), 4 (M) or 8 (H)", subnetConfig.NetBIOSNodeType)
+	}
+
+	if subnetConfig.OfferTimeout < 0 {
+		return nil, fmt.Errorf("offer_timeout must not be negative")
+	}
+	if subnetConfig.DeclineCooldown < 0 {
+		return nil, fmt.Errorf("decline_cooldown must not be negative")
+	}
+	declineCooldown := defaultDeclineCooldown
+	if subnetConfig.DeclineCooldown > 0 {
+		declineCooldown = time.Duration(subnetConfig.DeclineCooldown) * time.Second
+	}
+	offerTimeout := defaultOfferTimeout
+	if subnetConfig.OfferTimeout > 0 {
+		offerTimeout = time.Duration(subnetConfig.OfferTimeout) * time.Second
+	}
+
+	if subnetConfig.ServerName != "" && subnetConfig.ServerHostname != "" && subnetConfig.ServerName != subnetConfig.ServerHostname {
+		return nil, fmt.Errorf("server_name and server_hostname are set to different values")
+	}
+	serverName := subnetConfig.ServerName
+	if serverName == "" {
+		serverName = subnetConfig.ServerHostname
+	}
+	serverName = truncateHeaderField("server_name", serverName, 64)
+	headerBootFile := truncateHeaderField("bootfile_name", subnetConfig.BootfileName, 128)
+
+	knownClients, err := parseKnownClients(subnetConfig.KnownClients)
+	if err != nil {
+		return nil, err
+	}
+	macFilter, err := parseMACFilter(subnetConfig.AllowMACs, subnetConfig.DenyMACs)
+	if err != nil {
+		return nil, err
+	}
+	leaseOverrides, err := parseLeaseOverrides(subnetConfig.LeaseOverrides)
+	if err != nil {
+		return nil, err
+	}
+
+	conflictDetection, err := parseConflictDetection(subnetConfig.ConflictDetection, subnetConfig.PingCheck)
+	if err != nil {
+		return nil, err
+	}
+	unknownClientPolicy, err := parseUnknownClientPolicy(subnetConfig.UnknownClientPolicy, subnetConfig.DenyUnknownClients, subnetConfig.Authoritative)
+	if err != nil {
+		return nil, err
+	}
+	if subnetConfig.ConflictRecheckInterval < 0 {
+		return nil, fmt.Errorf("conflict_recheck_interval must not be negative")
+	}
+	conflictRecheck := defaultConflictRecheckInterval
+	if subnetConfig.ConflictRecheckInterval > 0 {
+		conflictRecheck = time.Duration(subnetConfig.ConflictRecheckInterval) * time.Second
+	}
+
+	subnetMask, err := parseSubnetMask(subnetConfig.SubnetMask, ipNet.Mask)
+	if err != nil {
+		return nil, err
+	}
+
+	var replySource net.IP
+	if subnetConfig.ReplySourceIP != "" {
+		if replySource = net.ParseIP(subnetConfig.ReplySourceIP).To4(); replySource == nil {
+			return nil, fmt.Errorf("invalid reply_source_ip: %s", subnetConfig.ReplySourceIP)
+		}
+	}
+
+	var nextServer net.IP
+	if subnetConfig.NextServer != "" {
+		if nextServer = net.ParseIP(subnetConfig.NextServer).To4(); nextServer == nil {
+			return nil, fmt.Errorf("invalid next_server: %s", subnetConfig.NextServer)
+		}
+	}
+
+	s := &DHCPServer{
+		leaseState:          newLeaseState(),
+		subnetConfig:        subnetConfig,
+		pool:                pool,
+		network:             ipNet,
+		subnetMask:          subnetMask,
+		gateway:             gateway,
+		routers:             routers,
+		dnsServers:          parseIPs(subnetConfig.DNSServers),
+		vendorOptions:       vendorOptions,
+		vivso:               vivso,
+		customOptions:       customOptions,
+		reservations:        reservations,
+		prefixReservations:  prefixReservations,
+		leaseOverrides:      leaseOverrides,
+		patternReservations: patternReservations,
+		exclusions:          exclusions,
+		replySource:         replySource,
+		staticRoutes:        staticRoutes,
+		classes:             classes,
+		nextServer:          nextServer,
+		knownClients:        knownClients,
+		macFilter:           macFilter,
+		serverName:          serverName,
+		headerBootFile:      headerBootFile,
+		winsServers:         parseIPs(subnetConfig.WINSServers),
+		timeServers:         parseIPs(subnetConfig.TimeServers),
+		logServers:          parseIPs(subnetConfig.LogServers),
+		offerTimeout:        offerTimeout,
+		declineCooldown:     declineCooldown,
+
+		quarantineProbeInterval: time.Duration(subnetConfig.QuarantineProbeInterval) * time.Second,
+		quarantineMaxAge:        time.Duration(subnetConfig.QuarantineMaxAge) * time.Second,
+		declineThreshold:        subnetConfig.DeclineThreshold,
+		conflictDetection:       conflictDetection,
+		conflictRecheck:         conflictRecheck,
+		unknownClientPolicy:     unknownClientPolicy,
+		utilizationWarnings:     utilizationWarnings,
+	}
+	s.subnets = []*DHCPServer{s}
+	return s, nil
+}
+
+// enabled reports whether the subnet is served
+func (c *SubnetConfig) enabled() bool {
+	return c.Enabled == nil || *c.Enabled
 }
 
-// getIPForClient gets an IP address for the client
-func (s *DHCPServer) getIPForClient(mac net.HardwareAddr) (net.IP, error) {
+// getIPForClient gets an IP address for the client. A non-nil requestedIP (option 50)
+// is preferred over the pool when it is free. Clients matching a prefix reservation
+// are allocated from its range, and otherwise clients in a class with a dedicated
+// range from that range. known selects the known or unknown lease duration.
+// With offer set the address is only held for the offer timeout until a REQUEST
+// confirms it. It fails with ErrPoolExhausted or ErrInvalidReservation.
+func (s *DHCPServer) getIPForClient(mac net.HardwareAddr, clientID []byte, hostname string, requestedIP net.IP, class *clientClass, known, offer bool) (*allocation, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	defer s.checkUtilization()
 
 	macStr := mac.String()
 	leaseDuration := time.Duration(s.subnetConfig.LeaseDuration) * time.Second
+	if known && s.subnetConfig.KnownLeaseDuration > 0 {
+		leaseDuration = time.Duration(s.subnetConfig.KnownLeaseDuration) * time.Second
+	} else if !known && s.subnetConfig.UnknownLeaseDuration > 0 {
+		leaseDuration = time.Duration(s.subnetConfig.UnknownLeaseDuration) * time.Second
+	}
+	pool := s.pool
+	if class != nil {
+		if class.leaseDuration > 0 {
+			leaseDuration = class.leaseDuration
+		}
+		if class.pool != nil {
+			pool = class.pool
+		}
+	}
+	override := s.leaseOverrideFor(macStr)
+	if override > 0 {
+		leaseDuration = override
+	}
 
 	// Check for reserved IP
-	if reservedIP, exists := s.subnetConfig.ReservedAddresses[macStr]; exists {
-		ip := net.ParseIP(reservedIP)
-		if ip == nil {
-			return nil, fmt.Errorf("invalid reserved IP for %s", macStr)
+	if res, key := s.reservationFor(macStr, clientID, hostname); res != nil {
+		if !s.network.Contains(res.ip) {
+			return nil, fmt.Errorf("%w: %s for %s is outside network %s", ErrInvalidReservation, res.ip, key, s.network)
 		}
-		if lease, exists := s.leases[macStr]; exists {
-			lease.IP = ip
-			lease.ExpiresAt = time.Now().Add(leaseDuration)
-		} else {
-			s.leases[macStr] = &Lease{
-				IP:        ip,
-				MAC:       mac,
-				ExpiresAt: time.Now().Add(leaseDuration),
-			}
+		// Evict leases of other clients on the reserved address, e.g. from before the reservation
+		s.evictOthers(res.ip, mac, key)
+		if res.leaseDuration > 0 {
+			leaseDuration = res.leaseDuration
 		}
-		return ip, nil
+		lease := s.bindLease(mac, res.ip, leaseDuration, class, key, offer)
+		return &allocation{ip: res.ip, leaseDuration: lease.granted(), host: res, class: class}, nil
+	}
+
+	// A pattern reservation builds the client's address from its MAC
+	if pr, ip := s.patternAddressFor(mac); pr != nil {
+		s.evictOthers(ip, mac, pr.key)
+		if lease, exists := s.leases.Get(macStr); exists && !lease.IP.Equal(ip) && !s.ownerOf(lease.IP).isReservedIP(lease.IP) {
+			s.releaseIP(lease.IP)
+		}
+		if pr.host.leaseDuration > 0 && override == 0 {
+			leaseDuration = pr.host.leaseDuration
+		}
+		lease := s.bindLease(mac, ip, leaseDuration, class, "", offer)
+		return &allocation{ip: ip, leaseDuration: lease.granted(), host: pr.host, class: class}, nil
+	}
+
+	// A prefix reservation confines the client to its range
+	var host *reservation
+	if pr := s.prefixReservationFor(macStr); pr != nil {
+		pool, host = pr.pool, pr.host
+		if host.leaseDuration > 0 && override == 0 {
+			leaseDuration = host.leaseDuration
+		}
+	}
+
+	// Dynamic leases are shortened while the pool is nearly exhausted
+	leaseDuration = s.emergencyLeaseDuration(pool, leaseDuration)
+
+	// Prefer the address the client asked for
+	if requestedIP != nil && s.claimRequestedIP(mac, requestedIP, pool) {
+		lease := s.bindLease(mac, requestedIP, leaseDuration, class, "", offer)
+		return &allocation{ip: requestedIP, leaseDuration: lease.granted(), host: host, class: class, fresh: true}, nil
 	}
 
 	// Check for existing lease (even if expired)
-	if lease, exists := s.leases[macStr]; exists {
-		isAvailable := true
-		for otherMac, otherLease := range s.leases {
-			if otherMac != macStr && otherLease.IP.Equal(lease.IP) && time.Now().Before(otherLease.ExpiresAt) {
+	if lease, exists := s.leases.Get(macStr); exists {
+		isAvailable := s.poolFor(lease.IP) == pool
+		if off, ok := pool.offset(lease.IP); isAvailable && ok && pool.excluded.has(off) {
+			// Excluded, reserved for another client, or an infrastructure address
+			log.Printf("Warning: lease of %s on %s is excluded from the range and is not renewed; allocating another address", macStr, lease.IP)
+			isAvailable = false
+		}
+		for _, otherLease := range s.leases.ByIP(lease.IP) {
+			if otherLease.MAC.String() != macStr && s.clock.Now().Before(otherLease.ExpiresAt) {
 				isAvailable = false
 				break
 			}
 		}
 		if isAvailable {
-			lease.ExpiresAt = time.Now().Add(leaseDuration)
-			return lease.IP, nil
+			lease = s.bindLease(mac, lease.IP, leaseDuration, class, "", offer)
+			return &allocation{ip: lease.IP, leaseDuration: lease.granted(), host: host, class: class}, nil
+		}
+		if s.poolFor(lease.IP) != pool {
+			s.releaseIP(lease.IP) // The client moved to another class or prefix range
+		}
+		s.leases.Delete(macStr)
+	}
+
+	// Prefer an address the client held before if it is still free
+	if ip := s.claimPastAddress(macStr, pool); ip != nil {
+		lease := s.bindLease(mac, ip, leaseDuration, class, "", offer)
+		return &allocation{ip: ip, leaseDuration: lease.granted(), host: host, class: class, fresh: true}, nil
+	}
+
+	// Assign new IP if no reusable lease exists. The reaper reclaims expired leases in
+	// the background; sweep them here only when the pool has run dry.
+	now := s.clock.Now()
+	ip := pool.take(macStr, now)
+	if ip == nil {
+		s.expireLeases(now)
+		ip = pool.take(macStr, now)
+	}
+	if ip == nil {
+		s.refuse(pool)
+		return nil, fmt.Errorf("%w in %s-%s", ErrPoolExhausted, pool.start, pool.end)
+	}
+	lease := s.bindLease(mac, ip, leaseDuration, class, "", offer)
+	return &allocation{ip: ip, leaseDuration: lease.granted(), host: host, class: class, fresh: true}, nil
+}
+
+// allocateProbed is getIPForClient for a DISCOVER. With ping_check enabled, a newly
+// allocated address is probed first; if a host answers, the address is quarantined
+// like a declined one and the next candidate is tried. Probing stops when ctx ends.
+func (s *DHCPServer) allocateProbed(ctx context.Context, mac net.HardwareAddr, clientID []byte, hostname string, requestedIP net.IP, class *clientClass, known bool) (*allocation, error) {
+	for attempt := 1; ; attempt++ {
+		a, err := s.getIPForClient(mac, clientID, hostname, requestedIP, class, known, true)
+		if err != nil || !a.fresh || attempt > maxProbeAttempts || !s.shouldProbe(a.ip, s.clock.Now()) {
+			return a, err
+		}
+
+		timeout := s.pingTimeout()
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = min(timeout, time.Until(deadline))
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("conflict probe of %s: %w", a.ip, context.DeadlineExceeded)
+		}
+		inUse, holder, err := probeAddress(s.iface, a.ip, timeout)
+		if err != nil {
+			log.Printf("Conflict probe of %s failed, offering it anyway: %v", a.ip, err)
+			return a, nil
+		}
+		if !inUse {
+			s.mutex.Lock()
+			s.markSeen(a.ip, s.clock.Now())
+			s.mutex.Unlock()
+			return a, nil
+		}
+
+		if holder != nil {
+			log.Printf("Address conflict: %s is in use by %s; quarantining it", a.ip, holder)
+		} else {
+			log.Printf("Address conflict: %s answers to ping; quarantining it", a.ip)
+		}
+		s.quarantine(mac, a.ip)
+		requestedIP = nil
+	}
+}
+
+// parseSubnetMask returns the subnet_mask override as a mask, or networkMask when it
+// is unset. The override must be a dotted IPv4 mask with contiguous ones.
+func parseSubnetMask(mask string, networkMask net.IPMask) (net.IPMask, error) {
+	if mask == "" {
+		return networkMask, nil
+	}
+	ip := net.ParseIP(mask).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid subnet_mask %q: expected a dotted IPv4 mask", mask)
+	}
+	if ones, bits := net.IPMask(ip).Size(); ones == 0 && bits == 0 {
+		return nil, fmt.Errorf("invalid subnet_mask %s: the mask is not contiguous", mask)
+	}
+	return net.IPMask(ip), nil
+}
+
+// pingTimeout is how long a conflict probe waits for an answer
+func (s *DHCPServer) pingTimeout() time.Duration {
+	if s.subnetConfig.PingTimeout > 0 {
+		return time.Duration(s.subnetConfig.PingTimeout) * time.Millisecond
+	}
+	return defaultPingTimeout
+}
+
+// quarantine withdraws the offer of ip to mac and keeps the address out of the pool
+// for the decline cooldown
+func (s *DHCPServer) quarantine(mac net.HardwareAddr, ip net.IP) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if lease, exists := s.leases.Get(mac.String()); exists && lease.IP.Equal(ip) {
+		s.leases.Delete(mac.String())
+	}
+	s.markDeclined(ip)
+}
+
+// bindLease creates or updates the lease of mac. An offer holds the address for the
+// offer timeout only, without shortening an active bound lease on the same address.
+// The lease time granted is leaseDuration after lease_jitter_percent is applied.
+// reservation is the key of the reservation that matched, empty for dynamic addresses.
+// The caller must hold s.mutex.
+func (s *DHCPServer) bindLease(mac net.HardwareAddr, ip net.IP, leaseDuration time.Duration, class *clientClass, reservation string, offer bool) *Lease {
+	macStr := mac.String()
+	lease, exists := s.leases.Get(macStr)
+	if !exists {
+		lease = &Lease{MAC: mac}
+	}
+	now := s.clock.Now()
+	if !exists || !lease.IP.Equal(ip) || (!lease.offered() && !now.Before(lease.ExpiresAt)) {
+		lease.StartedAt = now
+	}
+	held := exists && !lease.offered() && lease.IP.Equal(ip) && now.Before(lease.ExpiresAt)
+	event := journalOffer
+	leaseTime := jitteredLeaseTime(leaseDuration, s.subnetConfig.LeaseJitterPercent, mac, lease.StartedAt)
+	lease.LeaseTime = int(leaseTime / time.Second)
+	lease.IP = ip
+	switch {
+	case !offer:
+		lease.ExpiresAt = now.Add(leaseTime)
+		lease.transition(StateBound)
+		event = journalAck
+		if held {
+			event = journalRenew
+		}
+	case held:
+		// Keep the bound lease as it is
+		event = ""
+	default:
+		lease.ExpiresAt = now.Add(s.offerTimeout)
+		lease.transition(StateOffered)
+	}
+	lease.Class = className(class)
+	lease.Reservation = reservation
+	s.leases.Put(lease)
+	if event != "" {
+		s.journalLease(event, lease)
+	}
+	return lease
+}
+
+// recordClientInfo stores the option 55 fingerprint, the hostname and the FQDN on the
+// lease of mac. A hostname already used by another client's active lease is kept but logged.
+func (s *DHCPServer) recordClientInfo(mac net.HardwareAddr, fp, hostname, fqdn string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	macStr := mac.String()
+	lease, exists := s.leases.Get(macStr)
+	if !exists {
+		return
+	}
+	lease.Fingerprint = fp
+	lease.Hostname = hostname
+	lease.FQDN = fqdn
+	s.leases.Put(lease)
+	if hostname == "" {
+		return
+	}
+	for _, other := range s.leases.ByHostname(hostname) {
+		if otherMac := other.MAC.String(); otherMac != macStr && s.clock.Now().Before(other.ExpiresAt) {
+			log.Printf("Warning: hostname %q of %s is also used by %s", hostname, macStr, otherMac)
+		}
+	}
+}
+
+// leaseHostname returns the host name of lease: the reservation's if it sets one,
+// else the name the client sent. The caller must hold s.mutex.
+func (s *DHCPServer) leaseHostname(lease *Lease) string {
+	if res, exists := s.ownerOf(lease.IP).reservations[lease.reservationKey()]; exists && res.hostname != "" {
+		return res.hostname
+	}
+	return lease.Hostname
+}
+
+// leaseBound announces the lease of mac, just confirmed by an ACK, to DNS, the webhook
+// and subscribers. renewed tells whether the client already held the address.
+func (s *DHCPServer) leaseBound(mac net.HardwareAddr, renewed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lease, exists := s.leases.Get(mac.String())
+	if !exists || lease.offered() {
+		return
+	}
+	s.markSeen(lease.IP, s.clock.Now())
+	s.registerDNS(lease)
+	s.notifyLease("ack", lease)
+	if renewed {
+		s.publishLease(LeaseRenewed, lease)
+	} else {
+		s.publishLease(LeaseAssigned, lease)
+	}
+}
+
+// leaseEnded moves a lease that was released, declined or expired to its final state,
+// withdraws it from DNS and announces it to the webhook as event, release, decline or
+// expire, and to subscribers. Offers that lapsed or were declined were never
+// announced. The caller must hold s.mutex.
+func (s *DHCPServer) leaseEnded(event string, lease *Lease) {
+	wasOffered := lease.offered()
+	eventType := LeaseExpired
+	switch event {
+	case "release":
+		s.journalLease(journalRelease, lease)
+		lease.transition(StateReleased)
+		eventType = LeaseReleased
+	case "decline":
+		// declineIP journals the decline along with the quarantine
+		lease.transition(StateDeclined)
+		eventType = LeaseDeclined
+	default:
+		s.journalLease(journalExpire, lease)
+		lease.transition(StateExpired)
+	}
+	if wasOffered {
+		return
+	}
+	// Another host uses a declined address, so it was not seen in use by our client
+	if event != "decline" {
+		s.markSeen(lease.IP, s.clock.Now())
+	}
+	s.unregisterDNS(lease)
+	s.notifyLease(event, lease)
+	s.publishLease(eventType, lease)
+}
+
+// evictOthers ends the leases of clients other than mac on ip, which the reservation
+// key gives to mac. The caller must hold s.mutex.
+func (s *DHCPServer) evictOthers(ip net.IP, mac net.HardwareAddr, key string) {
+	for _, otherLease := range s.leases.ByIP(ip) {
+		otherMac := otherLease.MAC.String()
+		if otherMac == mac.String() {
+			continue
+		}
+		active := s.clock.Now().Before(otherLease.ExpiresAt)
+		s.leaseEnded("expire", otherLease)
+		s.leases.Delete(otherMac)
+		if active {
+			log.Printf("Evicted active lease of %s on %s: address is reserved for %s by %s", otherMac, ip, mac, key)
 		}
-		delete(s.leases, macStr)
+	}
+}
+
+// claimRequestedIP takes requestedIP out of pool for mac if it is free or only held by
+// an expired lease, releasing the client's previous address. The caller must hold
+// s.mutex and bind the lease.
+func (s *DHCPServer) claimRequestedIP(mac net.HardwareAddr, requestedIP net.IP, pool *addressPool) bool {
+	macStr := mac.String()
+	if lease, exists := s.leases.Get(macStr); exists && lease.IP.Equal(requestedIP) {
+		return false // Renewal of the existing lease is handled by the caller
+	}
+	if s.poolFor(requestedIP) != pool || s.isReservedIP(requestedIP) || s.isExcluded(requestedIP) {
+		return false
 	}
 
-	// Clean up expired leases to reclaim IPs
-	for mac, lease := range s.leases {
-		if time.Now().After(lease.ExpiresAt) {
-			isReserved := false
-			for _, reservedIP := range s.subnetConfig.ReservedAddresses {
-				if lease.IP.String() == reservedIP {
-					isReserved = true
-					break
-				}
+	claimed := pool.takeIP(requestedIP)
+	if !claimed {
+		// The address may still be held by an expired lease of another client
+		for _, otherLease := range s.leases.ByIP(requestedIP) {
+			if s.clock.Now().Before(otherLease.ExpiresAt) {
+				return false
 			}
-			if !isReserved {
-				s.availableIPs = append(s.availableIPs, lease.IP)
-				delete(s.leases, mac) // Remove expired lease
+			otherMac := otherLease.MAC.String()
+			s.leases.Delete(otherMac)
+			if !otherLease.offered() {
+				s.rememberAddress(otherMac, otherLease.IP, otherLease.ExpiresAt)
 			}
+			claimed = true
+			break
+		}
+	}
+	if !claimed {
+		return false
+	}
+
+	// Return the client's previous address to the pool
+	if lease, exists := s.leases.Get(macStr); exists && !s.ownerOf(lease.IP).isReservedIP(lease.IP) {
+		s.releaseIP(lease.IP)
+	}
+	return true
+}
+
+// releaseIP returns a dynamically assigned address to the pool it came from, which
+// may belong to another subnet. The caller must hold s.mutex.
+func (s *DHCPServer) releaseIP(ip net.IP) {
+	if pool := s.ownerOf(ip).poolFor(ip); pool != nil {
+		pool.release(ip)
+	}
+}
+
+// recycleIP returns the address of an expired lease to its pool once reuse_delay has
+// passed
+func (s *DHCPServer) recycleIP(ip net.IP, now time.Time) {
+	if pool := s.ownerOf(ip).poolFor(ip); pool != nil {
+		pool.recycle(ip, now)
+	}
+}
+
+// poolFor returns the pool ip belongs to, or nil if it is outside all pools. Class
+// and prefix ranges take precedence since they are carved out of the subnet range.
+func (s *DHCPServer) poolFor(ip net.IP) *addressPool {
+	pools := s.pools()
+	for _, pool := range pools[1:] {
+		if pool.contains(ip) {
+			return pool
 		}
 	}
+	if s.pool.inRanges(ip) {
+		return s.pool
+	}
+	return nil
+}
+
+// pools returns the subnet pool followed by the dedicated class and prefix pools
+func (s *DHCPServer) pools() []*addressPool {
+	pools := []*addressPool{s.pool}
+	for _, class := range s.classes {
+		if class.pool != nil {
+			pools = append(pools, class.pool)
+		}
+	}
+	for _, pr := range s.prefixReservations {
+		pools = append(pools, pr.pool)
+	}
+	return pools
+}
 
-	// Assign new IP if no reusable lease exists
-	if len(s.availableIPs) == 0 {
-		return nil, fmt.Errorf("no available IPs")
+// ownsAddress reports whether ip may be leased to mac: it lies in a range of the
+// subnet, is reserved, or is the address a pattern reservation gives mac
+func (s *DHCPServer) ownsAddress(mac net.HardwareAddr, ip net.IP) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.poolFor(ip) != nil || s.isReservedIP(ip) {
+		return true
 	}
-	ip := s.availableIPs[0]
-	s.availableIPs = s.availableIPs[1:]
-	newLease := &Lease{
-		IP:        ip,
-		MAC:       mac,
-		ExpiresAt: time.Now().Add(leaseDuration),
+	_, patternIP := s.patternAddressFor(mac)
+	return patternIP != nil && patternIP.Equal(ip)
+}
+
+// requestedAddress returns the address a REQUEST asks for: option 50, or ciaddr when
+// the client is renewing. It returns nil if there is neither.
+func requestedAddress(p *dhcpv4.DHCPv4) net.IP {
+	if ip := p.RequestedIPAddress(); ip != nil && !ip.IsUnspecified() {
+		return ip
 	}
-	s.leases[macStr] = newLease
-	return ip, nil
+	if p.ClientIPAddr != nil && !p.ClientIPAddr.IsUnspecified() {
+		return p.ClientIPAddr
+	}
+	return nil
+}
+
+// isReservedIP reports whether ip is assigned to a client in reserved_addresses
+func (s *DHCPServer) isReservedIP(ip net.IP) bool {
+	for _, res := range s.reservations {
+		if res.ip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwnServerIdentifier reports whether id may be the server identifier sent by this
+// server. Subnets whose address is unknown send none, so any id is taken as theirs.
+func (s *DHCPServer) isOwnServerIdentifier(id net.IP) bool {
+	for _, subnet := range s.subnets {
+		if subnet.serverIP == nil || subnet.serverIP.Equal(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// withdrawOffer returns the address offered to mac to the pool if its lease is only
+// held by an OFFER, reporting whether it was
+func (s *DHCPServer) withdrawOffer(mac net.HardwareAddr) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	defer s.checkUtilization()
+	macStr := mac.String()
+	lease, exists := s.leases.Get(macStr)
+	if !exists || !lease.offered() {
+		return false
+	}
+	s.leases.Delete(macStr)
+	s.leaseEnded("release", lease)
+	if !s.ownerOf(lease.IP).isReservedIP(lease.IP) {
+		s.releaseIP(lease.IP)
+	}
+	log.Printf("Withdrew the offer of %s to %s", lease.IP, macStr)
+	return true
+}
+
+// nextServerIP returns the address placed in siaddr. The gateway is used as a
+// substitute when the server's own address could not be determined.
+func (s *DHCPServer) nextServerIP() net.IP {
+	if s.serverIP != nil {
+		return s.serverIP
+	}
+	return s.gateway
+}
+
+// domainFor returns the domain name given to the client of a, empty if none is configured
+func (s *DHCPServer) domainFor(a *allocation) string {
+	if a.host != nil && a.host.domain != "" {
+		return a.host.domain
+	}
+	if s.subnetConfig.DomainName != nil {
+		return *s.subnetConfig.DomainName
+	}
+	return ""
+}
+
+// hostname returns the client's host name: the reservation's if it sets one, else
+// the sanitized name the client sent
+func (a *allocation) hostname(sent string) string {
+	if a.host != nil && a.host.hostname != "" {
+		return a.host.hostname
+	}
+	return sent
+}
+
+// replyOptions builds the options shared by OFFER and ACK replies to p. Settings
+// from the client's reservation take precedence over its class, which in turn take
+// precedence over the subnet's.
+func (s *DHCPServer) replyOptions(p *dhcpv4.DHCPv4, a *allocation) []dhcpv4.Modifier {
+	gateway := s.gateway
+	routers := s.routers
+	dnsServers := s.dnsServers
+	nextServer := s.nextServer
+	bootFile := s.subnetConfig.BootFilename
+	domainName := s.domainFor(a)
+	if a.class != nil {
+		if len(a.class.dnsServers) > 0 {
+			dnsServers = a.class.dnsServers
+		}
+		if a.class.nextServer != nil {
+			nextServer = a.class.nextServer
+		}
+		if a.class.bootFile != "" {
+			bootFile = a.class.bootFile
+		}
+	}
+	if a.host != nil {
+		if a.host.gateway != nil {
+			gateway = a.host.gateway
+			routers = []net.IP{a.host.gateway}
+		}
+		if len(a.host.dnsServers) > 0 {
+			dnsServers = a.host.dnsServers
+		}
+		if a.host.bootFile != "" {
+			bootFile = a.host.bootFile
+		}
+	}
+
+	modifiers := []dhcpv4.Modifier{
+		dhcpv4.WithOption(dhcpv4.OptSubnetMask(s.subnetMask)),
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(a.leaseDuration)),
+	}
+	if s.subnetConfig.LeaseJitterPercent > 0 {
+		// Spell out T1 and T2 of the jittered lease time so clients need not derive them
+		modifiers = append(modifiers,
+			dhcpv4.WithOption(dhcpv4.OptRenewTimeValue(a.leaseDuration/2)),
+			dhcpv4.WithOption(dhcpv4.OptRebindingTimeValue(a.leaseDuration*7/8)),
+		)
+	}
+	if s.serverIP != nil {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.serverIP)))
+	}
+	if nextServer != nil {
+		modifiers = append(modifiers, dhcpv4.WithServerIP(nextServer))
+	}
+	if bootFile != "" {
+		modifiers = append(modifiers,
+			func(d *dhcpv4.DHCPv4) { d.BootFileName = bootFile },
+			dhcpv4.WithOption(dhcpv4.OptBootFileName(bootFile)),
+		)
+	}
+	// The sname and file fields carry these values, so options are never overloaded into them
+	if s.headerBootFile != "" {
+		modifiers = append(modifiers, func(d *dhcpv4.DHCPv4) { d.BootFileName = s.headerBootFile })
+	}
+	if s.serverName != "" {
+		modifiers = append(modifiers, func(d *dhcpv4.DHCPv4) { d.ServerHostName = s.serverName })
+	}
+	if len(routers) > 0 {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptRouter(routers...)))
+	}
+	if len(dnsServers) > 0 {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptDNS(dnsServers...)))
+	}
+	if len(s.winsServers) > 0 {
+		modifiers = append(modifiers, dhcpv4.WithOption(ipListOption(dhcpv4.OptionNetBIOSOverTCPIPNameServer, s.winsServers)))
+	}
+	if len(s.timeServers) > 0 && p.IsOptionRequested(dhcpv4.OptionTimeServer) {
+		modifiers = append(modifiers, dhcpv4.WithOption(ipListOption(dhcpv4.OptionTimeServer, s.timeServers)))
+	}
+	if len(s.logServers) > 0 && p.IsOptionRequested(dhcpv4.OptionLogServer) {
+		modifiers = append(modifiers, dhcpv4.WithOption(ipListOption(dhcpv4.OptionLogServer, s.logServers)))
+	}
+	if nodeType := s.subnetConfig.NetBIOSNodeType; nodeType != 0 {
+		modifiers = append(modifiers, dhcpv4.WithGeneric(dhcpv4.OptionNetBIOSOverTCPIPNodeType, []byte{byte(nodeType)}))
+	}
+	if domainName != "" {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptDomainName(domainName)))
+	}
+	if a.host != nil && a.host.hostname != "" {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptHostName(a.host.hostname)))
+	}
+	if mtu := s.subnetConfig.MTU; mtu != 0 {
+		modifiers = append(modifiers, dhcpv4.WithGeneric(dhcpv4.OptionInterfaceMTU, []byte{byte(mtu >> 8), byte(mtu)}))
+	}
+	if len(s.staticRoutes) > 0 {
+		routes := classlessRoutes(s.staticRoutes, gateway)
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptClasslessStaticRoute(routes...)))
+		// Option 33 only accompanies option 121, carrying the same host routes
+		if s.subnetConfig.CompatOption33 {
+			if data := classfulRoutes(s.staticRoutes); data != nil {
+				modifiers = append(modifiers, dhcpv4.WithGeneric(dhcpv4.OptionStaticRoutingTable, data))
+			}
+		}
+	}
+	if payload := matchVendorOption(s.vendorOptions, p.ClassIdentifier()); payload != nil {
+		modifiers = append(modifiers, dhcpv4.WithGeneric(dhcpv4.OptionVendorSpecificInformation, payload))
+	}
+	if s.vivso != nil {
+		modifiers = append(modifiers, dhcpv4.WithGeneric(dhcpv4.OptionVendorIdentifyingVendorSpecific, s.vivso))
+	}
+
+	// Custom options replace options of the same code set before them, but not those
+	// set by a more specific layer: a reservation's boot_file wins over option 67 in
+	// the class or subnet options
+	classSets, hostSets := a.class.setOptions(), a.host.setOptions()
+	for _, opt := range s.customOptions {
+		if !classSets[opt.Code.Code()] && !hostSets[opt.Code.Code()] {
+			modifiers = append(modifiers, dhcpv4.WithOption(opt))
+		}
+	}
+	if a.class != nil {
+		for _, opt := range a.class.options {
+			if !hostSets[opt.Code.Code()] {
+				modifiers = append(modifiers, dhcpv4.WithOption(opt))
+			}
+		}
+	}
+	if a.host != nil {
+		for _, opt := range a.host.options {
+			modifiers = append(modifiers, dhcpv4.WithOption(opt))
+		}
+	}
+	return modifiers
 }
 
 // ServeDHCP handles DHCP requests
 func (s *DHCPServer) ServeDHCP(conn net.PacketConn, peer net.Addr, p *dhcpv4.DHCPv4) {
-	if p.OpCode != dhcpv4.OpcodeBootRequest {
+	defer recoverPacket(peer)
+	if !acceptPacket(peer, p) {
+		return
+	}
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	if !s.subnetConfig.enabled() {
 		return
 	}
 
+	ctx, cancel := s.requestContext()
+	defer cancel()
+	conn = s.replyConn(conn)
+
 	log.Printf("Received %s from %s", p.MessageType(), p.ClientHWAddr)
 
+	if denied, rule := s.macFilter.check(p.ClientHWAddr); denied {
+		count := s.macFilter.denied.Add(1)
+		log.Printf("Denied %s from %s: matched %s, %d denied so far", p.MessageType(), p.ClientHWAddr, rule, count)
+		if p.MessageType() == dhcpv4.MessageTypeRequest && s.subnetConfig.Authoritative {
+			s.sendNAK(conn, peer, p)
+		}
+		return
+	}
+
+	if s.unknownClientPolicy != unknownClientAllocate && !s.isReservedClient(p) {
+		s.unknownDenials.record(p, s.clock.Now())
+		if p.MessageType() == dhcpv4.MessageTypeRequest && s.unknownClientPolicy == unknownClientReject {
+			s.sendNAK(conn, peer, p)
+		}
+		return
+	}
+
+	class := s.classify(p)
+	if class != nil && class.deny {
+		count := class.denied.Add(1)
+		log.Printf("Denied %s from %s: matched class %s (vendor class %q, user class %q), %d denied so far", p.MessageType(), p.ClientHWAddr, class.name, p.ClassIdentifier(), p.UserClass(), count)
+		if p.MessageType() == dhcpv4.MessageTypeRequest && s.subnetConfig.Authoritative {
+			s.sendNAK(conn, peer, p)
+		}
+		return
+	}
+	if class != nil {
+		log.Printf("Classified %s as %s (vendor class %q, user class %q)", p.ClientHWAddr, class.name, p.ClassIdentifier(), p.UserClass())
+	}
+	known := s.isKnownClient(p)
+
 	switch p.MessageType() {
 	case dhcpv4.MessageTypeDiscover:
-		ip, err := s.getIPForClient(p.ClientHWAddr)
+		a, err := s.allocateProbed(ctx, p.ClientHWAddr, p.Options.Get(dhcpv4.OptionClientIdentifier), clientHostname(p), p.RequestedIPAddress(), class, known)
+		if isTimeout(err) {
+			replyExpired(ctx, p)
+			return
+		}
 		if err != nil {
 			log.Printf("Error getting IP for %s: %v", p.ClientHWAddr, err)
 			return
@@ -201,47 +1206,74 @@ func (s *DHCPServer) ServeDHCP(conn net.PacketConn, peer net.Addr, p *dhcpv4.DHC
 		modifiers := []dhcpv4.Modifier{
 			dhcpv4.WithReply(p),
 			dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
-			dhcpv4.WithYourIP(ip),
-			dhcpv4.WithServerIP(s.gateway), // This should be the server's own IP, but gateway is a reasonable substitute for now
-			dhcpv4.WithOption(dhcpv4.OptSubnetMask(s.subnetMask)),
-			dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(time.Duration(s.subnetConfig.LeaseDuration) * time.Second)),
-		}
-		if s.gateway != nil {
-			modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptRouter(s.gateway)))
-		}
-		if len(s.dnsServers) > 0 {
-			modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptDNS(s.dnsServers...)))
+			dhcpv4.WithYourIP(a.ip),
+			dhcpv4.WithServerIP(s.nextServerIP()),
 		}
+		modifiers = append(modifiers, s.replyOptions(p, a)...)
 
 		reply, err := dhcpv4.New(modifiers...)
 		if err != nil {
 			log.Printf("Failed to create OFFER: %v", err)
 			return
 		}
-		log.Printf("Offering IP %s to %s", ip, p.ClientHWAddr)
+		fitReply(p, reply)
+		if replyExpired(ctx, p) {
+			return
+		}
+		log.Printf("Offering IP %s to %s", a.ip, p.ClientHWAddr)
+		s.logReplyOptions(reply)
 		if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
 			log.Printf("Failed to send OFFER: %v", err)
 		}
 
 	case dhcpv4.MessageTypeRequest:
-		ip, err := s.getIPForClient(p.ClientHWAddr)
+		// A client in the SELECTING state that chose another server's offer names it in option 54
+		if id := p.ServerIdentifier(); id != nil && !id.IsUnspecified() && !s.isOwnServerIdentifier(id) {
+			log.Printf("Ignoring REQUEST from %s for server %s", p.ClientHWAddr, id)
+			if s.withdrawOffer(p.ClientHWAddr) {
+				s.saveLeasesWithin(ctx)
+			}
+			return
+		}
+		// An address in the network but outside every range is not ours to confirm
+		if ip := requestedAddress(p); ip != nil && s.network.Contains(ip) && !s.ownsAddress(p.ClientHWAddr, ip) {
+			log.Printf("%s requested %s, which lies outside the ranges", p.ClientHWAddr, ip)
+			if s.subnetConfig.Authoritative {
+				s.sendNAK(conn, peer, p)
+			}
+			return
+		}
+		bound := s.boundAddress(p.ClientHWAddr)
+		a, err := s.getIPForClient(p.ClientHWAddr, p.Options.Get(dhcpv4.OptionClientIdentifier), clientHostname(p), nil, class, known, false)
 		if err != nil {
 			log.Printf("Error getting IP for %s: %v", p.ClientHWAddr, err)
+			if errors.Is(err, ErrPoolExhausted) {
+				s.sendNAK(conn, peer, p)
+			}
 			return
 		}
+		fp := fingerprint(p)
+		hostname := clientHostname(p)
+		fqdn, err := parseClientFQDN(p)
+		if err != nil {
+			log.Printf("Ignoring client FQDN from %s: %v", p.ClientHWAddr, err)
+		}
+		fqdnName := ""
+		if fqdn != nil {
+			fqdn.complete(a.hostname(hostname), s.domainFor(a))
+			fqdnName = fqdn.name
+		}
+		s.recordClientInfo(p.ClientHWAddr, fp, hostname, fqdnName)
+		s.leaseBound(p.ClientHWAddr, bound.Equal(a.ip))
 
 		modifiers := []dhcpv4.Modifier{
 			dhcpv4.WithReply(p),
 			dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
-			dhcpv4.WithYourIP(ip),
-			dhcpv4.WithOption(dhcpv4.OptSubnetMask(s.subnetMask)),
-			dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(time.Duration(s.subnetConfig.LeaseDuration) * time.Second)),
+			dhcpv4.WithYourIP(a.ip),
 		}
-		if s.gateway != nil {
-			modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptRouter(s.gateway)))
-		}
-		if len(s.dnsServers) > 0 {
-			modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptDNS(s.dnsServers...)))
+		modifiers = append(modifiers, s.replyOptions(p, a)...)
+		if fqdn != nil {
+			modifiers = append(modifiers, dhcpv4.WithOption(fqdnReply(fqdn, s.ddns != nil)))
 		}
 
 		reply, err := dhcpv4.New(modifiers...)
@@ -249,10 +1281,67 @@ func (s *DHCPServer) ServeDHCP(conn net.PacketConn, peer net.Addr, p *dhcpv4.DHC
 			log.Printf("Failed to create ACK: %v", err)
 			return
 		}
-		log.Printf("Assigned IP %s to %s", ip, p.ClientHWAddr)
+		fitReply(p, reply)
+		s.saveLeasesWithin(ctx)
+		if replyExpired(ctx, p) {
+			return
+		}
+		log.Printf("Assigned IP %s to %s (hostname %q, FQDN %q, fingerprint %q, %s)", a.ip, p.ClientHWAddr, hostname, fqdnName, fp, fingerprintLabel(fp))
+		s.logReplyOptions(reply)
 		if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
 			log.Printf("Failed to send ACK: %v", err)
 		}
+
+	case dhcpv4.MessageTypeDecline:
+		ip := p.RequestedIPAddress()
+		if ip == nil {
+			log.Printf("Ignoring DECLINE from %s without a requested address", p.ClientHWAddr)
+			return
+		}
+		s.declineIP(p.ClientHWAddr, ip)
+		s.saveLeasesWithin(ctx)
+
+	case dhcpv4.MessageTypeRelease:
+		if !s.release(p.ClientHWAddr, p.ClientIPAddr) {
+			log.Printf("Ignoring RELEASE of %s from %s: no such lease", p.ClientIPAddr, p.ClientHWAddr)
+		}
+	}
+}
+
+// logReplyOptions logs every option of reply with its code, name and value when
+// option debugging is enabled
+func (s *DHCPServer) logReplyOptions(reply *dhcpv4.DHCPv4) {
+	if !s.debugOptions {
+		return
+	}
+	codes := make([]int, 0, len(reply.Options))
+	for code := range reply.Options {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		option := dhcpv4.Options{uint8(code): reply.Options[uint8(code)]}
+		log.Printf("  %s to %s option %d %s", reply.MessageType(), reply.ClientHWAddr, code, strings.TrimSpace(option.String()))
+	}
+}
+
+// sendNAK refuses the client's REQUEST
+func (s *DHCPServer) sendNAK(conn net.PacketConn, peer net.Addr, p *dhcpv4.DHCPv4) {
+	modifiers := []dhcpv4.Modifier{
+		dhcpv4.WithReply(p),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+	}
+	if s.serverIP != nil {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.serverIP)))
+	}
+	reply, err := dhcpv4.New(modifiers...)
+	if err != nil {
+		log.Printf("Failed to create NAK: %v", err)
+		return
+	}
+	log.Printf("Sending NAK to %s", p.ClientHWAddr)
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		log.Printf("Failed to send NAK: %v", err)
 	}
 }
 
@@ -271,65 +1360,349 @@ func main() {
 	// Define command-line flag for network interface
 	ifaceFlag := flag.String("iface", "en5", "Network interface to bind the DHCP server to")
 	configFile := flag.String("config", "dhcp_config.yaml", "Path to the DHCP configuration file")
+	debugOptions := flag.Bool("debug-options", false, "Log every option sent in OFFER and ACK replies")
+	initConfig := flag.Bool("init-config", false, "Write a commented example configuration to the -config path and exit")
+	importLeases := flag.String("import-dhcpd-leases", "", "Import the active leases of an ISC dhcpd leases file at startup")
 	flag.Parse()
 
+	if *initConfig {
+		if err := writeStarterConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Wrote an example configuration to %s; edit it, then start the server", *configFile)
+		return
+	}
+
 	// Read and parse the configuration file
-	configData, err := os.ReadFile(*configFile)
+	config, err := loadConfig(*configFile)
 	if err != nil {
-		log.Fatalf("Failed to read config file: %v", err)
+		log.Fatal(err)
 	}
-
-	var config Config
-	if err := yaml.Unmarshal(configData, &config); err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+	if err := setupLogging(config.LogDest, config.SyslogAddr); err != nil {
+		log.Fatal(err)
 	}
 
 	if config.Network == "" {
 		log.Fatal("No network configured in the config file")
 	}
 
-	// Determine which interface to use. Precedence: command-line > config file > default
-	var ifaceToUse string
+	// Determine which interfaces to use. Precedence: command-line > config file > default
+	var ifaces []string
 	defaultValue := "en5"
-	if config.Interface != "" {
-		ifaceToUse = config.Interface // Use value from config file
+	if len(config.Interfaces) > 0 {
+		ifaces = config.Interfaces // Use values from config file
+	} else if config.Interface != "" {
+		ifaces = []string{config.Interface}
 	} else {
-		ifaceToUse = defaultValue // Use default
+		ifaces = []string{defaultValue} // Use default
 	}
 	if wasFlagPassed("iface") {
-		ifaceToUse = *ifaceFlag // Flag overrides everything
+		ifaces = []string{*ifaceFlag} // Flag overrides everything
 	}
 
-	// Convert config to SubnetConfig
-	subnetConfig := SubnetConfig{
-		Network:           config.Network,
-		Gateway:           config.Gateway,
-		Range:             config.Range,
-		LeaseDuration:     config.LeaseDuration,
-		DNSServers:        config.DNSServers,
-		ReservedAddresses: config.ReservedAddresses,
+	// Initialize a DHCP server per subnet, sharing one lease state
+	servers := []*DHCPServer{}
+	for _, subnetConfig := range append([]SubnetConfig{config.SubnetConfig}, config.Subnets...) {
+		server, err := NewDHCPServer(subnetConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		servers = append(servers, server)
+	}
+	if err := joinSubnets(servers); err != nil {
+		log.Fatal(err)
 	}
+	server := servers[0]
 
-	// Initialize DHCP server
-	server, err := NewDHCPServer(subnetConfig)
-	if err != nil {
+	for _, subnet := range servers {
+		if !subnet.subnetConfig.enabled() {
+			log.Printf("Subnet %s is disabled; it is not served until enabled", subnet.network)
+		}
+
+		// Serve the subnet on the interface attached to it, or the first one if it is
+		// only reached through relays
+		subnet.iface = ifaces[0]
+		for _, iface := range ifaces {
+			if interfaceInNetwork(iface, subnet.network) {
+				subnet.iface = iface
+				break
+			}
+		}
+
+		// Determine the server identifier from the bound interface
+		serverIP, err := interfaceIPv4(subnet.iface, subnet.network)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		} else {
+			subnet.serverIP = serverIP
+			log.Printf("Using %s as server identifier for %s", serverIP, subnet.network)
+		}
+
+		subnet.debugOptions = *debugOptions || config.DebugOptions
+		subnet.requestTimeout = time.Duration(config.RequestTimeout) * time.Millisecond
+	}
+
+	if config.AddressHistory > 0 {
+		server.historySize = config.AddressHistory
+	}
+	if config.AddressHistoryMaxAge > 0 {
+		server.historyMaxAge = time.Duration(config.AddressHistoryMaxAge) * time.Second
+	}
+	if config.DDNS != nil {
+		if server.ddns, err = newDDNSUpdater(config.DDNS); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.WebhookURL != "" {
+		if server.webhook, err = newWebhookNotifier(config.WebhookURL, server.clock); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if server.expiryWarning, err = parseExpiryWarningFraction(config.ExpiryWarningFraction); err != nil {
 		log.Fatal(err)
 	}
 
-	// Set up UDP address for DHCP server
-	addr := &net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 67}
-	s, err := server4.NewServer(ifaceToUse, addr, server.ServeDHCP)
+	// Restore leases saved by a previous run
+	backend, err := openLeaseBackend(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if backend != nil {
+		server.backend = backend
+		defer backend.close()
+	}
+	if config.LeaseJournal != "" {
+		if server.journal, err = openLeaseJournal(config.LeaseJournal, config.JournalFsync); err != nil {
+			log.Fatal(err)
+		}
+		defer server.journal.close()
+	}
+	if backend != nil || server.journal != nil {
+		if err := server.loadLeases(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *importLeases != "" {
+		if err := server.importDhcpdLeases(*importLeases); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if backend != nil {
+		kept, err := server.CompactLeases()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Compacted the lease store to %d lease(s)", kept)
+	}
 
-	log.Printf("Starting DHCP server on interface %s, port 67...", ifaceToUse)
-	if err := s.Serve(); err != nil {
-		log.Fatal(err)
+	// Look for other DHCP servers before we start answering ourselves
+	if config.DetectRogueServers {
+		for _, iface := range ifaces {
+			self, _ := interfaceIPv4(iface, nil)
+			rogues, err := detectRogueServers(iface, self, rogueProbeTimeout)
+			if err != nil {
+				log.Printf("Rogue DHCP server detection failed on %s: %v", iface, err)
+			} else if len(rogues) == 0 {
+				log.Printf("No other DHCP servers detected on %s", iface)
+			} else {
+				log.Printf("Warning: %d other DHCP server(s) answering on %s: %v", len(rogues), iface, rogues)
+			}
+		}
+	}
+
+	// Bind a listener to each interface, routing its packets to the matching subnet
+	listeners := []*Listener{}
+	for _, iface := range ifaces {
+		var local *DHCPServer
+		for _, subnet := range servers {
+			if interfaceInNetwork(iface, subnet.network) {
+				local = subnet
+				break
+			}
+		}
+		listener, err := NewListener(iface, subnetHandler(iface, servers, local))
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, listener)
 	}
+
+	// Stop serving on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Reload the configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig(*configFile, config, servers)
+		}
+	}()
+
+	// Reclaim expired leases in the background
+	reapInterval := defaultReapInterval
+	if config.ReapInterval > 0 {
+		reapInterval = time.Duration(config.ReapInterval) * time.Second
+	}
+	go server.RunReaper(ctx, reapInterval)
+	if server.ddns != nil {
+		go server.ddns.Run(ctx)
+	}
+	if server.webhook != nil {
+		go server.webhook.Run(ctx)
+	}
+	for _, subnet := range servers {
+		go subnet.RunQuarantineProber(ctx)
+	}
+
+	// Start the management API if configured
+	if config.APIListen != "" {
+		if config.APIToken == "" {
+			log.Fatal("api_token is required when api_listen is set")
+		}
+		apiServer := &http.Server{
+			Addr:    config.APIListen,
+			Handler: newAPIHandler(server, config.APIToken, config.ReservationsFile),
+		}
+		go func() {
+			log.Printf("Starting management API on %s", config.APIListen)
+			if err := apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Management API failed: %v", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			apiServer.Close()
+		}()
+	}
+
+	log.Printf("Starting DHCP server on interface(s) %s, port 67...", strings.Join(ifaces, ", "))
+	server.health.serving.Store(true)
+	rebindRetries := defaultRebindRetries
+	if config.RebindRetries != 0 {
+		rebindRetries = config.RebindRetries
+	}
+	rebindMaxBackoff := defaultRebindMaxBackoff
+	if config.RebindMaxBackoff > 0 {
+		rebindMaxBackoff = time.Duration(config.RebindMaxBackoff) * time.Second
+	}
+	errCh := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() {
+			errCh <- listener.Supervise(ctx, rebindRetries, rebindMaxBackoff)
+		}()
+	}
+	for range listeners {
+		if err := <-errCh; err != nil {
+			log.Fatal(err)
+		}
+	}
+	server.saveLeases()
+	log.Println("DHCP server stopped")
+}
+
+// reloadConfig re-reads the configuration file and applies it to the running servers,
+// the primary subnet first. Errors leave the current configuration in place.
+// Interface and API settings and the number of subnets only take effect after a restart.
+func reloadConfig(path string, current *Config, servers []*DHCPServer) {
+	log.Printf("Reloading configuration from %s", path)
+	config, err := loadConfig(path)
+	if err != nil {
+		log.Printf("Reload failed, keeping the current configuration: %v", err)
+		return
+	}
+	subnetConfigs := append([]SubnetConfig{config.SubnetConfig}, config.Subnets...)
+	if len(subnetConfigs) != len(servers) {
+		log.Printf("Reload failed, keeping the current configuration: adding or removing subnets requires a restart")
+		return
+	}
+	nexts := make([]*DHCPServer, len(subnetConfigs))
+	for i, subnetConfig := range subnetConfigs {
+		if nexts[i], err = NewDHCPServer(subnetConfig); err != nil {
+			log.Printf("Reload failed, keeping the current configuration: %v", err)
+			return
+		}
+	}
+	if err := checkOverlap(nexts); err != nil {
+		log.Printf("Reload failed, keeping the current configuration: %v", err)
+		return
+	}
+	if config.Interface != current.Interface || !slices.Equal(config.Interfaces, current.Interfaces) ||
+		config.APIListen != current.APIListen || config.APIToken != current.APIToken {
+		log.Printf("Warning: interface and API changes require a restart")
+	}
+
+	for i, server := range servers {
+		if was, now := server.subnetConfig.enabled(), nexts[i].subnetConfig.enabled(); was != now {
+			if now {
+				log.Printf("Subnet %s is enabled again", server.network)
+			} else {
+				log.Printf("Subnet %s is disabled; its leases are kept but it is no longer served", server.network)
+			}
+		}
+		changes := server.Reload(nexts[i])
+		if len(changes) == 0 {
+			log.Printf("Configuration of %s reloaded, no changes", server.network)
+			continue
+		}
+		log.Printf("Configuration of %s reloaded: %s", server.network, strings.Join(changes, "; "))
+	}
+}
+
+// truncateHeaderField cuts value to fit a NUL-terminated BOOTP header field of size
+// bytes, logging a warning when it is too long
+func truncateHeaderField(name, value string, size int) string {
+	if len(value) < size {
+		return value
+	}
+	log.Printf("Warning: %s %q is longer than %d bytes and will be truncated", name, value, size-1)
+	return value[:size-1]
+}
+
+// ipListOption encodes an option carrying a list of IPv4 addresses, like option 6
+func ipListOption(code dhcpv4.OptionCode, ips []net.IP) dhcpv4.Option {
+	return dhcpv4.Option{Code: code, Value: dhcpv4.IPs(ips)}
 }
 
+// parseRouters validates the configured gateways, which must lie inside network
+func parseRouters(values []string, network *net.IPNet) ([]net.IP, error) {
+	routers := []net.IP{}
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		ip := net.ParseIP(value).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid gateway: %q", value)
+		}
+		if !network.Contains(ip) {
+			return nil, fmt.Errorf("gateway %s is outside network %s", ip, network)
+		}
+		routers = append(routers, ip)
+	}
+	return routers, nil
+}
+
+// parseIPs parses a list of IP address strings, skipping empty or invalid entries
+func parseIPs(values []string) []net.IP {
+	ips := []net.IP{}
+	for _, value := range values {
+		ip := net.ParseIP(value)
+		if ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// incIP returns the address following ip. IPv4 addresses are incremented in their
+// 4-byte form, so 255.255.255.255 wraps to 0.0.0.0 instead of carrying into the
+// IPv4-mapped prefix.
 func incIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
 	newIP := make(net.IP, len(ip))
 	copy(newIP, ip)
 	for j := len(newIP) - 1; j >= 0; j-- {
@@ -340,4 +1713,3 @@ func incIP(ip net.IP) net.IP {
 	}
 	return newIP
 }
-
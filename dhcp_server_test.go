@@ -0,0 +1,339 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// fakeConn is a net.PacketConn that records the packets written to it
+type fakeConn struct {
+	mutex  sync.Mutex
+	writes [][]byte
+}
+
+func (c *fakeConn) ReadFrom([]byte) (int, net.Addr, error) { return 0, nil, net.ErrClosed }
+func (c *fakeConn) Close() error                           { return nil }
+func (c *fakeConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort}
+}
+func (c *fakeConn) SetDeadline(time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *fakeConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// replies decodes the packets written so far
+func (c *fakeConn) replies(t testing.TB) []*dhcpv4.DHCPv4 {
+	t.Helper()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	replies := make([]*dhcpv4.DHCPv4, 0, len(c.writes))
+	for _, b := range c.writes {
+		reply, err := dhcpv4.FromBytes(b)
+		if err != nil {
+			t.Fatalf("server wrote an undecodable packet: %v", err)
+		}
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+// testServerIP is the address the test server replies from
+var testServerIP = net.IPv4(10, 0, 0, 1).To4()
+
+// clientPeer is where replies to a client without an address are sent
+var clientPeer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+
+// testSubnetConfig returns a small subnet configuration for tests to adjust
+func testSubnetConfig() SubnetConfig {
+	return SubnetConfig{
+		Network:       "10.0.0.0/24",
+		Gateway:       StringList{"10.0.0.1"},
+		Range:         StringList{"10.0.0.10-10.0.0.200"},
+		DNSServers:    []string{"10.0.0.53"},
+		LeaseDuration: 3600,
+	}
+}
+
+// newTestServer returns a server for cfg with its own in-memory lease state
+func newTestServer(t testing.TB, cfg SubnetConfig) *DHCPServer {
+	t.Helper()
+	s, err := NewDHCPServer(cfg)
+	if err != nil {
+		t.Fatalf("NewDHCPServer: %v", err)
+	}
+	if err := joinSubnets([]*DHCPServer{s}); err != nil {
+		t.Fatal(err)
+	}
+	s.serverIP = testServerIP
+	return s
+}
+
+// testMAC returns a locally administered MAC address ending in n
+func testMAC(n byte) net.HardwareAddr {
+	return net.HardwareAddr{0x02, 0, 0, 0, 0, n}
+}
+
+// newDiscover returns a DISCOVER from mac
+func newDiscover(t testing.TB, mac net.HardwareAddr, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+	p, err := dhcpv4.NewDiscovery(mac, modifiers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// newDecline returns a DECLINE of ip from mac
+func newDecline(t testing.TB, mac net.HardwareAddr, ip net.IP) *dhcpv4.DHCPv4 {
+	t.Helper()
+	p, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDecline),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerIP)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// newRelease returns a RELEASE of ip from mac
+func newRelease(t testing.TB, mac net.HardwareAddr, ip net.IP) *dhcpv4.DHCPv4 {
+	t.Helper()
+	p, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+		dhcpv4.WithClientIP(ip),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerIP)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// newRequest returns a REQUEST from mac for ip in the SELECTING state, naming serverID
+// in option 54 unless it is nil
+func newRequest(t testing.TB, mac net.HardwareAddr, ip, serverID net.IP, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+	base := []dhcpv4.Modifier{
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithBroadcast(true),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+	}
+	if serverID != nil {
+		base = append(base, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)))
+	}
+	p, err := dhcpv4.New(append(base, modifiers...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// serve hands p to s and returns its reply, nil if it sent none
+func serve(t testing.TB, s *DHCPServer, p *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	t.Helper()
+	conn := &fakeConn{}
+	s.ServeDHCP(conn, clientPeer, p)
+	replies := conn.replies(t)
+	switch len(replies) {
+	case 0:
+		return nil
+	case 1:
+		return replies[0]
+	}
+	t.Fatalf("server sent %d replies to one %s", len(replies), p.MessageType())
+	return nil
+}
+
+// inRange reports whether ip lies in the range of testSubnetConfig
+func inRange(ip net.IP) bool {
+	ip4 := ip.To4()
+	return ip4 != nil && ip4[0] == 10 && ip4[1] == 0 && ip4[2] == 0 && ip4[3] >= 10 && ip4[3] <= 200
+}
+
+func TestServeDHCP(t *testing.T) {
+	leaseOptions := []dhcpv4.OptionCode{
+		dhcpv4.OptionServerIdentifier,
+		dhcpv4.OptionIPAddressLeaseTime,
+		dhcpv4.OptionSubnetMask,
+		dhcpv4.OptionRouter,
+		dhcpv4.OptionDomainNameServer,
+	}
+	reserved := testSubnetConfig()
+	reserved.ReservedAddresses = map[string]ReservationConfig{testMAC(9).String(): {IP: "10.0.0.250"}}
+	authoritative := testSubnetConfig()
+	authoritative.Authoritative = true
+	jittered := testSubnetConfig()
+	jittered.LeaseJitterPercent = 10
+
+	tests := []struct {
+		name        string
+		cfg         SubnetConfig
+		setup       []*dhcpv4.DHCPv4 // Sent first, replies ignored
+		packet      *dhcpv4.DHCPv4
+		wantType    dhcpv4.MessageType // MessageTypeNone for no reply
+		wantIP      net.IP             // Expected yiaddr; nil means any address in range
+		wantOptions []dhcpv4.OptionCode
+	}{
+		{
+			name:        "discover is offered an address in range",
+			cfg:         testSubnetConfig(),
+			packet:      newDiscover(t, testMAC(1)),
+			wantType:    dhcpv4.MessageTypeOffer,
+			wantOptions: leaseOptions,
+		},
+		{
+			name:        "discover asking for a free address gets it",
+			cfg:         testSubnetConfig(),
+			packet:      newDiscover(t, testMAC(1), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 77)))),
+			wantType:    dhcpv4.MessageTypeOffer,
+			wantIP:      net.IPv4(10, 0, 0, 77),
+			wantOptions: leaseOptions,
+		},
+		{
+			name:        "jittered lease spells out T1 and T2",
+			cfg:         jittered,
+			packet:      newDiscover(t, testMAC(1)),
+			wantType:    dhcpv4.MessageTypeOffer,
+			wantOptions: append([]dhcpv4.OptionCode{dhcpv4.OptionRenewTimeValue, dhcpv4.OptionRebindingTimeValue}, leaseOptions...),
+		},
+		{
+			name:        "reserved client is offered its address",
+			cfg:         reserved,
+			packet:      newDiscover(t, testMAC(9)),
+			wantType:    dhcpv4.MessageTypeOffer,
+			wantIP:      net.IPv4(10, 0, 0, 250),
+			wantOptions: leaseOptions,
+		},
+		{
+			name:        "request for the offered address is acknowledged",
+			cfg:         testSubnetConfig(),
+			setup:       []*dhcpv4.DHCPv4{newDiscover(t, testMAC(1), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 77))))},
+			packet:      newRequest(t, testMAC(1), net.IPv4(10, 0, 0, 77), testServerIP),
+			wantType:    dhcpv4.MessageTypeAck,
+			wantIP:      net.IPv4(10, 0, 0, 77),
+			wantOptions: leaseOptions,
+		},
+		{
+			name:        "authoritative server refuses an address outside the ranges",
+			cfg:         authoritative,
+			packet:      newRequest(t, testMAC(1), net.IPv4(10, 0, 0, 5), nil),
+			wantType:    dhcpv4.MessageTypeNak,
+			wantIP:      net.IPv4zero,
+			wantOptions: []dhcpv4.OptionCode{dhcpv4.OptionServerIdentifier},
+		},
+		{
+			name:     "non-authoritative server stays silent outside the ranges",
+			cfg:      testSubnetConfig(),
+			packet:   newRequest(t, testMAC(1), net.IPv4(10, 0, 0, 5), nil),
+			wantType: dhcpv4.MessageTypeNone,
+		},
+		{
+			name:     "request naming another server is ignored",
+			cfg:      testSubnetConfig(),
+			setup:    []*dhcpv4.DHCPv4{newDiscover(t, testMAC(1))},
+			packet:   newRequest(t, testMAC(1), net.IPv4(10, 0, 0, 10), net.IPv4(10, 0, 0, 2)),
+			wantType: dhcpv4.MessageTypeNone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.cfg)
+			for _, p := range tt.setup {
+				serve(t, s, p)
+			}
+			reply := serve(t, s, tt.packet)
+			if tt.wantType == dhcpv4.MessageTypeNone {
+				if reply != nil {
+					t.Fatalf("got %s, want no reply", reply.MessageType())
+				}
+				return
+			}
+			if reply == nil {
+				t.Fatalf("got no reply, want %s", tt.wantType)
+			}
+			if got := reply.MessageType(); got != tt.wantType {
+				t.Fatalf("got %s, want %s", got, tt.wantType)
+			}
+			if reply.TransactionID != tt.packet.TransactionID {
+				t.Errorf("transaction ID %s, want %s", reply.TransactionID, tt.packet.TransactionID)
+			}
+			if tt.wantIP != nil && !reply.YourIPAddr.Equal(tt.wantIP) {
+				t.Errorf("yiaddr %s, want %s", reply.YourIPAddr, tt.wantIP)
+			}
+			if tt.wantIP == nil && !inRange(reply.YourIPAddr) {
+				t.Errorf("yiaddr %s is outside the range", reply.YourIPAddr)
+			}
+			for _, code := range tt.wantOptions {
+				if !reply.Options.Has(code) {
+					t.Errorf("option %s missing", code)
+				}
+			}
+			if id := reply.ServerIdentifier(); id != nil && !id.Equal(testServerIP) {
+				t.Errorf("server identifier %s, want %s", id, testServerIP)
+			}
+		})
+	}
+}
+
+func TestServeDHCPReplyOptionValues(t *testing.T) {
+	s := newTestServer(t, testSubnetConfig())
+	reply := serve(t, s, newDiscover(t, testMAC(1)))
+	if reply == nil {
+		t.Fatal("got no OFFER")
+	}
+	if got := reply.IPAddressLeaseTime(0); got != time.Hour {
+		t.Errorf("lease time %s, want 1h", got)
+	}
+	if got := net.IP(reply.SubnetMask()); !got.Equal(net.IPv4(255, 255, 255, 0)) {
+		t.Errorf("subnet mask %s, want 255.255.255.0", got)
+	}
+	if got := reply.Router(); len(got) != 1 || !got[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("routers %v, want [10.0.0.1]", got)
+	}
+	if got := reply.DNS(); len(got) != 1 || !got[0].Equal(net.IPv4(10, 0, 0, 53)) {
+		t.Errorf("DNS servers %v, want [10.0.0.53]", got)
+	}
+}
+
+func TestIncIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip   net.IP
+		want string
+		len  int
+	}{
+		{net.IPv4(192, 168, 1, 1), "192.168.1.2", net.IPv4len},
+		{net.IPv4(192, 168, 1, 255), "192.168.2.0", net.IPv4len},
+		{net.IPv4(10, 255, 255, 255), "11.0.0.0", net.IPv4len},
+		{net.IPv4(192, 168, 1, 255).To4(), "192.168.2.0", net.IPv4len},
+		// The 16-byte form wraps within IPv4 instead of carrying into the ::ffff: prefix
+		{net.IPv4(255, 255, 255, 255), "0.0.0.0", net.IPv4len},
+		{net.IPv4(255, 255, 255, 255).To4(), "0.0.0.0", net.IPv4len},
+		{net.ParseIP("2001:db8::ffff"), "2001:db8::1:0", net.IPv6len},
+		{net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), "::", net.IPv6len},
+	} {
+		in := slices.Clone(tc.ip)
+		got := incIP(tc.ip)
+		if got.String() != tc.want || len(got) != tc.len {
+			t.Errorf("incIP(%s) = %s in %d bytes, want %s in %d", tc.ip, got, len(got), tc.want, tc.len)
+		}
+		if !tc.ip.Equal(in) {
+			t.Errorf("incIP modified its argument to %s", tc.ip)
+		}
+	}
+}
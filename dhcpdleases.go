@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dhcpdTimeLayout is how ISC dhcpd writes lease times, in UTC, after the weekday
+const dhcpdTimeLayout = "2006/01/02 15:04:05"
+
+// dhcpdLease is a lease block of an ISC dhcpd leases file
+type dhcpdLease struct {
+	ip       net.IP
+	mac      net.HardwareAddr
+	starts   time.Time
+	ends     time.Time // Zero for "ends never"
+	state    string    // Binding state, such as active, free or backup
+	hostname string    // Client-hostname as sent by the client
+}
+
+// dhcpdToken is a word, a quoted string or one of { } ; of a leases file
+type dhcpdToken struct {
+	text   string
+	quoted bool
+}
+
+// tokenizeDhcpdLeases splits a leases file into tokens, dropping comments
+func tokenizeDhcpdLeases(data string) ([]dhcpdToken, error) {
+	var tokens []dhcpdToken
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, dhcpdToken{text: string(c)})
+			i++
+		case c == '"':
+			var b strings.Builder
+			i++
+			for i < len(data) && data[i] != '"' {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				b.WriteByte(data[i])
+				i++
+			}
+			if i == len(data) {
+				return tokens, errors.New("unterminated string")
+			}
+			i++
+			tokens = append(tokens, dhcpdToken{text: b.String(), quoted: true})
+		default:
+			start := i
+			for i < len(data) && !strings.ContainsRune(" \t\r\n#{};\"", rune(data[i])) {
+				i++
+			}
+			tokens = append(tokens, dhcpdToken{text: data[start:i]})
+		}
+	}
+	return tokens, nil
+}
+
+// skipDhcpdStatement returns the position after the statement or block starting at i
+func skipDhcpdStatement(tokens []dhcpdToken, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		if tokens[i].quoted {
+			continue
+		}
+		switch tokens[i].text {
+		case ";":
+			if depth == 0 {
+				return i + 1
+			}
+		case "{":
+			depth++
+		case "}":
+			if depth--; depth <= 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
+
+// parseDhcpdLeases parses the lease blocks of an ISC dhcpd leases file in file order.
+// Other statements are ignored; malformed lease blocks are skipped and counted.
+func parseDhcpdLeases(data string) ([]dhcpdLease, int) {
+	tokens, err := tokenizeDhcpdLeases(data)
+	if err != nil {
+		// Keep the blocks before the broken string
+		log.Printf("Warning: dhcpd leases file is cut short: %v", err)
+	}
+	var leases []dhcpdLease
+	malformed := 0
+	for i := 0; i < len(tokens); {
+		if tokens[i].quoted || tokens[i].text != "lease" {
+			i = skipDhcpdStatement(tokens, i)
+			continue
+		}
+		end := skipDhcpdStatement(tokens, i)
+		lease, err := parseDhcpdLease(tokens[i+1 : end])
+		if err != nil {
+			log.Printf("Warning: skipping malformed dhcpd lease block: %v", err)
+			malformed++
+		} else {
+			leases = append(leases, lease)
+		}
+		i = end
+	}
+	return leases, malformed
+}
+
+// parseDhcpdLease parses the tokens of a lease block after the lease keyword: the
+// address and the statements between braces
+func parseDhcpdLease(tokens []dhcpdToken) (dhcpdLease, error) {
+	var lease dhcpdLease
+	if len(tokens) < 3 || tokens[1].text != "{" || tokens[len(tokens)-1].text != "}" {
+		return lease, errors.New("not a complete lease block")
+	}
+	if lease.ip = net.ParseIP(tokens[0].text).To4(); lease.ip == nil {
+		return lease, fmt.Errorf("invalid address %q", tokens[0].text)
+	}
+	body := tokens[2 : len(tokens)-1]
+	for i := 0; i < len(body); {
+		end := skipDhcpdStatement(body, i)
+		words := body[i:end]
+		i = end
+		if words[len(words)-1].text != ";" {
+			continue // A nested block such as "on expiry { ... }"
+		}
+		words = words[:len(words)-1]
+		if len(words) == 0 {
+			continue
+		}
+		var err error
+		switch words[0].text {
+		case "starts":
+			lease.starts, err = parseDhcpdTime(words[1:])
+		case "ends":
+			lease.ends, err = parseDhcpdTime(words[1:])
+		case "binding":
+			if len(words) != 3 || words[1].text != "state" {
+				err = errors.New("invalid binding state")
+			} else {
+				lease.state = words[2].text
+			}
+		case "hardware":
+			if len(words) != 3 || words[1].text != "ethernet" {
+				continue // Other hardware types cannot be served
+			}
+			if lease.mac, err = net.ParseMAC(words[2].text); err != nil {
+				err = fmt.Errorf("invalid hardware address %q", words[2].text)
+			}
+		case "client-hostname":
+			if len(words) == 2 {
+				lease.hostname = words[1].text
+			}
+		}
+		if err != nil {
+			return lease, fmt.Errorf("lease %s: %w", lease.ip, err)
+		}
+	}
+	return lease, nil
+}
+
+// parseDhcpdTime parses the value of a starts or ends statement: a weekday, date and
+// time in UTC, "epoch" and Unix seconds, or "never", returned as the zero time
+func parseDhcpdTime(words []dhcpdToken) (time.Time, error) {
+	switch {
+	case len(words) == 1 && words[0].text == "never":
+		return time.Time{}, nil
+	case len(words) == 2 && words[0].text == "epoch":
+		secs, err := strconv.ParseInt(words[1].text, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q", words[1].text)
+		}
+		return time.Unix(secs, 0).UTC(), nil
+	case len(words) == 3:
+		t, err := time.Parse(dhcpdTimeLayout, words[1].text+" "+words[2].text)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q", words[1].text+" "+words[2].text)
+		}
+		return t, nil
+	}
+	return time.Time{}, errors.New("invalid time")
+}
+
+// importDhcpdLeases seeds the lease table with the active bindings of an ISC dhcpd
+// leases file that lie inside the configured ranges, then saves them to the lease
+// store. Leases restored from the store take precedence over imported ones.
+func (s *DHCPServer) importDhcpdLeases(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read dhcpd leases file: %w", err)
+	}
+	parsed, malformed := parseDhcpdLeases(string(data))
+
+	s.mutex.Lock()
+	now := s.clock.Now()
+
+	// dhcpd appends to the file, so the last block of an address describes it
+	latest := make(map[string]dhcpdLease)
+	var order []string
+	for _, lease := range parsed {
+		key := lease.ip.String()
+		if _, seen := latest[key]; !seen {
+			order = append(order, key)
+		}
+		latest[key] = lease
+	}
+	// A client holds one address; keep its most recently started binding
+	active := make(map[string]dhcpdLease)
+	for _, key := range order {
+		lease := latest[key]
+		if lease.state != "active" || lease.mac == nil || (!lease.ends.IsZero() && !now.Before(lease.ends)) {
+			continue
+		}
+		if held, exists := active[lease.mac.String()]; !exists || lease.starts.After(held.starts) {
+			active[lease.mac.String()] = lease
+		}
+	}
+
+	imported, outside, conflicts := 0, 0, 0
+	for _, key := range order {
+		lease := latest[key]
+		if lease.mac == nil || !lease.ip.Equal(active[lease.mac.String()].ip) {
+			continue
+		}
+		macStr := lease.mac.String()
+		owner := s.subnetFor(lease.ip)
+		if owner == nil {
+			outside++
+			continue
+		}
+		if _, exists := s.leases.Get(macStr); exists || len(s.leases.ByIP(lease.ip)) > 0 {
+			conflicts++
+			continue
+		}
+		reservation := ""
+		if res, exists := owner.reservations[macStr]; exists {
+			if !res.ip.Equal(lease.ip) {
+				conflicts++
+				continue
+			}
+			reservation = macStr
+		} else if owner.isReservedIP(lease.ip) {
+			conflicts++
+			continue
+		} else if pool := owner.poolFor(lease.ip); pool == nil || owner.isExcluded(lease.ip) {
+			outside++
+			continue
+		} else if !pool.takeIP(lease.ip) {
+			conflicts++
+			continue
+		}
+
+		started := lease.starts
+		if started.IsZero() {
+			started = now
+		}
+		// dhcpd moves starts to every renewal, so the two bound the time granted
+		expires, granted := lease.ends, lease.ends.Sub(started)
+		if expires.IsZero() {
+			granted = time.Duration(owner.subnetConfig.LeaseDuration) * time.Second
+			expires = now.Add(granted)
+		}
+		imported++
+		restored := &Lease{
+			IP:          lease.ip,
+			MAC:         lease.mac,
+			ExpiresAt:   expires,
+			State:       StateBound,
+			Hostname:    sanitizeHostname(lease.hostname),
+			StartedAt:   started,
+			LeaseTime:   int(granted / time.Second),
+			Reservation: reservation,
+		}
+		s.leases.Put(restored)
+		s.journalLease(journalAck, restored)
+	}
+	s.mutex.Unlock()
+
+	log.Printf("Imported %d of %d active lease(s) from %s; skipped %d outside the ranges, %d conflicting and %d malformed block(s)",
+		imported, len(active), path, outside, conflicts, malformed)
+	if imported > 0 {
+		s.saveLeases()
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// defaultEmergencyLeaseDuration is the lease time granted from a nearly exhausted pool
+const defaultEmergencyLeaseDuration = 5 * time.Minute
+
+// freePercent returns the share of the pool's addresses that can still be handed out,
+// counting addresses that are cooling down
+func (p *addressPool) freePercent() int {
+	if p.capacity == 0 {
+		return 0
+	}
+	return (p.available + len(p.cooling)) * 100 / p.capacity
+}
+
+// updateEmergency enters emergency mode when less than emergencyPercent of the pool
+// is free and leaves it once twice that share is free again, so the mode does not
+// flap around the threshold. It reports whether the mode changed.
+func (p *addressPool) updateEmergency() bool {
+	if p.emergencyPercent <= 0 {
+		return false
+	}
+	free := p.freePercent()
+	switch {
+	case !p.emergency && free < p.emergencyPercent:
+		p.emergency = true
+		return true
+	case p.emergency && free >= 2*p.emergencyPercent:
+		p.emergency = false
+		return true
+	}
+	return false
+}
+
+// emergencyLeaseDuration returns leaseDuration, shortened to the emergency lease
+// duration while pool is in emergency mode. Mode changes are logged.
+func (s *DHCPServer) emergencyLeaseDuration(pool *addressPool, leaseDuration time.Duration) time.Duration {
+	s.checkEmergency(pool)
+	if pool.emergency {
+		return min(leaseDuration, pool.emergencyLeaseTime)
+	}
+	return leaseDuration
+}
+
+// checkEmergency updates the emergency mode of pool and logs a change
+func (s *DHCPServer) checkEmergency(pool *addressPool) {
+	if !pool.updateEmergency() {
+		return
+	}
+	if pool.emergency {
+		log.Printf("Warning: only %d%% of %s-%s is free; granting %s leases until it recovers",
+			pool.freePercent(), pool.start, pool.end, pool.emergencyLeaseTime)
+	} else {
+		log.Printf("%d%% of %s-%s is free again; granting normal leases", pool.freePercent(), pool.start, pool.end)
+	}
+}
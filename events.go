@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// LeaseEventType says what happened to a lease
+type LeaseEventType string
+
+// Lease event types
+const (
+	LeaseAssigned LeaseEventType = "assigned" // Bound to an address the client did not hold
+	LeaseRenewed  LeaseEventType = "renewed"  // Extended on the address the client held
+	LeaseReleased LeaseEventType = "released" // Given up by the client or through Release
+	LeaseExpired  LeaseEventType = "expired"  // Ran out or was expired through the API
+	LeaseDeclined LeaseEventType = "declined" // Given up by the client with a DECLINE as the address is in use
+)
+
+// LeaseEvent is a change of a lease, delivered to Subscribe channels
+type LeaseEvent struct {
+	Type  LeaseEventType
+	Lease Lease // Copy of the lease as of the event
+	Time  time.Time
+}
+
+// leaseEventBuffer is how many events a subscriber may fall behind before events
+// are dropped for it
+const leaseEventBuffer = 64
+
+// leaseSubscriber is one Subscribe channel
+type leaseSubscriber struct {
+	ch       chan LeaseEvent
+	dropping bool // Events are being dropped; logged once per streak
+}
+
+// leaseEvents fans lease events out to the subscribers
+type leaseEvents struct {
+	mutex       sync.Mutex
+	subscribers []*leaseSubscriber
+}
+
+// Subscribe returns a channel receiving every lease event of the server and the
+// subnets sharing its leases. Events are never waited for: a subscriber that falls
+// more than 64 events behind misses events until it catches up. Call Unsubscribe
+// when done, which closes the channel.
+func (s *DHCPServer) Subscribe() <-chan LeaseEvent {
+	sub := &leaseSubscriber{ch: make(chan LeaseEvent, leaseEventBuffer)}
+	s.events.mutex.Lock()
+	defer s.events.mutex.Unlock()
+	s.events.subscribers = append(s.events.subscribers, sub)
+	return sub.ch
+}
+
+// Unsubscribe stops the events of a channel returned by Subscribe and closes it
+func (s *DHCPServer) Unsubscribe(ch <-chan LeaseEvent) {
+	s.events.mutex.Lock()
+	defer s.events.mutex.Unlock()
+	for i, sub := range s.events.subscribers {
+		if sub.ch == ch {
+			s.events.subscribers = append(s.events.subscribers[:i], s.events.subscribers[i+1:]...)
+			close(sub.ch)
+			return
+		}
+	}
+}
+
+// publishLease sends an event of lease to every subscriber without blocking. The
+// caller must hold s.mutex.
+func (s *DHCPServer) publishLease(eventType LeaseEventType, lease *Lease) {
+	s.events.mutex.Lock()
+	defer s.events.mutex.Unlock()
+	if len(s.events.subscribers) == 0 {
+		return
+	}
+	event := LeaseEvent{Type: eventType, Lease: s.copyLease(lease), Time: s.clock.Now()}
+	for _, sub := range s.events.subscribers {
+		select {
+		case sub.ch <- event:
+			sub.dropping = false
+		default:
+			if !sub.dropping {
+				log.Printf("Warning: lease event subscriber is not keeping up, dropping events")
+				sub.dropping = true
+			}
+		}
+	}
+}
+
+// boundAddress returns the address of the active lease of mac confirmed by an ACK,
+// or nil if it has none
+func (s *DHCPServer) boundAddress(mac net.HardwareAddr) net.IP {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lease, exists := s.leases.Get(mac.String())
+	if !exists || lease.offered() || !s.clock.Now().Before(lease.ExpiresAt) {
+		return nil
+	}
+	return lease.IP
+}
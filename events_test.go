@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// nextEvent returns the next lease event on ch, failing if none is pending
+func nextEvent(t testing.TB, ch <-chan LeaseEvent) LeaseEvent {
+	t.Helper()
+	select {
+	case event := <-ch:
+		return event
+	default:
+		t.Fatal("no lease event")
+		return LeaseEvent{}
+	}
+}
+
+func TestDeclineEndsLease(t *testing.T) {
+	cfg := testSubnetConfig()
+	cfg.DeclineCooldown = 300
+	s := newTestServer(t, cfg)
+	events := s.Subscribe()
+	defer s.Unsubscribe(events)
+
+	mac, ip := testMAC(1), net.IPv4(10, 0, 0, 50).To4()
+	bind(t, s, mac, ip)
+	if event := nextEvent(t, events); event.Type != LeaseAssigned {
+		t.Fatalf("got a %s event, want assigned", event.Type)
+	}
+
+	serve(t, s, newDecline(t, mac, ip))
+	event := nextEvent(t, events)
+	if event.Type != LeaseDeclined || event.Lease.MAC.String() != mac.String() || !event.Lease.IP.Equal(ip) {
+		t.Fatalf("got a %s event for %s on %s, want declined for %s on %s", event.Type, event.Lease.MAC, event.Lease.IP, mac, ip)
+	}
+	if event.Lease.State != StateDeclined {
+		t.Errorf("declined lease is %s", event.Lease.State)
+	}
+	if _, ok := s.Lease(mac); ok {
+		t.Error("declined lease is still held")
+	}
+
+	// A DECLINE of an address the client does not hold ends nothing
+	serve(t, s, newDecline(t, testMAC(2), ip))
+	select {
+	case event := <-events:
+		t.Errorf("got a %s event for a stranger's DECLINE", event.Type)
+	default:
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// parseExclusions parses the exclusions entries, each a single address or a
+// "start-end" range inside network, into ranges
+func parseExclusions(entries []string, network *net.IPNet) ([][2]net.IP, error) {
+	exclusions := make([][2]net.IP, 0, len(entries))
+	for _, entry := range entries {
+		var startIP, endIP net.IP
+		if strings.Contains(entry, "-") {
+			var err error
+			if startIP, endIP, err = parseRange(entry); err != nil {
+				return nil, fmt.Errorf("invalid exclusion: %w", err)
+			}
+		} else if startIP = net.ParseIP(entry).To4(); startIP == nil {
+			return nil, fmt.Errorf("invalid exclusion %q: expected an IPv4 address or a start-end range", entry)
+		} else {
+			endIP = startIP
+		}
+		if !network.Contains(startIP) || !network.Contains(endIP) {
+			return nil, fmt.Errorf("exclusion %s is outside network %s", entry, network)
+		}
+		exclusions = append(exclusions, [2]net.IP{startIP, endIP})
+	}
+	return exclusions, nil
+}
+
+// checkExclusions verifies that no pattern reservation hands out an excluded address.
+// checkReservations covers the other reservations.
+func checkExclusions(exclusions [][2]net.IP, patterns []*patternReservation) error {
+	for _, r := range exclusions {
+		excluded := newAddressPool(r[0], r[1], nil, nil)
+		for _, pr := range patterns {
+			if ip := pr.addressIn(excluded); ip != nil {
+				return fmt.Errorf("reservation for %s: address %s lies in the exclusion %s-%s", pr.key, ip, r[0], r[1])
+			}
+		}
+	}
+	return nil
+}
+
+// excludeInfrastructure takes the network and broadcast addresses of network, unless it
+// is a /31 or /32, and the addresses of routers and DNS servers out of pools, logging
+// each one found in a range
+func excludeInfrastructure(pools []*addressPool, network *net.IPNet, routers, dnsServers []net.IP) {
+	type infraAddress struct {
+		ip   net.IP
+		role string
+	}
+	var addrs []infraAddress
+	if ones, _ := network.Mask.Size(); ones < 31 {
+		addrs = append(addrs, infraAddress{network.IP, "network address"}, infraAddress{broadcastAddress(network), "broadcast address"})
+	}
+	for _, ip := range routers {
+		addrs = append(addrs, infraAddress{ip, "gateway"})
+	}
+	for _, ip := range dnsServers {
+		addrs = append(addrs, infraAddress{ip, "DNS server"})
+	}
+	for _, addr := range addrs {
+		for _, p := range pools {
+			if off, ok := p.offset(addr.ip); ok && !p.excluded.has(off) {
+				p.exclude(off)
+				log.Printf("Warning: leaving %s, the %s, out of the range %s-%s", addr.ip, addr.role, p.start, p.end)
+			}
+		}
+	}
+}
+
+// isInfrastructure reports whether ip is the network or broadcast address of the
+// subnet or one of its routers or DNS servers
+func (s *DHCPServer) isInfrastructure(ip net.IP) bool {
+	if isNetworkOrBroadcast(ip, s.network) {
+		return true
+	}
+	for _, other := range append(append([]net.IP{}, s.routers...), s.dnsServers...) {
+		if ip.Equal(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcluded reports whether ip lies in one of the subnet's exclusions
+func (s *DHCPServer) isExcluded(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+	v := ipToUint32(ip)
+	for _, r := range s.exclusions {
+		if v >= ipToUint32(r[0]) && v <= ipToUint32(r[1]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// parseExpiryWarningFraction validates expiry_warning_fraction, 0 disabling warnings
+func parseExpiryWarningFraction(fraction float64) (float64, error) {
+	if fraction < 0 || fraction >= 1 {
+		return 0, fmt.Errorf("expiry_warning_fraction must be between 0 and 1, got %g", fraction)
+	}
+	return fraction, nil
+}
+
+// warnExpiring announces the bound leases that have run past the expiry warning
+// fraction of their term without being renewed, once per term: a renewal moves the
+// expiry and arms the warning again. The caller must hold s.mutex.
+func (s *DHCPServer) warnExpiring(now time.Time) {
+	if s.expiryWarning == 0 {
+		return
+	}
+	leases := s.leases.Snapshot()
+	for mac, expiresAt := range s.warnedExpiry {
+		if lease, exists := leases[mac]; !exists || !lease.ExpiresAt.Equal(expiresAt) {
+			delete(s.warnedExpiry, mac)
+		}
+	}
+	for mac, lease := range leases {
+		if lease.offered() || lease.LeaseTime == 0 || !now.Before(lease.ExpiresAt) {
+			continue
+		}
+		remaining := time.Duration(float64(lease.granted()) * (1 - s.expiryWarning))
+		if now.Before(lease.ExpiresAt.Add(-remaining)) {
+			continue
+		}
+		if _, warned := s.warnedExpiry[mac]; warned {
+			continue
+		}
+		s.warnedExpiry[mac] = lease.ExpiresAt
+		log.Printf("Lease of %s on %s expires at %s without having been renewed", mac, lease.IP, lease.ExpiresAt.Format(time.RFC3339))
+		s.notifyLease("expiring", lease)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// knownFingerprints maps well-known Parameter Request List sequences to device labels
+var knownFingerprints = map[string]string{
+	"1,3,6,15,31,33,43,44,46,47,119,121,249,252": "Windows 10",
+	"1,3,6,15,31,33,43,44,46,47,121,249,252":     "Windows 7",
+	"1,3,6,15,26,28,51,58,59,43":                 "Android",
+	"1,3,6,15,26,28,51,58,59,43,114":             "Android",
+	"1,3,6,15,26,28,51,58,59,43,114,108":         "Android",
+	"1,121,3,6,15,119,252":                       "iOS",
+	"1,121,3,6,15,114,119,252,95,44,46":          "macOS",
+	"1,121,3,6,15,119,252,95,44,46":              "macOS",
+	"1,28,2,3,15,6,119,12,44,47,26,121,42":       "Linux (dhclient)",
+	"1,3,6,12,15,28,42":                          "Linux (udhcpc)",
+	"1,3,15,6":                                   "PlayStation",
+	"1,3,6,15,28,33":                             "Nintendo Switch",
+}
+
+// fingerprint returns the option codes of the client's Parameter Request List (option 55)
+// in the order sent, as a comma-separated string, or "" if the option is absent
+func fingerprint(p *dhcpv4.DHCPv4) string {
+	prl := p.Options.Get(dhcpv4.OptionParameterRequestList)
+	codes := make([]string, len(prl))
+	for i, code := range prl {
+		codes[i] = strconv.Itoa(int(code))
+	}
+	return strings.Join(codes, ",")
+}
+
+// fingerprintLabel returns the device label for a fingerprint, or "unknown"
+func fingerprintLabel(fp string) string {
+	if label, ok := knownFingerprints[fp]; ok {
+		return label
+	}
+	return "unknown"
+}
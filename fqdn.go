@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Client FQDN option (81, RFC 4702) flag bits
+const (
+	fqdnFlagS = 0x01 // Server should perform the A RR update
+	fqdnFlagO = 0x02 // Server overrode the client's S bit
+	fqdnFlagE = 0x04 // Domain name uses the canonical wire format
+	fqdnFlagN = 0x08 // Server should not perform any DNS updates
+)
+
+// clientFQDN is a parsed Client FQDN option
+type clientFQDN struct {
+	flags   byte
+	name    string // Without the trailing dot
+	partial bool   // The client sent only a leading part of its name
+}
+
+// parseClientFQDN decodes option 81 from the packet, returning nil if it is absent
+func parseClientFQDN(p *dhcpv4.DHCPv4) (*clientFQDN, error) {
+	data := p.Options.Get(dhcpv4.OptionFQDN)
+	if data == nil {
+		return nil, nil
+	}
+	if len(data) < 3 {
+		return nil, fmt.Errorf("client FQDN option too short: %d bytes", len(data))
+	}
+	// The RCODE1 and RCODE2 bytes are deprecated and ignored
+	fqdn := &clientFQDN{flags: data[0] & (fqdnFlagS | fqdnFlagE | fqdnFlagN)}
+	if fqdn.flags&fqdnFlagS != 0 && fqdn.flags&fqdnFlagN != 0 {
+		return nil, fmt.Errorf("client FQDN option has both S and N flags set")
+	}
+
+	name := data[3:]
+	if fqdn.flags&fqdnFlagE == 0 {
+		// Deprecated ASCII encoding; a trailing dot marks a fully qualified name
+		fqdn.name = strings.TrimSuffix(string(name), ".")
+		fqdn.partial = !strings.HasSuffix(string(name), ".")
+		return fqdn, nil
+	}
+
+	labels := []string{}
+	fqdn.partial = true
+	for len(name) > 0 {
+		length := int(name[0])
+		if length == 0 {
+			fqdn.partial = false
+			if len(name) > 1 {
+				return nil, fmt.Errorf("client FQDN option has data after the root label")
+			}
+			break
+		}
+		if length > 63 || length+1 > len(name) {
+			return nil, fmt.Errorf("client FQDN option has an invalid label length %d", length)
+		}
+		labels = append(labels, string(name[1:1+length]))
+		name = name[1+length:]
+	}
+	fqdn.name = strings.Join(labels, ".")
+	return fqdn, nil
+}
+
+// complete fills in the name the server answers with: hostname when the client sent
+// none, qualified with domain when the name is partial and a domain is configured
+func (f *clientFQDN) complete(hostname, domain string) {
+	if f.name == "" {
+		if hostname == "" {
+			return
+		}
+		f.name, f.partial = hostname, true
+	}
+	if f.partial && domain != "" {
+		f.name = f.name + "." + strings.Trim(domain, ".")
+		f.partial = false
+	}
+}
+
+// encodeFQDNName encodes name in the wire format, terminated by the root label
+// unless partial
+func encodeFQDNName(name string, partial bool) []byte {
+	var b []byte
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	if !partial {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// fqdnReply builds the server's option 81 response. When serverUpdates is set the
+// server updates DNS itself, so it sets S and clears N, setting O if the client had
+// not asked for that. Otherwise it clears S and leaves the update to the client,
+// setting O when the client had asked the server to update. E is echoed.
+func fqdnReply(fqdn *clientFQDN, serverUpdates bool) dhcpv4.Option {
+	flags := fqdn.flags & fqdnFlagE
+	switch {
+	case serverUpdates:
+		flags |= fqdnFlagS
+		if fqdn.flags&fqdnFlagS == 0 {
+			flags |= fqdnFlagO
+		}
+	case fqdn.flags&fqdnFlagS != 0:
+		flags |= fqdnFlagO
+	default:
+		flags |= fqdn.flags & fqdnFlagN
+	}
+	data := []byte{flags, 255, 255}
+	if flags&fqdnFlagE != 0 {
+		data = append(data, encodeFQDNName(fqdn.name, fqdn.partial)...)
+	} else {
+		name := fqdn.name
+		if !fqdn.partial {
+			name += "."
+		}
+		data = append(data, name...)
+	}
+	return dhcpv4.OptGeneric(dhcpv4.OptionFQDN, data)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// withFQDN returns a packet carrying data as option 81
+func withFQDN(t *testing.T, data []byte) *dhcpv4.DHCPv4 {
+	t.Helper()
+	p, err := dhcpv4.New(dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionFQDN, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// TestClientFQDNRoundTrip decodes hand-encoded option 81 bytes in both the deprecated
+// ASCII form and the RFC 1035 wire form, then checks that a reply echoing the client's
+// flags encodes the name back to the same bytes
+func TestClientFQDNRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		wire    []byte
+		fqdn    string
+		partial bool
+	}{
+		{
+			name: "ascii qualified",
+			wire: append([]byte{0, 255, 255}, "host.example.com."...),
+			fqdn: "host.example.com",
+		},
+		{
+			name:    "ascii partial",
+			wire:    append([]byte{0, 255, 255}, "host"...),
+			fqdn:    "host",
+			partial: true,
+		},
+		{
+			name: "wire qualified",
+			wire: []byte{fqdnFlagE, 255, 255,
+				4, 'h', 'o', 's', 't',
+				7, 'e', 'x', 'a', 'm', 'p', 'l', 'e',
+				3, 'c', 'o', 'm',
+				0},
+			fqdn: "host.example.com",
+		},
+		{
+			name:    "wire partial",
+			wire:    []byte{fqdnFlagE, 255, 255, 4, 'h', 'o', 's', 't'},
+			fqdn:    "host",
+			partial: true,
+		},
+		{
+			name: "wire root only",
+			wire: []byte{fqdnFlagE, 255, 255, 0},
+		},
+		{
+			name:    "wire empty",
+			wire:    []byte{fqdnFlagE, 255, 255},
+			partial: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fqdn, err := parseClientFQDN(withFQDN(t, tc.wire))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fqdn.flags != tc.wire[0] || fqdn.name != tc.fqdn || fqdn.partial != tc.partial {
+				t.Fatalf("parsed %+v, want flags %#x name %q partial %v", fqdn, tc.wire[0], tc.fqdn, tc.partial)
+			}
+			if got := fqdnReply(fqdn, false).Value.ToBytes(); !bytes.Equal(got, tc.wire) {
+				t.Errorf("reply encodes as %v, want %v", got, tc.wire)
+			}
+		})
+	}
+}
+
+// TestClientFQDNFlags checks the S/O/E/N bits of the reply for each combination the
+// client may send, with and without the server doing the DNS updates
+func TestClientFQDNFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		client        byte
+		serverUpdates bool
+		want          byte
+	}{
+		{"none, client updates", 0, false, 0},
+		{"none, server updates", 0, true, fqdnFlagS | fqdnFlagO},
+		{"S, client updates", fqdnFlagS, false, fqdnFlagO},
+		{"S, server updates", fqdnFlagS, true, fqdnFlagS},
+		{"N, client updates", fqdnFlagN, false, fqdnFlagN},
+		{"N, server updates", fqdnFlagN, true, fqdnFlagS | fqdnFlagO},
+		{"E, client updates", fqdnFlagE, false, fqdnFlagE},
+		{"SE, server updates", fqdnFlagS | fqdnFlagE, true, fqdnFlagS | fqdnFlagE},
+		{"NE, client updates", fqdnFlagN | fqdnFlagE, false, fqdnFlagN | fqdnFlagE},
+		// O is only meaningful from the server and is ignored from the client
+		{"O, client updates", fqdnFlagO, false, 0},
+		{"SO, server updates", fqdnFlagS | fqdnFlagO, true, fqdnFlagS},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			wire := append([]byte{tc.client, 255, 255}, "host"...)
+			if tc.client&fqdnFlagE != 0 {
+				wire = []byte{tc.client, 255, 255, 4, 'h', 'o', 's', 't'}
+			}
+			fqdn, err := parseClientFQDN(withFQDN(t, wire))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fqdn.flags&fqdnFlagO != 0 {
+				t.Errorf("parsed flags %#x keep the client's O bit", fqdn.flags)
+			}
+			got := fqdnReply(fqdn, tc.serverUpdates).Value.ToBytes()
+			if got[0] != tc.want {
+				t.Errorf("reply flags = %#x, want %#x", got[0], tc.want)
+			}
+			if got[1] != 255 || got[2] != 255 {
+				t.Errorf("reply RCODEs = %d, %d, want 255, 255", got[1], got[2])
+			}
+			if !bytes.Equal(got[3:], wire[3:]) {
+				t.Errorf("reply name = %v, want %v", got[3:], wire[3:])
+			}
+		})
+	}
+}
+
+func TestClientFQDNInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		wire []byte
+	}{
+		{"too short", []byte{0, 255}},
+		{"S and N", append([]byte{fqdnFlagS | fqdnFlagN, 255, 255}, "host"...)},
+		{"label past end", []byte{fqdnFlagE, 255, 255, 5, 'h', 'o', 's', 't'}},
+		{"label too long", append([]byte{fqdnFlagE, 255, 255, 64}, bytes.Repeat([]byte{'a'}, 64)...)},
+		{"data after root", []byte{fqdnFlagE, 255, 255, 4, 'h', 'o', 's', 't', 0, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if fqdn, err := parseClientFQDN(withFQDN(t, tc.wire)); err == nil {
+				t.Errorf("parsed %+v, want an error", fqdn)
+			}
+		})
+	}
+}
+
+func TestClientFQDNAbsent(t *testing.T) {
+	p, err := dhcpv4.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fqdn, err := parseClientFQDN(p); fqdn != nil || err != nil {
+		t.Errorf("parseClientFQDN = %+v, %v, want nil, nil", fqdn, err)
+	}
+}
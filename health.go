@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// healthState tracks what GET /healthz reports
+type healthState struct {
+	startedAt time.Time
+	serving   atomic.Bool  // Set once every listener is bound
+	storeErr  atomic.Value // Message of the last failed lease store write, "" after a success
+}
+
+// recordStoreResult remembers the outcome of a lease store write
+func (h *healthState) recordStoreResult(err error) {
+	if err != nil {
+		h.storeErr.Store(err.Error())
+	} else {
+		h.storeErr.Store("")
+	}
+}
+
+// storeError returns the message of the last failed lease store write, or ""
+func (h *healthState) storeError() string {
+	msg, _ := h.storeErr.Load().(string)
+	return msg
+}
+
+// healthReport is the JSON body of GET /healthz
+type healthReport struct {
+	Status        string `json:"status"` // ok, starting or store_failing
+	Error         string `json:"error,omitempty"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+	ActiveLeases  int    `json:"active_leases"`
+}
+
+// activeLeases counts the leases confirmed by an ACK that have not expired
+func (s *DHCPServer) activeLeases(now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	active := 0
+	for _, lease := range s.leases.Snapshot() {
+		if !lease.offered() && now.Before(lease.ExpiresAt) {
+			active++
+		}
+	}
+	return active
+}
+
+// handleHealth answers 200 while the server is serving and its lease store accepts
+// writes, and 503 during startup or after a failed write
+func (api *apiServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	now := api.server.clock.Now()
+	h := &api.server.health
+	report := healthReport{
+		Status:        "ok",
+		UptimeSeconds: int64(now.Sub(h.startedAt).Seconds()),
+		ActiveLeases:  api.server.activeLeases(now),
+	}
+	status := http.StatusOK
+	switch {
+	case !h.serving.Load():
+		report.Status, status = "starting", http.StatusServiceUnavailable
+	case h.storeError() != "":
+		report.Status, report.Error, status = "store_failing", h.storeError(), http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"time"
+)
+
+// Defaults of the address history eviction policy
+const (
+	defaultAddressHistorySize   = 4
+	defaultAddressHistoryMaxAge = 30 * 24 * time.Hour
+)
+
+// pastAddress is an address a client held before its lease ended
+type pastAddress struct {
+	IP         net.IP    `json:"ip"`
+	ReleasedAt time.Time `json:"released_at"`
+}
+
+// rememberAddress records that the lease of mac on ip ended at, keeping the most
+// recent historySize distinct addresses. The caller must hold s.mutex.
+func (s *DHCPServer) rememberAddress(mac string, ip net.IP, at time.Time) {
+	past := slices.DeleteFunc(s.history[mac], func(entry pastAddress) bool {
+		return entry.IP.Equal(ip)
+	})
+	past = slices.Insert(past, 0, pastAddress{IP: ip, ReleasedAt: at})
+	if len(past) > s.historySize {
+		past = past[:s.historySize]
+	}
+	s.history[mac] = past
+}
+
+// pruneHistory drops history entries older than historyMaxAge. The caller must hold
+// s.mutex.
+func (s *DHCPServer) pruneHistory(now time.Time) {
+	for mac, past := range s.history {
+		past = slices.DeleteFunc(past, func(entry pastAddress) bool {
+			return s.historyMaxAge > 0 && now.Sub(entry.ReleasedAt) >= s.historyMaxAge
+		})
+		if len(past) == 0 {
+			delete(s.history, mac)
+		} else {
+			s.history[mac] = past
+		}
+	}
+}
+
+// claimPastAddress takes the most recent address mac held before that is still free
+// in pool, or returns nil. The caller must hold s.mutex and bind the lease.
+func (s *DHCPServer) claimPastAddress(mac string, pool *addressPool) net.IP {
+	now := s.clock.Now()
+	for _, entry := range s.history[mac] {
+		if s.historyMaxAge > 0 && now.Sub(entry.ReleasedAt) >= s.historyMaxAge {
+			break // Older entries have expired as well
+		}
+		if s.poolFor(entry.IP) == pool && pool.takeIP(entry.IP) {
+			return entry.IP
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// expire advances clock by d and reaps the leases that ran out
+func expire(t *testing.T, s *DHCPServer, clock fakeClock, d time.Duration) {
+	t.Helper()
+	clock.Advance(d)
+	s.reapExpired(clock.Now())
+}
+
+// TestReturningClientGetsPastAddress lets a lease expire and other clients take
+// addresses from the pool, then has the client come back several lease periods later
+// without asking for any address
+func TestReturningClientGetsPastAddress(t *testing.T) {
+	s, clock := newClockedServer(t, testSubnetConfig())
+	mac, ip := testMAC(1), net.IPv4(10, 0, 0, 50).To4()
+	bind(t, s, mac, ip)
+
+	expire(t, s, clock, 3*time.Hour)
+	if _, ok := s.Lease(mac); ok {
+		t.Fatal("lease outlived three lease periods")
+	}
+	if !isFree(t, s, ip) {
+		t.Fatalf("%s did not return to the pool", ip)
+	}
+	for n := byte(2); n < 7; n++ {
+		if offer := serve(t, s, newDiscover(t, testMAC(n))); offer == nil || offer.YourIPAddr.Equal(ip) {
+			t.Fatalf("client %d offered %v", n, offer)
+		}
+	}
+
+	clock.Advance(2 * time.Hour)
+	offer := serve(t, s, newDiscover(t, mac))
+	if offer == nil || !offer.YourIPAddr.Equal(ip) {
+		t.Fatalf("returning client offered %v, want %s", offer, ip)
+	}
+	if ack := serve(t, s, newRequest(t, mac, ip, testServerIP)); ack == nil || !ack.YourIPAddr.Equal(ip) {
+		t.Fatalf("returning client acked %v, want %s", ack, ip)
+	}
+}
+
+// TestPastAddressEviction checks that a client falls back to an older address when
+// its latest is taken, forgets addresses beyond address_history, and forgets all of
+// them after address_history_max_age
+func TestPastAddressEviction(t *testing.T) {
+	newServer := func(t *testing.T) (*DHCPServer, fakeClock) {
+		s, clock := newClockedServer(t, testSubnetConfig())
+		s.historySize, s.historyMaxAge = 2, 24*time.Hour
+		return s, clock
+	}
+	mac := testMAC(1)
+	ip := func(n byte) net.IP { return net.IPv4(10, 0, 0, n).To4() }
+	held := func(t *testing.T, s *DHCPServer, clock fakeClock, ips ...net.IP) {
+		for _, ip := range ips {
+			bind(t, s, mac, ip)
+			expire(t, s, clock, 2*time.Hour)
+		}
+	}
+
+	t.Run("latest taken", func(t *testing.T) {
+		s, clock := newServer(t)
+		held(t, s, clock, ip(60), ip(61))
+		bind(t, s, testMAC(2), ip(61))
+		if offer := serve(t, s, newDiscover(t, mac)); offer == nil || !offer.YourIPAddr.Equal(ip(60)) {
+			t.Fatalf("offered %v, want 10.0.0.60", offer)
+		}
+	})
+
+	t.Run("beyond address_history", func(t *testing.T) {
+		s, clock := newServer(t)
+		held(t, s, clock, ip(60), ip(61), ip(62))
+		bind(t, s, testMAC(2), ip(62))
+		bind(t, s, testMAC(3), ip(61))
+		if offer := serve(t, s, newDiscover(t, mac)); offer == nil || offer.YourIPAddr.Equal(ip(60)) {
+			t.Fatalf("offered %v, want an address other than the forgotten 10.0.0.60", offer)
+		}
+	})
+
+	t.Run("after address_history_max_age", func(t *testing.T) {
+		s, clock := newServer(t)
+		held(t, s, clock, ip(60))
+		expire(t, s, clock, 23*time.Hour)
+		if offer := serve(t, s, newDiscover(t, mac)); offer == nil || offer.YourIPAddr.Equal(ip(60)) {
+			t.Fatalf("offered %v, want an address other than the forgotten 10.0.0.60", offer)
+		}
+	})
+}
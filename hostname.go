@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// maxHostnameLength caps stored hostnames at the length of a DNS label
+const maxHostnameLength = 63
+
+// clientHostname returns the sanitized hostname (option 12) sent by the client, or ""
+func clientHostname(p *dhcpv4.DHCPv4) string {
+	return sanitizeHostname(p.HostName())
+}
+
+// sanitizeHostname keeps only letters, digits and hyphens, trims leading and trailing
+// hyphens and caps the result at maxHostnameLength characters
+func sanitizeHostname(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	hostname := b.String()
+	if len(hostname) > maxHostnameLength {
+		hostname = hostname[:maxHostnameLength]
+	}
+	return strings.Trim(hostname, "-")
+}
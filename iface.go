@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// interfaceIPv4 returns the IPv4 address of the named interface to use as the server
+// identifier. Addresses inside network are preferred; link-local addresses are ignored.
+func interfaceIPv4(name string, network *net.IPNet) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: failed to list addresses: %w", name, err)
+	}
+
+	var fallback net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP.To4()
+		if ip == nil || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if network != nil && network.Contains(ip) {
+			return ip, nil
+		}
+		if fallback == nil {
+			fallback = ip
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("interface %s has no IPv4 address; assign one before starting DHCP", name)
+	}
+	return fallback, nil
+}
+
+// interfaceInNetwork reports whether the interface has an IPv4 address inside network
+func interfaceInNetwork(name string, network *net.IPNet) bool {
+	ip, err := interfaceIPv4(name, network)
+	return err == nil && network.Contains(ip)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// starterConfig is the commented example written by -init-config
+const starterConfig = `# DHCP server configuration. See README.md for every parameter.
+
+# Network interface to serve (overridden by the -iface flag)
+interface: "en0"
+
+# The subnet served, in CIDR notation
+network: "192.168.2.0/24"
+
+# Router handed to clients in option 3; it must lie inside network
+gateway: "192.168.2.1"
+
+# Addresses handed out dynamically, as start-end inside network
+range: "192.168.2.100-192.168.2.200"
+
+# Lease time in seconds
+lease_duration: 3600
+
+# DNS servers handed to clients in option 6
+dns_servers:
+  - "192.168.2.1"
+  - "8.8.8.8"
+
+# Fixed addresses by client MAC, kept out of range
+reserved_addresses:
+  "11:22:33:44:55:66": "192.168.2.20"
+`
+
+// writeStarterConfig writes starterConfig to path, refusing to overwrite an existing file
+func writeStarterConfig(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists; remove it or choose another path with -config", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create config file: %w", err)
+	}
+	if _, err := f.WriteString(starterConfig); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+)
+
+// pipeConn is one end of an in-memory datagram link made by packetPipe. Every packet
+// written to one end is read from the other, whatever its destination.
+type pipeConn struct {
+	local, remote *net.UDPAddr
+	in            <-chan []byte
+	out           chan<- []byte
+	done          chan struct{} // Closed by Close
+	peerDone      chan struct{} // done of the other end
+	once          sync.Once
+}
+
+// packetPipe returns the two ends of an in-memory link between a client and a server
+// port
+func packetPipe() (client, server *pipeConn) {
+	toServer, toClient := make(chan []byte, 16), make(chan []byte, 16)
+	clientDone, serverDone := make(chan struct{}), make(chan struct{})
+	clientAddr := &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}
+	serverAddr := &net.UDPAddr{IP: testServerIP, Port: dhcpv4.ServerPort}
+	client = &pipeConn{local: clientAddr, remote: serverAddr, in: toClient, out: toServer, done: clientDone, peerDone: serverDone}
+	server = &pipeConn{local: serverAddr, remote: clientAddr, in: toServer, out: toClient, done: serverDone, peerDone: clientDone}
+	return client, server
+}
+
+func (c *pipeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.in:
+		return copy(b, packet), c.remote, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *pipeConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	packet := append([]byte(nil), b...)
+	select {
+	case c.out <- packet:
+		return len(b), nil
+	case <-c.peerDone:
+		return len(b), nil // Lost, like a datagram to a closed port
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *pipeConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr              { return c.local }
+func (c *pipeConn) SetDeadline(time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestClientExchange(t *testing.T) {
+	s := newTestServer(t, testSubnetConfig())
+	clientConn, serverConn := packetPipe()
+
+	server, err := server4.NewServer("", nil, subnetHandler("test0", []*DHCPServer{s}, s), server4.WithConn(serverConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Close()
+
+	mac := testMAC(1)
+	client, err := nclient4.NewWithConn(clientConn, mac, nclient4.WithTimeout(2*time.Second), nclient4.WithRetry(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	lease, err := client.Request(ctx, dhcpv4.WithOption(dhcpv4.OptHostName("e2e-client")))
+	if err != nil {
+		t.Fatalf("discover/offer/request/ack exchange failed: %v", err)
+	}
+
+	ack := lease.ACK
+	if ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("got %s, want ACK", ack.MessageType())
+	}
+	if !inRange(ack.YourIPAddr) {
+		t.Errorf("assigned %s, outside the range", ack.YourIPAddr)
+	}
+	if !ack.YourIPAddr.Equal(lease.Offer.YourIPAddr) {
+		t.Errorf("ACK for %s, but %s was offered", ack.YourIPAddr, lease.Offer.YourIPAddr)
+	}
+	if id := ack.ServerIdentifier(); !id.Equal(testServerIP) {
+		t.Errorf("server identifier %s, want %s", id, testServerIP)
+	}
+	if got := ack.IPAddressLeaseTime(0); got != time.Hour {
+		t.Errorf("lease time %s, want 1h", got)
+	}
+	if got := net.IP(ack.SubnetMask()); !got.Equal(net.IPv4(255, 255, 255, 0)) {
+		t.Errorf("subnet mask %s, want 255.255.255.0", got)
+	}
+	if got := ack.Router(); len(got) != 1 || !got[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("routers %v, want [10.0.0.1]", got)
+	}
+	if got := ack.DNS(); len(got) != 1 || !got[0].Equal(net.IPv4(10, 0, 0, 53)) {
+		t.Errorf("DNS servers %v, want [10.0.0.53]", got)
+	}
+
+	bound, ok := s.Lease(mac)
+	if !ok {
+		t.Fatal("server has no lease for the client")
+	}
+	if bound.State != StateBound || !bound.IP.Equal(ack.YourIPAddr) {
+		t.Errorf("server lease is %s on %s, want bound on %s", bound.State, bound.IP, ack.YourIPAddr)
+	}
+	if bound.Hostname != "e2e-client" {
+		t.Errorf("server lease hostname %q, want e2e-client", bound.Hostname)
+	}
+}
@@ -0,0 +1,140 @@
+// Package testutil holds helpers shared by the server's tests
+package testutil
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeClock is a clock whose time only moves when Advance is called. Timers and
+// tickers made by it fire during Advance, in time order, so tests drive expiry and
+// background loops without sleeping.
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*waiter
+	changed chan struct{} // Closed and replaced whenever a waiter is added
+}
+
+// waiter is a pending After or an active ticker
+type waiter struct {
+	at     time.Time
+	period time.Duration // Zero for After
+	ch     chan time.Time
+}
+
+// NewFakeClock returns a fake clock set to now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now, changed: make(chan struct{})}
+}
+
+// Now returns the current fake time
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// After delivers the fake time on the channel once Advance moved it d ahead
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w := &waiter{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.add(w)
+	return w.ch
+}
+
+// NewTicker returns a ticker delivering the fake time every d. Like a time.Ticker it
+// drops ticks a slow receiver misses.
+func (c *FakeClock) NewTicker(d time.Duration) *FakeTicker {
+	if d <= 0 {
+		panic("testutil: non-positive interval for NewTicker")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w := &waiter{at: c.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	c.add(w)
+	return &FakeTicker{clock: c, w: w}
+}
+
+// add registers w and wakes BlockUntil. The caller must hold c.mutex.
+func (c *FakeClock) add(w *waiter) {
+	c.waiters = append(c.waiters, w)
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// remove unregisters w
+func (c *FakeClock) remove(w *waiter) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Advance moves the time d ahead, firing every timer and tick due by then in order
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.waiters, func(i, j int) bool { return c.waiters[i].at.Before(c.waiters[j].at) })
+		if len(c.waiters) == 0 || c.waiters[0].at.After(end) {
+			break
+		}
+		w := c.waiters[0]
+		c.now = w.at
+		select {
+		case w.ch <- w.at:
+		default:
+		}
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+	}
+	c.now = end
+}
+
+// Waiters returns the number of pending timers and active tickers
+func (c *FakeClock) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntil waits until at least n timers and tickers are pending, so a test can
+// advance the time once a background loop is waiting on the clock
+func (c *FakeClock) BlockUntil(n int) {
+	for {
+		c.mutex.Lock()
+		pending, changed := len(c.waiters), c.changed
+		c.mutex.Unlock()
+		if pending >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+// FakeTicker is a ticker made by a FakeClock
+type FakeTicker struct {
+	clock *FakeClock
+	w     *waiter
+}
+
+// C returns the channel ticks are delivered on
+func (t *FakeTicker) C() <-chan time.Time {
+	return t.w.ch
+}
+
+// Stop turns the ticker off
+func (t *FakeTicker) Stop() {
+	t.clock.remove(t.w)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"time"
+)
+
+// maxLeaseJitterPercent bounds lease_jitter_percent so T1 of the shortest jittered
+// lease still comes after T2 of none
+const maxLeaseJitterPercent = 50
+
+// jitteredLeaseTime spreads base by up to ±percent. The result depends only on the
+// client and the start of its binding, so retransmitted replies and renewals agree.
+func jitteredLeaseTime(base time.Duration, percent int, mac net.HardwareAddr, start time.Time) time.Duration {
+	if percent <= 0 {
+		return base
+	}
+	h := fnv.New64a()
+	h.Write(mac)
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(start.Unix())))
+	// Map the hash onto [-1, 1] in steps of 0.001
+	frac := float64(h.Sum64()%2001)/1000 - 1
+	d := time.Duration(float64(base) * (1 + frac*float64(percent)/100)).Round(time.Second)
+	return max(d, time.Second)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Journal fsync policies
+const (
+	journalFsyncAlways   = "always"   // Before a record is considered written
+	journalFsyncInterval = "interval" // At most once per journalFsyncPeriod
+	journalFsyncNever    = "never"    // Left to the operating system
+)
+
+// journalFsyncPeriod is how often the interval policy syncs the journal
+const journalFsyncPeriod = time.Second
+
+// journalHeaderSize is the size of the frame header of a record: the payload length
+// and its CRC-32C, both big-endian
+const journalHeaderSize = 8
+
+// journalMaxRecord bounds the payload length read back, so a corrupt length is
+// recognized instead of allocating gigabytes
+const journalMaxRecord = 1 << 20
+
+// journalTable is the CRC-32C (Castagnoli) table used to checksum records
+var journalTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Journal record events. Checkpoints are written after the lease store saved a
+// snapshot and are not lease events.
+const (
+	journalOffer      = "offer"
+	journalAck        = "ack"
+	journalRenew      = "renew"
+	journalRelease    = "release"
+	journalExpire     = "expire"
+	journalDecline    = "decline"
+	journalCheckpoint = "checkpoint"
+)
+
+// journalRecord is one entry of the lease journal
+type journalRecord struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	MAC         string    `json:"mac,omitempty"`
+	IP          net.IP    `json:"ip,omitempty"`
+	Lease       *Lease    `json:"lease,omitempty"`       // The lease as granted, for offer, ack and renew
+	Offered     bool      `json:"offered,omitempty"`     // The released or expired lease was only offered
+	Quarantined bool      `json:"quarantined,omitempty"` // A declined address was withheld from the pool
+	Covers      int64     `json:"covers,omitempty"`      // Journal size included in the snapshot of a checkpoint
+}
+
+// leaseJournal appends lease events to a file of framed, checksummed JSON records.
+// It is the audit trail of who held which address when, and lets loadLeases replay
+// the changes a missing or stale lease store snapshot lacks.
+type leaseJournal struct {
+	mutex    sync.Mutex
+	path     string
+	file     *os.File
+	lock     *os.File
+	size     int64  // Bytes of intact records in the file
+	fsync    string // always, interval or never
+	lastSync time.Time
+	failed   bool           // Writes are failing; logged once per streak
+	covered  int64          // Position covered by the latest checkpoint
+	pending  []journalEntry // Records read at open, until loadLeases replays them
+}
+
+// openLeaseJournal opens the journal at path for appending with the fsync policy, ""
+// meaning always. A torn or corrupt record at the end, left by a crash, is cut off.
+func openLeaseJournal(path, fsync string) (*leaseJournal, error) {
+	switch fsync {
+	case "":
+		fsync = journalFsyncAlways
+	case journalFsyncAlways, journalFsyncInterval, journalFsyncNever:
+	default:
+		return nil, fmt.Errorf("invalid journal_fsync %q: must be always, interval or never", fsync)
+	}
+	lock, err := lockFile(path + ".lock")
+	if errors.Is(err, errLocked) {
+		return nil, fmt.Errorf("%s is in use by another instance of the server (%s is locked)", path, path+".lock")
+	}
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		if lock != nil {
+			lock.Close()
+		}
+		return nil, fmt.Errorf("failed to open lease journal: %w", err)
+	}
+	j := &leaseJournal{path: path, file: file, lock: lock, fsync: fsync}
+	if j.pending, err = j.records(); err != nil {
+		j.close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// records reads every intact record with its offset and positions the file for
+// appending after the last one, truncating whatever follows it
+func (j *leaseJournal) records() ([]journalEntry, error) {
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read lease journal: %w", err)
+	}
+	data, err := io.ReadAll(j.file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease journal: %w", err)
+	}
+	var entries []journalEntry
+	off := int64(0)
+	for off < int64(len(data)) {
+		record, n, err := decodeJournalRecord(data[off:])
+		if err != nil {
+			log.Printf("Warning: discarding %d byte(s) at the end of lease journal %s: %v", int64(len(data))-off, j.path, err)
+			if err := j.file.Truncate(off); err != nil {
+				return nil, fmt.Errorf("failed to truncate lease journal: %w", err)
+			}
+			break
+		}
+		entries = append(entries, journalEntry{offset: off, record: record})
+		off += n
+	}
+	if _, err := j.file.Seek(off, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read lease journal: %w", err)
+	}
+	j.size = off
+	return entries, nil
+}
+
+// journalEntry is a record read back with its offset in the journal
+type journalEntry struct {
+	offset int64
+	record journalRecord
+}
+
+// decodeJournalRecord decodes the record at the start of data and returns it with
+// its framed size
+func decodeJournalRecord(data []byte) (journalRecord, int64, error) {
+	var record journalRecord
+	if len(data) < journalHeaderSize {
+		return record, 0, errors.New("torn record header")
+	}
+	length := binary.BigEndian.Uint32(data[0:4])
+	if length > journalMaxRecord {
+		return record, 0, fmt.Errorf("record length %d is implausible", length)
+	}
+	end := journalHeaderSize + int64(length)
+	if int64(len(data)) < end {
+		return record, 0, errors.New("torn record")
+	}
+	payload := data[journalHeaderSize:end]
+	if crc32.Checksum(payload, journalTable) != binary.BigEndian.Uint32(data[4:8]) {
+		return record, 0, errors.New("checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, 0, fmt.Errorf("invalid record: %w", err)
+	}
+	return record, end, nil
+}
+
+// append writes record to the journal. Failures are logged; the in-memory state stays
+// authoritative.
+func (j *leaseJournal) append(record journalRecord) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error: failed to encode lease journal record: %v", err)
+		return
+	}
+	frame := make([]byte, journalHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, journalTable))
+	copy(frame[journalHeaderSize:], payload)
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if _, err = j.file.Write(frame); err == nil {
+		j.size += int64(len(frame))
+		err = j.sync(record.Time)
+	} else {
+		// Cut off a partial frame so later records stay readable
+		j.file.Truncate(j.size)
+		j.file.Seek(j.size, io.SeekStart)
+	}
+	if err != nil {
+		if !j.failed {
+			log.Printf("Error: failed to write lease journal: %v", err)
+			j.failed = true
+		}
+		return
+	}
+	if j.failed {
+		log.Printf("Lease journal writes succeed again")
+		j.failed = false
+	}
+}
+
+// sync flushes the journal to disk as the fsync policy asks. The caller must hold
+// j.mutex.
+func (j *leaseJournal) sync(now time.Time) error {
+	switch j.fsync {
+	case journalFsyncNever:
+		return nil
+	case journalFsyncInterval:
+		if now.Sub(j.lastSync) < journalFsyncPeriod {
+			return nil
+		}
+	}
+	j.lastSync = now
+	return j.file.Sync()
+}
+
+// checkpoint records that the lease store saved a snapshot including every record
+// before offset covers
+func (j *leaseJournal) checkpoint(covers int64, now time.Time) {
+	j.mutex.Lock()
+	unchanged := covers == j.covered
+	j.covered = covers
+	j.mutex.Unlock()
+	if unchanged {
+		return
+	}
+	j.append(journalRecord{Time: now, Event: journalCheckpoint, Covers: covers})
+}
+
+// offset returns the size of the journal, the position of the next record
+func (j *leaseJournal) offset() int64 {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.size
+}
+
+// close syncs and closes the journal and releases its lock
+func (j *leaseJournal) close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.file.Sync()
+	err := j.file.Close()
+	if j.lock != nil {
+		j.lock.Close()
+	}
+	return err
+}
+
+// replayJournal applies the records to data, the state loaded from the lease store: those
+// after the position its latest checkpoint covers, or all of them when the store had
+// no snapshot. It returns the number of records applied.
+func replayJournal(entries []journalEntry, data *leaseData, snapshot bool) int {
+	from := int64(0)
+	if snapshot {
+		for _, e := range entries {
+			if e.record.Event == journalCheckpoint {
+				from = e.record.Covers
+			}
+		}
+	}
+	if data.leases == nil {
+		data.leases = make(map[string]Lease)
+	}
+	if data.declined == nil {
+		data.declined = make(map[string]time.Time)
+	}
+	if data.history == nil {
+		data.history = make(map[string][]pastAddress)
+	}
+	applied := 0
+	for _, e := range entries {
+		r := e.record
+		if e.offset < from || r.Event == journalCheckpoint {
+			continue
+		}
+		applied++
+		switch r.Event {
+		case journalOffer, journalAck, journalRenew:
+			if r.Lease != nil {
+				data.leases[r.MAC] = *r.Lease
+			}
+		case journalRelease, journalExpire, journalDecline:
+			if lease, exists := data.leases[r.MAC]; exists && lease.IP.Equal(r.IP) {
+				delete(data.leases, r.MAC)
+			}
+			if r.Event == journalDecline {
+				if r.Quarantined {
+					data.declined[r.IP.String()] = r.Time
+				}
+			} else if !r.Offered {
+				data.history[r.MAC] = append([]pastAddress{{IP: r.IP, ReleasedAt: r.Time}}, data.history[r.MAC]...)
+			}
+		}
+	}
+	return applied
+}
+
+// journalLease appends a lease event to the journal, if one is configured. The caller
+// must hold s.mutex.
+func (s *DHCPServer) journalLease(event string, lease *Lease) {
+	if s.journal == nil {
+		return
+	}
+	record := journalRecord{Time: s.clock.Now(), Event: event, MAC: lease.MAC.String(), IP: lease.IP}
+	switch event {
+	case journalOffer, journalAck, journalRenew:
+		c := *lease
+		record.Lease = &c
+	case journalRelease, journalExpire:
+		record.Offered = lease.offered()
+	}
+	s.journal.append(record)
+}
+
+// journalDeclined appends the decline of ip by mac to the journal, if one is
+// configured. The caller must hold s.mutex.
+func (s *DHCPServer) journalDeclined(mac net.HardwareAddr, ip net.IP, quarantined bool) {
+	if s.journal == nil {
+		return
+	}
+	s.journal.append(journalRecord{Time: s.clock.Now(), Event: journalDecline, MAC: mac.String(), IP: ip, Quarantined: quarantined})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Unknown client policies
+const (
+	unknownClientAllocate = "allocate" // Serve from the pool like any client
+	unknownClientIgnore   = "ignore"   // Drop their packets
+	unknownClientReject   = "reject"   // Drop their packets and NAK their REQUESTs
+)
+
+// parseUnknownClientPolicy returns the unknown client policy of the subnet. An unset
+// unknown_client_policy follows deny_unknown_clients, which NAKs only when the
+// subnet is authoritative.
+func parseUnknownClientPolicy(policy string, denyUnknown, authoritative bool) (string, error) {
+	switch policy {
+	case "":
+		switch {
+		case !denyUnknown:
+			return unknownClientAllocate, nil
+		case authoritative:
+			return unknownClientReject, nil
+		}
+		return unknownClientIgnore, nil
+	case unknownClientAllocate:
+		if denyUnknown {
+			return "", fmt.Errorf("deny_unknown_clients conflicts with unknown_client_policy: allocate")
+		}
+	case unknownClientIgnore, unknownClientReject:
+	default:
+		return "", fmt.Errorf("invalid unknown_client_policy %q: must be allocate, ignore or reject", policy)
+	}
+	return policy, nil
+}
+
+// parseKnownClients normalizes the known_clients entries, each a MAC address or a
+// client identifier (option 61) in hex, to lower-case colon-separated form
+func parseKnownClients(entries []string) (map[string]struct{}, error) {
+	known := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		id, err := parseHex(entry)
+		if err != nil || len(id) == 0 {
+			return nil, fmt.Errorf("invalid known client %q: expected a MAC address or hex client identifier", entry)
+		}
+		known[net.HardwareAddr(id).String()] = struct{}{}
+	}
+	return known, nil
+}
+
+// isKnownClient reports whether the client has a reservation or is listed in
+// known_clients by MAC address or client identifier. With trust_hostnames a
+// reservation of the client's hostname counts too.
+func (s *DHCPServer) isKnownClient(p *dhcpv4.DHCPv4) bool {
+	if clientID := p.Options.Get(dhcpv4.OptionClientIdentifier); len(clientID) > 0 {
+		if _, exists := s.knownClients[net.HardwareAddr(clientID).String()]; exists {
+			return true
+		}
+		s.mutex.Lock()
+		_, reserved := s.reservations[clientIDKey(clientID)]
+		s.mutex.Unlock()
+		if reserved {
+			return true
+		}
+	}
+	if hostname := clientHostname(p); hostname != "" && s.subnetConfig.TrustHostnames {
+		s.mutex.Lock()
+		_, reserved := s.reservations[hostnameKey(hostname)]
+		s.mutex.Unlock()
+		if reserved {
+			return true
+		}
+	}
+	return s.isKnownMAC(p.ClientHWAddr)
+}
+
+// isKnownMAC reports whether mac has a reservation or is listed in known_clients
+func (s *DHCPServer) isKnownMAC(mac net.HardwareAddr) bool {
+	if _, exists := s.knownClients[mac.String()]; exists {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, reserved := s.reservations[mac.String()]
+	return reserved
+}
+
+// unknownLogInterval is the least time between two log lines about ignored unknown
+// clients, so a noisy segment does not flood the log
+const unknownLogInterval = 10 * time.Second
+
+// unknownDenials counts the packets refused by unknown_client_policy and rate-limits
+// logging them
+type unknownDenials struct {
+	mutex      sync.Mutex
+	count      uint64
+	unlogged   uint64 // Denials since the last log line
+	lastLogged time.Time
+}
+
+// record counts a denied packet and logs it unless another one was logged less than
+// unknownLogInterval ago; the next line reports how many went unlogged meanwhile
+func (d *unknownDenials) record(p *dhcpv4.DHCPv4, now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.count++
+	if now.Sub(d.lastLogged) < unknownLogInterval {
+		d.unlogged++
+		return
+	}
+	log.Printf("Denied %s from unknown client %s, %d denied so far (%d not logged since the last message)", p.MessageType(), p.ClientHWAddr, d.count, d.unlogged)
+	d.unlogged = 0
+	d.lastLogged = now
+}
+
+// isReservedClient reports whether the client has a reservation of its MAC, a prefix
+// or a pattern of it, or is listed in known_clients by MAC or client identifier
+func (s *DHCPServer) isReservedClient(p *dhcpv4.DHCPv4) bool {
+	if s.isKnownClient(p) || s.prefixReservationFor(p.ClientHWAddr.String()) != nil {
+		return true
+	}
+	for _, pr := range s.patternReservations {
+		if pr.matches(p.ClientHWAddr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Reservation is a fixed address of a client, as listed by Reservations
+type Reservation struct {
+	Key           string        // MAC address, "id:" and a client identifier, or "hostname:" and a hostname
+	IP            net.IP        // Reserved address
+	Network       *net.IPNet    // Network of the subnet holding the reservation
+	Hostname      string        // Hostname sent to the client, empty if none is configured
+	LeaseDuration time.Duration // Zero means the subnet default
+}
+
+// copyLease returns a copy of lease sharing no memory with it, with the hostname
+// the client is known by
+func (s *DHCPServer) copyLease(lease *Lease) Lease {
+	c := *lease
+	c.IP = slices.Clone(lease.IP)
+	c.MAC = slices.Clone(lease.MAC)
+	c.Hostname = s.leaseHostname(lease)
+	return c
+}
+
+// Leases returns copies of the leases of the server and the subnets sharing its
+// leases, offered ones included, ordered by address
+func (s *DHCPServer) Leases() []Lease {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	snapshot := s.leases.Snapshot()
+	leases := make([]Lease, 0, len(snapshot))
+	for _, lease := range snapshot {
+		leases = append(leases, s.copyLease(lease))
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return bytes.Compare(leases[i].IP.To16(), leases[j].IP.To16()) < 0
+	})
+	return leases
+}
+
+// Lease returns a copy of the lease of mac, reporting whether it has one
+func (s *DHCPServer) Lease(mac net.HardwareAddr) (Lease, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lease, exists := s.leases.Get(mac.String())
+	if !exists {
+		return Lease{}, false
+	}
+	return s.copyLease(lease), true
+}
+
+// ReleaseLease ends the lease of mac as if the client had released it and returns
+// the freed address, reporting whether mac had a lease. Like Release, it keeps a
+// reservation of mac, so a reserved address stays out of the pool.
+func (s *DHCPServer) ReleaseLease(mac net.HardwareAddr) (net.IP, bool) {
+	s.mutex.Lock()
+	var ip net.IP
+	if lease, exists := s.leases.Get(mac.String()); exists {
+		ip = slices.Clone(lease.IP)
+	}
+	s.mutex.Unlock()
+
+	// The lease may have changed meanwhile; release only ends it if it is still on ip
+	if ip == nil || !s.release(mac, ip) {
+		return nil, false
+	}
+	return ip, true
+}
+
+// Reservations returns the exact reservations of every subnet, configured and added
+// at runtime, ordered by address. Prefix and pattern reservations are not listed.
+func (s *DHCPServer) Reservations() []Reservation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	reservations := []Reservation{}
+	for _, subnet := range s.subnets {
+		for key, res := range subnet.reservations {
+			reservations = append(reservations, Reservation{
+				Key:           key,
+				IP:            slices.Clone(res.ip),
+				Network:       &net.IPNet{IP: slices.Clone(subnet.network.IP), Mask: slices.Clone(subnet.network.Mask)},
+				Hostname:      res.hostname,
+				LeaseDuration: res.leaseDuration,
+			})
+		}
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return bytes.Compare(reservations[i].IP.To16(), reservations[j].IP.To16()) < 0
+	})
+	return reservations
+}
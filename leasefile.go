@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// leaseFileState is the content of lease_file
+type leaseFileState struct {
+	Version  int                      `json:"version,omitempty"`  // Format version, absent in version 1
+	Leases   map[string]Lease         `json:"leases"`             // MAC string to Lease
+	Declined map[string]time.Time     `json:"declined,omitempty"` // IP string to time of decline
+	History  map[string][]pastAddress `json:"history,omitempty"`  // MAC string to addresses held before
+}
+
+// fileBackend keeps leases in a JSON file that is rewritten on every change
+type fileBackend struct {
+	path string
+}
+
+// load implements leaseBackend. A missing file is not an error.
+func (b *fileBackend) load() (leaseData, error) {
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return leaseData{}, nil
+	}
+	if err != nil {
+		return leaseData{}, fmt.Errorf("failed to read lease file: %w", err)
+	}
+	var state leaseFileState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return leaseData{}, fmt.Errorf("failed to parse lease file: %w", err)
+	}
+	if state.Version == 0 {
+		state.Version = 1
+	}
+	// Leases of version 1 get their state from the offered flag as they are decoded
+	if err := checkStoreVersion("lease file "+b.path, state.Version); err != nil {
+		return leaseData{}, err
+	}
+	return leaseData{leases: state.Leases, declined: state.Declined, history: state.History}, nil
+}
+
+// sync implements leaseBackend, atomically replacing the file
+func (b *fileBackend) sync(state leaseData) error {
+	data, err := json.MarshalIndent(leaseFileState{Version: leaseStoreVersion, Leases: state.leases, Declined: state.declined, History: state.history}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	return nil
+}
+
+// compact implements leaseBackend. Every sync rewrites the whole file already.
+func (b *fileBackend) compact(state leaseData) error {
+	return b.sync(state)
+}
+
+// close implements leaseBackend
+func (b *fileBackend) close() error {
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// LeaseState is where a lease stands in its life cycle
+type LeaseState string
+
+// Lease states. Released, expired and declined leases are removed from the store
+// right after the transition, so they are only seen in events and logs.
+const (
+	StateOffered  LeaseState = "offered"  // Held by an OFFER and not yet confirmed by a REQUEST
+	StateBound    LeaseState = "bound"    // Confirmed by an ACK
+	StateReleased LeaseState = "released" // Given up by the client
+	StateExpired  LeaseState = "expired"  // Ran out, or the offer lapsed
+	StateDeclined LeaseState = "declined" // Refused by the client as already in use
+)
+
+// leaseTransitions lists the legal transitions from each state; "" is a lease that
+// is being created
+var leaseTransitions = map[LeaseState][]LeaseState{
+	"":            {StateOffered, StateBound},
+	StateOffered:  {StateOffered, StateBound, StateReleased, StateExpired, StateDeclined},
+	StateBound:    {StateOffered, StateBound, StateReleased, StateExpired, StateDeclined},
+	StateReleased: {},
+	StateExpired:  {},
+	StateDeclined: {},
+}
+
+// transition moves the lease to state to, reporting whether that is legal. A change of
+// state is logged with both states; an illegal transition is logged as an error and
+// leaves the lease unchanged.
+func (l *Lease) transition(to LeaseState) bool {
+	for _, legal := range leaseTransitions[l.State] {
+		if legal == to {
+			if l.State != to {
+				log.Printf("Lease of %s on %s is now %s (was %s)", l.MAC, l.IP, to, l.State.label())
+			}
+			l.State = to
+			return true
+		}
+	}
+	log.Printf("Error: illegal lease state transition of %s on %s from %s to %s", l.MAC, l.IP, l.State.label(), to)
+	return false
+}
+
+// label returns the state for log lines, "new" for a lease being created
+func (s LeaseState) label() string {
+	if s == "" {
+		return "new"
+	}
+	return string(s)
+}
+
+// offered reports whether the lease is only held by an OFFER
+func (l *Lease) offered() bool {
+	return l.State == StateOffered
+}
+
+// UnmarshalJSON implements json.Unmarshaler, deriving the state of leases saved
+// before it was recorded from their offered flag
+func (l *Lease) UnmarshalJSON(data []byte) error {
+	type plain Lease
+	saved := struct {
+		*plain
+		Offered bool `json:"offered"`
+	}{plain: (*plain)(l)}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	if l.State == "" {
+		l.State = StateBound
+		if saved.Offered {
+			l.State = StateOffered
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// captureLog sends log output to a buffer until the test ends
+func captureLog(t testing.TB) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+// TestLeaseTransitions tries every transition from every state, a new lease included
+func TestLeaseTransitions(t *testing.T) {
+	states := []LeaseState{"", StateOffered, StateBound, StateReleased, StateExpired, StateDeclined}
+	live := []LeaseState{StateOffered, StateBound, StateReleased, StateExpired, StateDeclined}
+	legal := map[LeaseState][]LeaseState{
+		"":            {StateOffered, StateBound},
+		StateOffered:  live,
+		StateBound:    live,
+		StateReleased: nil,
+		StateExpired:  nil,
+		StateDeclined: nil,
+	}
+	for _, from := range states {
+		for _, to := range states[1:] {
+			want := false
+			for _, ok := range legal[from] {
+				want = want || ok == to
+			}
+			logs := captureLog(t)
+			lease := &Lease{MAC: testMAC(1), IP: net.IPv4(10, 0, 0, 50), State: from}
+			if got := lease.transition(to); got != want {
+				t.Errorf("%s to %s: legal %v, want %v", from.label(), to, got, want)
+			}
+
+			switch {
+			case !want:
+				if lease.State != from {
+					t.Errorf("illegal %s to %s changed the state to %s", from.label(), to, lease.State)
+				}
+				if wantLog := "illegal lease state transition of 02:00:00:00:00:01 on 10.0.0.50 from " + from.label() + " to " + string(to); !bytes.Contains(logs.Bytes(), []byte(wantLog)) {
+					t.Errorf("illegal %s to %s logged %q", from.label(), to, logs)
+				}
+			case lease.State != to:
+				t.Errorf("%s to %s left the state at %s", from.label(), to, lease.State)
+			case from == to:
+				if logs.Len() != 0 {
+					t.Errorf("staying %s logged %q", to, logs)
+				}
+			default:
+				if wantLog := "Lease of 02:00:00:00:00:01 on 10.0.0.50 is now " + string(to) + " (was " + from.label() + ")"; !bytes.Contains(logs.Bytes(), []byte(wantLog)) {
+					t.Errorf("%s to %s logged %q", from.label(), to, logs)
+				}
+			}
+		}
+	}
+}
+
+// transitionLog matches the log line of a state change
+var transitionLog = regexp.MustCompile(`is now (\w+) \(was (\w+)\)`)
+
+// TestLeaseStateEvents drives a lease in each state through each DHCP event and checks
+// the state changes logged and the state of the stored lease
+func TestLeaseStateEvents(t *testing.T) {
+	mac, ip := testMAC(1), net.IPv4(10, 0, 0, 50).To4()
+	setups := map[string]func(t *testing.T, s *DHCPServer){
+		"none":    func(t *testing.T, s *DHCPServer) {},
+		"offered": func(t *testing.T, s *DHCPServer) { serve(t, s, newDiscover(t, mac, withRequestedIP(ip))) },
+		"bound":   func(t *testing.T, s *DHCPServer) { bind(t, s, mac, ip) },
+	}
+	events := map[string]func(t *testing.T, s *DHCPServer, clock fakeClock){
+		"discover": func(t *testing.T, s *DHCPServer, _ fakeClock) { serve(t, s, newDiscover(t, mac, withRequestedIP(ip))) },
+		"request":  func(t *testing.T, s *DHCPServer, _ fakeClock) { serve(t, s, newRequest(t, mac, ip, testServerIP)) },
+		"release":  func(t *testing.T, s *DHCPServer, _ fakeClock) { serve(t, s, newRelease(t, mac, ip)) },
+		"decline":  func(t *testing.T, s *DHCPServer, _ fakeClock) { serve(t, s, newDecline(t, mac, ip)) },
+		"expiry": func(t *testing.T, s *DHCPServer, clock fakeClock) {
+			clock.Advance(time.Hour + time.Second)
+			s.reapExpired(clock.Now())
+		},
+	}
+	for _, tc := range []struct {
+		from, event string
+		changes     []string    // Logged as "to (was from)"
+		stored      *LeaseState // State of the stored lease afterwards, nil if there is none
+	}{
+		{"none", "discover", []string{"offered (was new)"}, statePtr(StateOffered)},
+		{"none", "request", []string{"bound (was new)"}, statePtr(StateBound)},
+		{"none", "release", nil, nil},
+		{"none", "decline", nil, nil},
+		{"none", "expiry", nil, nil},
+		{"offered", "discover", nil, statePtr(StateOffered)},
+		{"offered", "request", []string{"bound (was offered)"}, statePtr(StateBound)},
+		{"offered", "release", []string{"released (was offered)"}, nil},
+		{"offered", "decline", []string{"declined (was offered)"}, nil},
+		{"offered", "expiry", []string{"expired (was offered)"}, nil},
+		{"bound", "discover", nil, statePtr(StateBound)},
+		{"bound", "request", nil, statePtr(StateBound)},
+		{"bound", "release", []string{"released (was bound)"}, nil},
+		{"bound", "decline", []string{"declined (was bound)"}, nil},
+		{"bound", "expiry", []string{"expired (was bound)"}, nil},
+	} {
+		t.Run(tc.from+" "+tc.event, func(t *testing.T) {
+			cfg := testSubnetConfig()
+			cfg.DeclineCooldown = 300
+			s, clock := newClockedServer(t, cfg)
+			setups[tc.from](t, s)
+
+			logs := captureLog(t)
+			events[tc.event](t, s, clock)
+			var changes []string
+			for _, m := range transitionLog.FindAllStringSubmatch(logs.String(), -1) {
+				changes = append(changes, m[1]+" (was "+m[2]+")")
+			}
+			if !slices.Equal(changes, tc.changes) {
+				t.Errorf("logged changes %q, want %q", changes, tc.changes)
+			}
+			if bytes.Contains(logs.Bytes(), []byte("illegal lease state transition")) {
+				t.Errorf("illegal transition: %s", logs)
+			}
+			lease, stored := s.Lease(mac)
+			switch {
+			case tc.stored == nil && stored:
+				t.Errorf("lease is still stored as %s", lease.State)
+			case tc.stored != nil && !stored:
+				t.Errorf("no lease stored, want one %s", *tc.stored)
+			case tc.stored != nil && lease.State != *tc.stored:
+				t.Errorf("stored lease is %s, want %s", lease.State, *tc.stored)
+			}
+		})
+	}
+}
+
+// withRequestedIP asks for ip in option 50
+func withRequestedIP(ip net.IP) dhcpv4.Modifier {
+	return dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip))
+}
+
+func statePtr(state LeaseState) *LeaseState { return &state }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"maps"
+	"net"
+	"strings"
+	"time"
+)
+
+// LeaseStore holds the leases of a DHCPServer, keyed by MAC string and indexed by
+// address and hostname. DHCPServer serializes access with its mutex, so implementations need not
+// be safe for concurrent use.
+type LeaseStore interface {
+	// Get returns the lease of mac
+	Get(mac string) (*Lease, bool)
+	// ByIP returns the leases on ip, normally at most one
+	ByIP(ip net.IP) []*Lease
+	// ByHostname returns the leases whose client sent hostname, ignoring case
+	ByHostname(hostname string) []*Lease
+	// Put adds or replaces the lease of lease.MAC. It must be called again after the
+	// IP or Hostname of a stored lease changes, to update the indexes.
+	Put(lease *Lease)
+	// Delete removes the lease of mac, if any
+	Delete(mac string)
+	// Snapshot returns the current leases. The map is a copy, the leases are not.
+	Snapshot() map[string]*Lease
+	// ExpireBefore removes and returns the leases that expired before t
+	ExpireBefore(t time.Time) []*Lease
+}
+
+// memoryLeaseStore is the default LeaseStore, a map by MAC with reverse indexes by IP
+// and by hostname
+type memoryLeaseStore struct {
+	leases     map[string]*Lease
+	byIP       leaseIndex
+	byHostname leaseIndex // Keyed by the lower-case hostname
+}
+
+// leaseIndex maps a key to the leases under it, by MAC string
+type leaseIndex struct {
+	leases  map[string]map[string]*Lease
+	indexed map[string]string // MAC string to the key it is indexed under
+}
+
+// newLeaseIndex returns an empty leaseIndex
+func newLeaseIndex() leaseIndex {
+	return leaseIndex{leases: make(map[string]map[string]*Lease), indexed: make(map[string]string)}
+}
+
+// add indexes lease of mac under key
+func (x leaseIndex) add(key, mac string, lease *Lease) {
+	if x.leases[key] == nil {
+		x.leases[key] = make(map[string]*Lease)
+	}
+	x.leases[key][mac] = lease
+	x.indexed[mac] = key
+}
+
+// remove drops mac from the index
+func (x leaseIndex) remove(mac string) {
+	key, exists := x.indexed[mac]
+	if !exists {
+		return
+	}
+	delete(x.leases[key], mac)
+	if len(x.leases[key]) == 0 {
+		delete(x.leases, key)
+	}
+	delete(x.indexed, mac)
+}
+
+// get returns the leases under key
+func (x leaseIndex) get(key string) []*Lease {
+	leases := []*Lease{}
+	for _, lease := range x.leases[key] {
+		leases = append(leases, lease)
+	}
+	return leases
+}
+
+// newMemoryLeaseStore returns an empty memoryLeaseStore
+func newMemoryLeaseStore() *memoryLeaseStore {
+	return &memoryLeaseStore{
+		leases:     make(map[string]*Lease),
+		byIP:       newLeaseIndex(),
+		byHostname: newLeaseIndex(),
+	}
+}
+
+// unindex removes mac from the indexes
+func (m *memoryLeaseStore) unindex(mac string) {
+	m.byIP.remove(mac)
+	m.byHostname.remove(mac)
+}
+
+// Get implements LeaseStore
+func (m *memoryLeaseStore) Get(mac string) (*Lease, bool) {
+	lease, exists := m.leases[mac]
+	return lease, exists
+}
+
+// ByIP implements LeaseStore
+func (m *memoryLeaseStore) ByIP(ip net.IP) []*Lease {
+	return m.byIP.get(ip.String())
+}
+
+// ByHostname implements LeaseStore
+func (m *memoryLeaseStore) ByHostname(hostname string) []*Lease {
+	return m.byHostname.get(strings.ToLower(hostname))
+}
+
+// Put implements LeaseStore
+func (m *memoryLeaseStore) Put(lease *Lease) {
+	mac := lease.MAC.String()
+	m.unindex(mac)
+	m.leases[mac] = lease
+	if lease.IP != nil {
+		m.byIP.add(lease.IP.String(), mac, lease)
+	}
+	if lease.Hostname != "" {
+		m.byHostname.add(strings.ToLower(lease.Hostname), mac, lease)
+	}
+}
+
+// Delete implements LeaseStore
+func (m *memoryLeaseStore) Delete(mac string) {
+	m.unindex(mac)
+	delete(m.leases, mac)
+}
+
+// Snapshot implements LeaseStore
+func (m *memoryLeaseStore) Snapshot() map[string]*Lease {
+	return maps.Clone(m.leases)
+}
+
+// ExpireBefore implements LeaseStore
+func (m *memoryLeaseStore) ExpireBefore(t time.Time) []*Lease {
+	expired := []*Lease{}
+	for mac, lease := range m.leases {
+		if lease.ExpiresAt.Before(t) {
+			expired = append(expired, lease)
+			m.Delete(mac)
+		}
+	}
+	return expired
+}
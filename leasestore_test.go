@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// benchLeases is the number of active leases the allocation benchmarks start with
+const benchLeases = 50000
+
+// indexMAC returns a distinct locally administered MAC address for i
+func indexMAC(i int) net.HardwareAddr {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(mac[2:], uint32(i))
+	return mac
+}
+
+// newLoadedServer returns a server on a /8 holding benchLeases bound leases, each with
+// its own hostname
+func newLoadedServer(b *testing.B) *DHCPServer {
+	b.Helper()
+	cfg := testSubnetConfig()
+	cfg.Network = "10.0.0.0/8"
+	cfg.Range = StringList{"10.0.0.10-10.255.255.250"}
+	s := newTestServer(b, cfg)
+	for i := range benchLeases {
+		if _, err := s.getIPForClient(indexMAC(i), nil, "", nil, nil, false, false); err != nil {
+			b.Fatal(err)
+		}
+		lease, _ := s.leases.Get(indexMAC(i).String())
+		lease.Hostname = fmt.Sprintf("host-%d", i)
+		s.leases.Put(lease)
+	}
+	if n := len(s.leases.Snapshot()); n != benchLeases {
+		b.Fatalf("%d leases, want %d", n, benchLeases)
+	}
+	return s
+}
+
+func TestMemoryLeaseStoreIndexes(t *testing.T) {
+	m := newMemoryLeaseStore()
+	ip := net.IPv4(10, 0, 0, 50).To4()
+	lease := &Lease{MAC: testMAC(1), IP: ip, Hostname: "Printer"}
+	m.Put(lease)
+	m.Put(&Lease{MAC: testMAC(2), IP: net.IPv4(10, 0, 0, 51).To4(), Hostname: "printer"})
+
+	if got := m.ByIP(ip); len(got) != 1 || got[0] != lease {
+		t.Fatalf("ByIP(%s) = %v", ip, got)
+	}
+	if got := m.ByHostname("PRINTER"); len(got) != 2 {
+		t.Fatalf("ByHostname ignoring case found %d leases, want 2", len(got))
+	}
+
+	// Put again after changing the address and hostname moves the lease in both indexes
+	lease.IP = net.IPv4(10, 0, 0, 60).To4()
+	lease.Hostname = "scanner"
+	m.Put(lease)
+	if got := m.ByIP(ip); len(got) != 0 {
+		t.Errorf("old address still indexed: %v", got)
+	}
+	if got := m.ByIP(lease.IP); len(got) != 1 {
+		t.Errorf("new address not indexed: %v", got)
+	}
+	if got := m.ByHostname("printer"); len(got) != 1 || got[0].MAC.String() != testMAC(2).String() {
+		t.Errorf("old hostname still indexed: %v", got)
+	}
+	if got := m.ByHostname("scanner"); len(got) != 1 {
+		t.Errorf("new hostname not indexed: %v", got)
+	}
+
+	m.Delete(testMAC(1).String())
+	if len(m.ByIP(lease.IP)) != 0 || len(m.ByHostname("scanner")) != 0 {
+		t.Error("deleted lease is still indexed")
+	}
+	if len(m.byIP.indexed) != 1 || len(m.byHostname.indexed) != 1 {
+		t.Errorf("indexes hold %d and %d leases, want 1", len(m.byIP.indexed), len(m.byHostname.indexed))
+	}
+}
+
+// BenchmarkGetIPForClient measures allocation latency with 50k active leases, for
+// renewals of existing clients and for new clients
+func BenchmarkGetIPForClient(b *testing.B) {
+	b.Run("renew", func(b *testing.B) {
+		s := newLoadedServer(b)
+		b.ResetTimer()
+		for i := range b.N {
+			if _, err := s.getIPForClient(indexMAC(i%benchLeases), nil, "", nil, nil, false, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("new", func(b *testing.B) {
+		s := newLoadedServer(b)
+		b.ResetTimer()
+		for i := range b.N {
+			if _, err := s.getIPForClient(indexMAC(benchLeases+i), nil, "", nil, nil, false, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("requested", func(b *testing.B) {
+		s := newLoadedServer(b)
+		held := make([]net.IP, benchLeases)
+		for i := range held {
+			lease, _ := s.leases.Get(indexMAC(i).String())
+			held[i] = lease.IP
+		}
+		b.ResetTimer()
+		for i := range b.N {
+			// Ask for an address held by another client, which the reverse index refuses
+			if _, err := s.getIPForClient(indexMAC(benchLeases+i), nil, "", held[i%benchLeases], nil, false, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkRecordClientInfo measures storing the client details of a REQUEST with 50k
+// active leases, with a hostname no other client uses
+func BenchmarkRecordClientInfo(b *testing.B) {
+	s := newLoadedServer(b)
+	b.ResetTimer()
+	for i := range b.N {
+		n := i % benchLeases
+		s.recordClientInfo(indexMAC(n), "1,3,6", fmt.Sprintf("host-%d", n), "")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+)
+
+// Defaults of the rebind policy after a listener fails
+const (
+	defaultRebindRetries    = 10
+	defaultRebindMaxBackoff = time.Minute
+	rebindInitialBackoff    = time.Second
+)
+
+// Listener serves DHCP on a single network interface
+type Listener struct {
+	iface   string
+	handler server4.Handler
+	server  *server4.Server
+}
+
+// listenAddr is the address every listener binds
+var listenAddr = &net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 67}
+
+// NewListener binds the DHCP port on iface and dispatches incoming packets to handler
+func NewListener(iface string, handler server4.Handler) (*Listener, error) {
+	s, err := server4.NewServer(iface, listenAddr, handler)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{iface: iface, handler: handler, server: s}, nil
+}
+
+// Run serves until ctx is canceled or the underlying server fails. Cancellation
+// closes the socket and returns nil once the serve loop has exited.
+func (l *Listener) Run(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- l.server.Serve()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		l.server.Close()
+		<-errCh
+		return nil
+	}
+}
+
+// Supervise is Run that survives the interface going away. When serving fails, it
+// waits for the interface to be up again and rebinds, doubling the wait after every
+// failed attempt up to maxBackoff. It gives up with an error after retries attempts
+// in a row; a negative retries returns the first failure.
+func (l *Listener) Supervise(ctx context.Context, retries int, maxBackoff time.Duration) error {
+	for {
+		err := l.Run(ctx)
+		if err == nil || ctx.Err() != nil {
+			return nil
+		}
+		if retries < 0 {
+			return err
+		}
+		log.Printf("Error: serving %s failed: %v; rebinding", l.iface, err)
+		if err := l.rebind(ctx, retries, maxBackoff); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// rebind binds a new server on the interface, waiting for it to come back up. It
+// returns nil without a server when ctx is canceled meanwhile.
+func (l *Listener) rebind(ctx context.Context, retries int, maxBackoff time.Duration) error {
+	backoff := rebindInitialBackoff
+	for attempt := 1; attempt <= retries; attempt++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+
+		log.Printf("Rebinding %s, attempt %d of %d", l.iface, attempt, retries)
+		if iface, err := net.InterfaceByName(l.iface); err != nil {
+			log.Printf("Interface %s is not available: %v", l.iface, err)
+			continue
+		} else if iface.Flags&net.FlagUp == 0 {
+			log.Printf("Interface %s is down", l.iface)
+			continue
+		}
+		s, err := server4.NewServer(l.iface, listenAddr, l.handler)
+		if err != nil {
+			log.Printf("Failed to rebind %s: %v", l.iface, err)
+			continue
+		}
+		l.server = s
+		log.Printf("Rebound %s", l.iface)
+		return nil
+	}
+	return fmt.Errorf("serving %s: gave up after %d rebind attempts", l.iface, retries)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/syslog"
+	"strings"
+)
+
+// syslogTag identifies the server's messages in syslog
+const syslogTag = "dhcp_server"
+
+// syslogOutput sends each log line to syslog with a priority derived from its text
+type syslogOutput struct {
+	w *syslog.Writer
+}
+
+// Write implements io.Writer for the log package, which writes one line per call
+func (o *syslogOutput) Write(b []byte) (int, error) {
+	line := strings.TrimSuffix(string(b), "\n")
+	var err error
+	switch syslogPriority(line) {
+	case syslog.LOG_ERR:
+		err = o.w.Err(line)
+	case syslog.LOG_WARNING:
+		err = o.w.Warning(line)
+	default:
+		err = o.w.Info(line)
+	}
+	return len(b), err
+}
+
+// syslogPriority classifies a log line: errors and failures are LOG_ERR, warnings
+// LOG_WARNING and everything else LOG_INFO
+func syslogPriority(line string) syslog.Priority {
+	switch {
+	case strings.HasPrefix(line, "Error"), strings.HasPrefix(line, "Failed"),
+		strings.Contains(line, " failed:"), strings.Contains(line, " failed,"):
+		return syslog.LOG_ERR
+	case strings.HasPrefix(line, "Warning"):
+		return syslog.LOG_WARNING
+	default:
+		return syslog.LOG_INFO
+	}
+}
+
+// parseSyslogAddr splits syslog_addr into a network and address for syslog.Dial. An
+// address without a tcp:// or udp:// scheme uses UDP; an empty one the local daemon.
+func parseSyslogAddr(addr string) (string, string, error) {
+	if addr == "" {
+		return "", "", nil
+	}
+	network, host, found := strings.Cut(addr, "://")
+	if !found {
+		return "udp", addr, nil
+	}
+	if network != "tcp" && network != "udp" {
+		return "", "", fmt.Errorf("invalid syslog_addr %q: scheme must be tcp or udp", addr)
+	}
+	return network, host, nil
+}
+
+// setupLogging directs the log package to dest: stderr (the default) or syslog, local
+// or at addr. When syslog can not be reached, logging stays on stderr.
+func setupLogging(dest, addr string) error {
+	switch dest {
+	case "", "stderr":
+		if addr != "" {
+			return fmt.Errorf("syslog_addr requires log_dest: syslog")
+		}
+		return nil
+	case "syslog":
+	default:
+		return fmt.Errorf("invalid log_dest %q: must be stderr or syslog", dest)
+	}
+	network, raddr, err := parseSyslogAddr(addr)
+	if err != nil {
+		return err
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+	if err != nil {
+		log.Printf("Warning: cannot connect to syslog, logging to stderr: %v", err)
+		return nil
+	}
+	// Syslog stamps every message itself
+	log.SetFlags(0)
+	log.SetOutput(&syslogOutput{w: w})
+	return nil
+}
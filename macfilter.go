@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// macFilter decides which clients are served by MAC address
+type macFilter struct {
+	allow  []string // Normalized MACs and OUI prefixes; when set, nothing else is served
+	deny   []string
+	denied atomic.Uint64
+}
+
+// parseMACFilter normalizes the allow_macs and deny_macs entries, returning nil when
+// both are empty
+func parseMACFilter(allow, deny []string) (*macFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f := &macFilter{}
+	var err error
+	if f.allow, err = parseMACRules("allow_macs", allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseMACRules("deny_macs", deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseMACRules normalizes entries, each a full MAC address or a prefix of one such as
+// an OUI, to lower-case colon-separated form. Colons, dashes, dots and spaces are
+// accepted as separators.
+func parseMACRules(field string, entries []string) ([]string, error) {
+	rules := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		b, err := parseMACBytes(entry)
+		if err != nil || len(b) == 0 || len(b) > 6 {
+			return nil, fmt.Errorf("invalid %s entry %q: expected a MAC address or a prefix of one", field, entry)
+		}
+		rules = append(rules, net.HardwareAddr(b).String())
+	}
+	return rules, nil
+}
+
+// parseMACBytes decodes a MAC address or a prefix of one written with colons, dashes,
+// dots, spaces or no separators
+func parseMACBytes(s string) ([]byte, error) {
+	return hex.DecodeString(strings.NewReplacer(":", "", "-", "", ".", "", " ", "").Replace(s))
+}
+
+// parseMACPrefix normalizes s if it is a MAC prefix of 3 to 5 octets, such as an OUI
+func parseMACPrefix(s string) (string, bool) {
+	b, err := parseMACBytes(s)
+	if err != nil || len(b) < 3 || len(b) > 5 {
+		return "", false
+	}
+	return net.HardwareAddr(b).String(), true
+}
+
+// matchMACRule returns the first rule mac matches, or "" if none does
+func matchMACRule(rules []string, mac string) string {
+	for _, rule := range rules {
+		// Both are normalized whole bytes, so a plain prefix check is exact
+		if strings.HasPrefix(mac, rule) {
+			return rule
+		}
+	}
+	return ""
+}
+
+// check reports whether mac is denied and by which rule. Deny rules win over allow
+// rules; with allow rules present, a MAC matching none of them is denied.
+func (f *macFilter) check(mac net.HardwareAddr) (bool, string) {
+	if f == nil {
+		return false, ""
+	}
+	macStr := mac.String()
+	if rule := matchMACRule(f.deny, macStr); rule != "" {
+		return true, "deny_macs " + rule
+	}
+	if len(f.allow) > 0 && matchMACRule(f.allow, macStr) == "" {
+		return true, "not in allow_macs"
+	}
+	return false, ""
+}
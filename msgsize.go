@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// minMaxMessageSize is the smallest maximum message size a client may announce in
+// option 57 (RFC 2132, section 9.10)
+const minMaxMessageSize = 576
+
+// ipUDPHeaderSize is the part of the maximum message size taken by the IP and UDP
+// headers around the DHCP message
+const ipUDPHeaderSize = 28
+
+// essentialReplyOptions are never dropped to fit a reply: without them the client
+// cannot use the lease or recognize the reply, or a relay cannot route it
+var essentialReplyOptions = map[dhcpv4.OptionCode]bool{
+	dhcpv4.OptionDHCPMessageType:       true,
+	dhcpv4.OptionServerIdentifier:      true,
+	dhcpv4.OptionIPAddressLeaseTime:    true,
+	dhcpv4.OptionSubnetMask:            true,
+	dhcpv4.OptionRouter:                true,
+	dhcpv4.OptionRenewTimeValue:        true,
+	dhcpv4.OptionRebindingTimeValue:    true,
+	dhcpv4.OptionRelayAgentInformation: true,
+	dhcpv4.OptionClientIdentifier:      true,
+}
+
+// replyLimit returns the largest DHCP message p's sender accepts according to its
+// option 57, or 0 if it sent none
+func replyLimit(p *dhcpv4.DHCPv4) int {
+	size, err := p.MaxMessageSize()
+	if err != nil {
+		return 0
+	}
+	return max(int(size), minMaxMessageSize) - ipUDPHeaderSize
+}
+
+// fitReply drops optional options from reply, largest first, until it fits the
+// maximum message size the client announced. Options the client asked for in its
+// parameter request list are dropped after those it did not ask for. A reply that
+// still does not fit is sent anyway with a warning.
+func fitReply(p, reply *dhcpv4.DHCPv4) {
+	limit := replyLimit(p)
+	if limit == 0 || len(reply.ToBytes()) <= limit {
+		return
+	}
+	requested := make(map[uint8]bool)
+	for _, code := range p.ParameterRequestList() {
+		requested[code.Code()] = true
+	}
+	var optional []uint8
+	for code := range reply.Options {
+		if !essentialReplyOptions[dhcpv4.GenericOptionCode(code)] {
+			optional = append(optional, code)
+		}
+	}
+	sort.Slice(optional, func(i, j int) bool {
+		a, b := optional[i], optional[j]
+		if requested[a] != requested[b] {
+			return !requested[a]
+		}
+		return len(reply.Options[a]) > len(reply.Options[b])
+	})
+
+	var dropped []uint8
+	for _, code := range optional {
+		if len(reply.ToBytes()) <= limit {
+			break
+		}
+		delete(reply.Options, code)
+		dropped = append(dropped, code)
+	}
+	size := len(reply.ToBytes())
+	if len(dropped) > 0 {
+		log.Printf("Warning: dropped options %v from the %s to %s to fit its maximum message size of %d bytes", dropped, reply.MessageType(), reply.ClientHWAddr, limit+ipUDPHeaderSize)
+	}
+	if size > limit {
+		log.Printf("Warning: %s to %s is %d bytes, more than its maximum message size of %d allows", reply.MessageType(), reply.ClientHWAddr, size, limit+ipUDPHeaderSize)
+	}
+}
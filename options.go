@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"gopkg.in/yaml.v3"
+)
+
+// VendorOptionConfig maps a vendor class (option 60) substring to an option 43 payload.
+// The payload is given either as raw hex or as a list of encapsulated sub-options.
+type VendorOptionConfig struct {
+	VendorClass string            `yaml:"vendor_class"`
+	Hex         string            `yaml:"hex,omitempty"`
+	SubOptions  []SubOptionConfig `yaml:"suboptions,omitempty"`
+}
+
+// SubOptionConfig defines a single code/value pair inside an encapsulated option
+type SubOptionConfig struct {
+	Code  int    `yaml:"code"`
+	Type  string `yaml:"type,omitempty"` // See encodeTypedValue, defaults to string
+	Value string `yaml:"value"`
+}
+
+// vendorOption is a compiled VendorOptionConfig ready to be sent on the wire
+type vendorOption struct {
+	match   string
+	payload []byte
+}
+
+// parseVendorOptions validates and encodes the configured option 43 payloads
+func parseVendorOptions(configs []VendorOptionConfig) ([]vendorOption, error) {
+	vendorOptions := []vendorOption{}
+	for _, cfg := range configs {
+		// An empty substring would match every client, even those sending no option 60
+		if cfg.VendorClass == "" {
+			return nil, fmt.Errorf("vendor option: vendor_class must not be empty")
+		}
+		if cfg.Hex != "" && len(cfg.SubOptions) > 0 {
+			return nil, fmt.Errorf("vendor option for %q: hex and suboptions are mutually exclusive", cfg.VendorClass)
+		}
+
+		var payload []byte
+		var err error
+		if cfg.Hex != "" {
+			payload, err = parseHex(cfg.Hex)
+		} else {
+			payload, err = encodeSubOptions(cfg.SubOptions)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("vendor option for %q: %w", cfg.VendorClass, err)
+		}
+		if len(payload) == 0 {
+			return nil, fmt.Errorf("vendor option for %q: empty payload", cfg.VendorClass)
+		}
+		if len(payload) > 255 {
+			return nil, fmt.Errorf("vendor option for %q: payload is %d bytes, maximum is 255", cfg.VendorClass, len(payload))
+		}
+
+		vendorOptions = append(vendorOptions, vendorOption{match: cfg.VendorClass, payload: payload})
+	}
+	return vendorOptions, nil
+}
+
+// matchVendorOption returns the payload whose vendor class is the longest substring of
+// vendorClass, or nil if nothing matches. Ties go to the entry listed first.
+func matchVendorOption(vendorOptions []vendorOption, vendorClass string) []byte {
+	var best *vendorOption
+	for i := range vendorOptions {
+		opt := &vendorOptions[i]
+		if !strings.Contains(vendorClass, opt.match) {
+			continue
+		}
+		if best == nil || len(opt.match) > len(best.match) {
+			best = opt
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.payload
+}
+
+// encodeSubOptions encodes sub-options as consecutive code/length/value triples
+func encodeSubOptions(subOptions []SubOptionConfig) ([]byte, error) {
+	encoded := []byte{}
+	for _, sub := range subOptions {
+		if sub.Code < 1 || sub.Code > 254 {
+			return nil, fmt.Errorf("invalid sub-option code %d", sub.Code)
+		}
+		value, err := encodeTypedValue(sub.Type, []string{sub.Value})
+		if err != nil {
+			return nil, fmt.Errorf("sub-option %d: %w", sub.Code, err)
+		}
+		if len(value) > 255 {
+			return nil, fmt.Errorf("sub-option %d: value is %d bytes, maximum is 255", sub.Code, len(value))
+		}
+		encoded = append(encoded, byte(sub.Code), byte(len(value)))
+		encoded = append(encoded, value...)
+	}
+	return encoded, nil
+}
+
+// encodeTypedValue converts typed option values into their wire representation.
+// Supported types are string (the default), ip, ip-list, uint8, uint16, uint32, hex and bool.
+func encodeTypedValue(valueType string, values []string) ([]byte, error) {
+	if valueType == "ip-list" {
+		encoded := []byte{}
+		for _, value := range values {
+			for _, field := range strings.Split(value, ",") {
+				ip := net.ParseIP(strings.TrimSpace(field)).To4()
+				if ip == nil {
+					return nil, fmt.Errorf("invalid IPv4 address: %s", field)
+				}
+				encoded = append(encoded, ip...)
+			}
+		}
+		if len(encoded) == 0 {
+			return nil, fmt.Errorf("ip-list requires at least one address")
+		}
+		return encoded, nil
+	}
+
+	if len(values) != 1 {
+		return nil, fmt.Errorf("type %q takes exactly one value, got %d", valueType, len(values))
+	}
+	value := values[0]
+	switch valueType {
+	case "", "string":
+		return []byte(value), nil
+	case "ip":
+		ip := net.ParseIP(value).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address: %s", value)
+		}
+		return ip, nil
+	case "uint8", "uint16", "uint32":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(valueType, "uint"))
+		n, err := strconv.ParseUint(value, 0, bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q", valueType, value)
+		}
+		encoded := make([]byte, bits/8)
+		for i := range encoded {
+			encoded[len(encoded)-1-i] = byte(n >> (8 * i))
+		}
+		return encoded, nil
+	case "hex":
+		return parseHex(value)
+	case "bool":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bool value %q", value)
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	default:
+		return nil, fmt.Errorf("unknown value type: %s", valueType)
+	}
+}
+
+// parseHex decodes a hex string, ignoring ':' and whitespace separators
+func parseHex(s string) ([]byte, error) {
+	cleaned := strings.NewReplacer(":", "", " ", "", "\t", "").Replace(s)
+	cleaned = strings.TrimPrefix(strings.TrimPrefix(cleaned, "0x"), "0X")
+	b, err := hex.DecodeString(cleaned)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex string %q: %w", s, err)
+	}
+	return b, nil
+}
+
+// VIVSOConfig defines one enterprise block of the Vendor-Identifying Vendor-Specific
+// Information option (125, RFC 3925)
+type VIVSOConfig struct {
+	Enterprise uint32         `yaml:"enterprise"`
+	SubOptions map[int]string `yaml:"suboptions"`
+}
+
+// VIVSOList accepts either a single enterprise block or a list of them in YAML
+type VIVSOList []VIVSOConfig
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (l *VIVSOList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		var single VIVSOConfig
+		if err := value.Decode(&single); err != nil {
+			return err
+		}
+		*l = VIVSOList{single}
+		return nil
+	}
+	var list []VIVSOConfig
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// encodeVIVSO encodes the enterprise blocks as the data of a single option 125
+func encodeVIVSO(blocks VIVSOList) ([]byte, error) {
+	encoded := []byte{}
+	seen := make(map[uint32]struct{})
+	for _, block := range blocks {
+		if _, exists := seen[block.Enterprise]; exists {
+			return nil, fmt.Errorf("vivso: duplicate enterprise number %d", block.Enterprise)
+		}
+		seen[block.Enterprise] = struct{}{}
+
+		codes := make([]int, 0, len(block.SubOptions))
+		for code := range block.SubOptions {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		subOptions := make([]SubOptionConfig, 0, len(codes))
+		for _, code := range codes {
+			subOptions = append(subOptions, SubOptionConfig{Code: code, Value: block.SubOptions[code]})
+		}
+		data, err := encodeSubOptions(subOptions)
+		if err != nil {
+			return nil, fmt.Errorf("vivso enterprise %d: %w", block.Enterprise, err)
+		}
+		if len(data) > 255 {
+			return nil, fmt.Errorf("vivso enterprise %d: data is %d bytes, maximum is 255", block.Enterprise, len(data))
+		}
+
+		encoded = binary.BigEndian.AppendUint32(encoded, block.Enterprise)
+		encoded = append(encoded, byte(len(data)))
+		encoded = append(encoded, data...)
+	}
+	if len(encoded) > 255 {
+		return nil, fmt.Errorf("vivso: option is %d bytes, maximum is 255", len(encoded))
+	}
+	return encoded, nil
+}
+
+// StringList accepts either a single scalar or a list of scalars in YAML
+type StringList []string
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (l *StringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = StringList{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// CustomOptionConfig defines an arbitrary option appended to every reply
+type CustomOptionConfig struct {
+	Code  int        `yaml:"code"`
+	Type  string     `yaml:"type"`
+	Value StringList `yaml:"value"`
+}
+
+// managedOptions are set by the server itself and cannot be overridden by custom options
+var managedOptions = map[int]string{
+	1:  "subnet mask",
+	3:  "router",
+	6:  "domain name server",
+	51: "lease time",
+	52: "option overload",
+	53: "message type",
+	54: "server identifier",
+}
+
+// parseCustomOptions validates and encodes the configured custom options
+func parseCustomOptions(configs []CustomOptionConfig) ([]dhcpv4.Option, error) {
+	options := []dhcpv4.Option{}
+	seen := make(map[int]struct{})
+	for _, cfg := range configs {
+		if cfg.Code < 1 || cfg.Code > 254 {
+			return nil, fmt.Errorf("custom option: invalid code %d", cfg.Code)
+		}
+		if name, managed := managedOptions[cfg.Code]; managed {
+			return nil, fmt.Errorf("custom option %d: %s is managed by the server and cannot be set", cfg.Code, name)
+		}
+		if _, exists := seen[cfg.Code]; exists {
+			return nil, fmt.Errorf("custom option %d: defined more than once", cfg.Code)
+		}
+		seen[cfg.Code] = struct{}{}
+
+		value, err := encodeTypedValue(cfg.Type, cfg.Value)
+		if err != nil {
+			return nil, fmt.Errorf("custom option %d: %w", cfg.Code, err)
+		}
+		if len(value) > 255 {
+			return nil, fmt.Errorf("custom option %d: value is %d bytes, maximum is 255", cfg.Code, len(value))
+		}
+		options = append(options, dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(cfg.Code), value))
+	}
+	return options, nil
+}
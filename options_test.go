@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMatchVendorOption(t *testing.T) {
+	// Each payload is sub-option 1 carrying the entry's label
+	entries := []struct{ label, vendorClass string }{
+		{"msft", "MSFT"},
+		{"msft5", "MSFT 5.0"},
+		{"pxe", "PXEClient"},
+		{"pxe-efi", "PXEClient:Arch:00007"},
+		{"efi", "Arch:00007"},
+		{"cisco", "Cisco"},
+		{"ap-12", "AP-12"},
+		{"ubnt", "ubnt"},
+	}
+	configs := make([]VendorOptionConfig, 0, len(entries))
+	for _, e := range entries {
+		configs = append(configs, VendorOptionConfig{
+			VendorClass: e.vendorClass,
+			SubOptions:  []SubOptionConfig{{Code: 1, Value: e.label}},
+		})
+	}
+	vendorOptions, err := parseVendorOptions(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		vendorClass string
+		want        string
+	}{
+		{"MSFT 5.0", "msft5"},
+		{"MSFT 98", "msft"},
+		{"PXEClient:Arch:00007:UNDI:003016", "pxe-efi"},
+		{"PXEClient:Arch:00000:UNDI:002001", "pxe"},
+		{"iPXE Arch:00007", "efi"},
+		{"udhcp 1.36.1 ubnt", "ubnt"},
+		// "Cisco" and "AP-12" are equally long; the one listed first wins
+		{"Cisco AP-12", "cisco"},
+		{"AP-12 Cisco", "cisco"},
+		{"android-dhcp-14", ""},
+		{"", ""},
+		// Matching is case sensitive
+		{"msft 5.0", ""},
+	} {
+		payload := matchVendorOption(vendorOptions, tc.vendorClass)
+		if tc.want == "" {
+			if payload != nil {
+				t.Errorf("vendor class %q got % x, want no option 43", tc.vendorClass, payload)
+			}
+			continue
+		}
+		if len(payload) < 2 || payload[0] != 1 || int(payload[1]) != len(payload)-2 {
+			t.Errorf("vendor class %q: malformed payload % x", tc.vendorClass, payload)
+			continue
+		}
+		if got := string(payload[2:]); got != tc.want {
+			t.Errorf("vendor class %q matched %s, want %s", tc.vendorClass, got, tc.want)
+		}
+	}
+}
+
+func TestParseVendorOptionsErrors(t *testing.T) {
+	sub := []SubOptionConfig{{Code: 1, Value: "x"}}
+	for _, tc := range []struct {
+		name string
+		cfg  VendorOptionConfig
+		want string
+	}{
+		{"empty vendor class", VendorOptionConfig{SubOptions: sub}, "vendor_class must not be empty"},
+		{"hex and suboptions", VendorOptionConfig{VendorClass: "MSFT", Hex: "0101", SubOptions: sub}, "mutually exclusive"},
+		{"empty payload", VendorOptionConfig{VendorClass: "MSFT"}, "empty payload"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseVendorOptions([]VendorOptionConfig{tc.cfg})
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want one containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// TestEncodeVIVSO compares option 125 data against hand-encoded RFC 3925 bytes: per
+// enterprise, a 4-byte enterprise number, a data length octet, then the sub-options
+// as code/length/value triples
+func TestEncodeVIVSO(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		want   []byte
+	}{
+		{
+			name: "single block",
+			config: `
+enterprise: 3561
+suboptions:
+  1: "http://acs.example.com"
+`,
+			want: append([]byte{
+				0x00, 0x00, 0x0d, 0xe9, // Enterprise 3561 (Broadband Forum)
+				0x18,       // 24 bytes of sub-options
+				0x01, 0x16, // Sub-option 1, 22 bytes
+			}, "http://acs.example.com"...),
+		},
+		{
+			// The TR-111 device identity of a gateway; sub-options are sorted by code
+			name: "tr-111 identity",
+			config: `
+enterprise: 3561
+suboptions:
+  3: IGD
+  1: 00D09E
+  2: GW-0001
+`,
+			want: []byte{
+				0x00, 0x00, 0x0d, 0xe9,
+				0x16,
+				0x01, 0x06, '0', '0', 'D', '0', '9', 'E',
+				0x02, 0x07, 'G', 'W', '-', '0', '0', '0', '1',
+				0x03, 0x03, 'I', 'G', 'D',
+			},
+		},
+		{
+			name: "two enterprises",
+			config: `
+- enterprise: 3561
+  suboptions:
+    4: "acs"
+- enterprise: 4491
+  suboptions:
+    2: "10.0.0.5"
+    1: "x"
+`,
+			want: []byte{
+				0x00, 0x00, 0x0d, 0xe9,
+				0x05,
+				0x04, 0x03, 'a', 'c', 's',
+				0x00, 0x00, 0x11, 0x8b, // Enterprise 4491 (CableLabs)
+				0x0d,
+				0x01, 0x01, 'x',
+				0x02, 0x08, '1', '0', '.', '0', '.', '0', '.', '5',
+			},
+		},
+		{
+			name: "empty block",
+			config: `
+enterprise: 9
+`,
+			want: []byte{0x00, 0x00, 0x00, 0x09, 0x00},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var blocks VIVSOList
+			if err := yaml.Unmarshal([]byte(tc.config), &blocks); err != nil {
+				t.Fatal(err)
+			}
+			got, err := encodeVIVSO(blocks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("encoded\n% x\nwant\n% x", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEncodeVIVSOErrors(t *testing.T) {
+	long := strings.Repeat("a", 200)
+	for _, tc := range []struct {
+		name   string
+		blocks VIVSOList
+		want   string
+	}{
+		{"duplicate enterprise", VIVSOList{{Enterprise: 3561}, {Enterprise: 3561}}, "duplicate enterprise number 3561"},
+		{"code 0", VIVSOList{{Enterprise: 3561, SubOptions: map[int]string{0: "x"}}}, "invalid sub-option code 0"},
+		{"code 255", VIVSOList{{Enterprise: 3561, SubOptions: map[int]string{255: "x"}}}, "invalid sub-option code 255"},
+		{"sub-option too long", VIVSOList{{Enterprise: 3561, SubOptions: map[int]string{1: long + long}}}, "sub-option 1: value is 400 bytes"},
+		{"block too long", VIVSOList{{Enterprise: 3561, SubOptions: map[int]string{1: long, 2: long}}}, "vivso enterprise 3561: data is 404 bytes"},
+		{"option too long", VIVSOList{{Enterprise: 1, SubOptions: map[int]string{1: long}}, {Enterprise: 2, SubOptions: map[int]string{1: long}}}, "option is 414 bytes"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := encodeVIVSO(tc.blocks)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want one containing %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// checkPacket reports why p cannot be served, nil if it looks like a client request
+func checkPacket(p *dhcpv4.DHCPv4) error {
+	if p == nil {
+		return errors.New("empty packet")
+	}
+	if p.OpCode != dhcpv4.OpcodeBootRequest {
+		return fmt.Errorf("opcode %s is not a request", p.OpCode)
+	}
+	if len(p.ClientHWAddr) == 0 {
+		return errors.New("no client hardware address")
+	}
+	switch t := p.MessageType(); t {
+	case dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeDecline,
+		dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeInform:
+		return nil
+	case dhcpv4.MessageTypeNone:
+		return errors.New("no message type")
+	default:
+		return fmt.Errorf("message type %s is not sent by clients", t)
+	}
+}
+
+// acceptPacket reports whether p should be served, logging malformed packets.
+// Replies from other servers on the segment are dropped silently.
+func acceptPacket(peer net.Addr, p *dhcpv4.DHCPv4) bool {
+	if p != nil && p.OpCode == dhcpv4.OpcodeBootReply {
+		return false
+	}
+	if err := checkPacket(p); err != nil {
+		log.Printf("Ignoring malformed packet from %s: %v", peer, err)
+		return false
+	}
+	return true
+}
+
+// recoverPacket stops a panic while handling a packet from taking the server down.
+// It must be deferred directly by the handler.
+func recoverPacket(peer net.Addr) {
+	if r := recover(); r != nil {
+		log.Printf("Recovered from panic handling packet from %s: %v\n%s", peer, r, debug.Stack())
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// FuzzServeDHCP decodes arbitrary bytes as the serve loop does and hands the result
+// to the listener's handler. The handler must neither panic, caught or not, nor send
+// anything but well-formed replies to the sender.
+func FuzzServeDHCP(f *testing.F) {
+	mac := testMAC(1)
+	discover := newDiscover(f, mac)
+	request := newRequest(f, mac, testServerIP, testServerIP)
+	f.Add(discover.ToBytes())
+	f.Add(request.ToBytes())
+	f.Add([]byte{})
+	f.Add(bytes.Repeat([]byte{0xff}, 300))
+	f.Add(discover.ToBytes()[:240])
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := newTestServer(t, testSubnetConfig())
+		handler := subnetHandler("test0", []*DHCPServer{s}, s)
+
+		p, err := dhcpv4.FromBytes(data)
+		if err != nil {
+			p = nil
+		}
+		logs.Reset()
+		conn := &fakeConn{}
+		handler(conn, clientPeer, p)
+		if strings.Contains(logs.String(), "Recovered from panic") {
+			t.Fatalf("handler panicked:\n%s", logs.String())
+		}
+		for _, reply := range conn.replies(t) {
+			if reply.OpCode != dhcpv4.OpcodeBootReply {
+				t.Fatalf("reply has opcode %s", reply.OpCode)
+			}
+			if reply.TransactionID != p.TransactionID {
+				t.Fatalf("reply for transaction %s to a packet of %s", reply.TransactionID, p.TransactionID)
+			}
+		}
+	})
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// patternReservation is a reservation keyed by a MAC pattern such as
+// "00:1b:21:3c:*:*" whose address is built from the client's MAC when it is
+// allocated, e.g. "10.2.<byte5>.<byte6>"
+type patternReservation struct {
+	key       string
+	mac       [6]int // Octet values, -1 for a wildcard
+	wildcards int
+	addr      [4]int // Octet values, or -1-n to copy octet n (0-based) of the MAC
+	host      *reservation
+}
+
+// isMACPattern reports whether a reserved_addresses key is a MAC pattern
+func isMACPattern(key string) bool {
+	return strings.Contains(key, "*")
+}
+
+// parseMACPattern parses six octets separated by colons or dashes, each two hex
+// digits or "*"
+func parseMACPattern(key string) ([6]int, int, error) {
+	var mac [6]int
+	parts := strings.FieldsFunc(key, func(r rune) bool { return r == ':' || r == '-' })
+	if len(parts) != 6 {
+		return mac, 0, fmt.Errorf("invalid MAC pattern %q: expected six octets", key)
+	}
+	wildcards := 0
+	for i, part := range parts {
+		if part == "*" {
+			mac[i] = -1
+			wildcards++
+			continue
+		}
+		v, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) != 2 {
+			return mac, 0, fmt.Errorf("invalid MAC pattern %q: octet %q is neither two hex digits nor *", key, part)
+		}
+		mac[i] = int(v)
+	}
+	return mac, wildcards, nil
+}
+
+// parseAddressTemplate parses a dotted IPv4 template whose octets are numbers or
+// <byteN> references to octet N (1 to 6) of the MAC, which must be wildcards of mac.
+// Every wildcard must be referenced, so no two matching MACs share an address.
+func parseAddressTemplate(template string, mac [6]int) ([4]int, error) {
+	var addr [4]int
+	parts := strings.Split(template, ".")
+	if len(parts) != 4 {
+		return addr, fmt.Errorf("invalid address template %q: expected four octets", template)
+	}
+	referenced := [6]bool{}
+	for i, part := range parts {
+		if ref, ok := strings.CutPrefix(part, "<byte"); ok {
+			ref, ok = strings.CutSuffix(ref, ">")
+			n, err := strconv.Atoi(ref)
+			if !ok || err != nil || n < 1 || n > 6 {
+				return addr, fmt.Errorf("invalid address template %q: %s is not <byte1> to <byte6>", template, part)
+			}
+			if mac[n-1] != -1 {
+				return addr, fmt.Errorf("invalid address template %q: %s refers to an octet that is not a wildcard", template, part)
+			}
+			referenced[n-1] = true
+			addr[i] = -n
+			continue
+		}
+		v, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return addr, fmt.Errorf("invalid address template %q: octet %q is neither a number nor <byteN>", template, part)
+		}
+		addr[i] = int(v)
+	}
+	for i, octet := range mac {
+		if octet == -1 && !referenced[i] {
+			return addr, fmt.Errorf("invalid address template %q: wildcard octet %d is not used, so clients would share addresses", template, i+1)
+		}
+	}
+	return addr, nil
+}
+
+// parsePatternReservations validates the reservations keyed by a MAC pattern. Every
+// address a pattern can produce must lie inside network and outside pools, and no
+// two patterns may produce the same address. When a MAC matches several patterns
+// the one with the fewest wildcards applies, so patterns matching the same MACs
+// must differ in that number. The result is ordered most specific first.
+func parsePatternReservations(configs map[string]ReservationConfig, network *net.IPNet, pools []*addressPool) ([]*patternReservation, error) {
+	patterns := []*patternReservation{}
+	for key, cfg := range configs {
+		if !isMACPattern(key) {
+			continue
+		}
+		mac, wildcards, err := parseMACPattern(key)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := parseAddressTemplate(cfg.IP, mac)
+		if err != nil {
+			return nil, fmt.Errorf("reservation for %s: %w", key, err)
+		}
+		if cfg.Hostname != "" {
+			return nil, fmt.Errorf("reservation for %s: hostname can not be shared by several clients", key)
+		}
+		if cfg.LeaseDuration < 0 {
+			return nil, fmt.Errorf("reservation for %s: lease_duration must not be negative", key)
+		}
+		options, err := parseCustomOptions(cfg.Options)
+		if err != nil {
+			return nil, fmt.Errorf("reservation for %s: %w", key, err)
+		}
+		gateway, err := parseReservationGateway(cfg.Gateway, network)
+		if err != nil {
+			return nil, fmt.Errorf("reservation for %s: %w", key, err)
+		}
+		pr := &patternReservation{
+			key:       key,
+			mac:       mac,
+			wildcards: wildcards,
+			addr:      addr,
+			host: &reservation{
+				gateway:       gateway,
+				dnsServers:    parseIPs(cfg.DNSServers),
+				leaseDuration: time.Duration(cfg.LeaseDuration) * time.Second,
+				bootFile:      cfg.BootFile,
+				options:       options,
+				domain:        cfg.Domain,
+			},
+		}
+
+		// The network is one aligned block, so the lowest and highest address decide
+		lowest, highest := pr.bounds()
+		if !network.Contains(lowest) || !network.Contains(highest) {
+			return nil, fmt.Errorf("reservation for %s: addresses %s lie outside network %s", key, cfg.IP, network)
+		}
+		for _, pool := range pools {
+			if ip := pr.addressIn(pool); ip != nil {
+				return nil, fmt.Errorf("reservation for %s: address %s lies in the pool %s-%s", key, ip, pool.start, pool.end)
+			}
+		}
+		for _, other := range patterns {
+			if pr.sharesAddresses(other) {
+				return nil, fmt.Errorf("reservation for %s: addresses %s overlap those of %s", key, cfg.IP, other.key)
+			}
+			if pr.sharesMACs(other) && pr.wildcards == other.wildcards {
+				return nil, fmt.Errorf("reservation for %s: matches the same clients as %s with as many wildcards", key, other.key)
+			}
+		}
+		patterns = append(patterns, pr)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if patterns[i].wildcards != patterns[j].wildcards {
+			return patterns[i].wildcards < patterns[j].wildcards
+		}
+		return patterns[i].key < patterns[j].key
+	})
+	return patterns, nil
+}
+
+// matches reports whether mac fits the pattern
+func (pr *patternReservation) matches(mac net.HardwareAddr) bool {
+	if len(mac) != 6 {
+		return false
+	}
+	for i, octet := range pr.mac {
+		if octet != -1 && byte(octet) != mac[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// address builds the address of mac, which must match the pattern
+func (pr *patternReservation) address(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, 4)
+	for i, octet := range pr.addr {
+		if octet < 0 {
+			ip[i] = mac[-octet-1]
+		} else {
+			ip[i] = byte(octet)
+		}
+	}
+	return ip
+}
+
+// bounds returns the lowest and highest address the pattern can produce
+func (pr *patternReservation) bounds() (net.IP, net.IP) {
+	lowest, highest := make(net.IP, 4), make(net.IP, 4)
+	for i, octet := range pr.addr {
+		if octet < 0 {
+			lowest[i], highest[i] = 0, 255
+		} else {
+			lowest[i], highest[i] = byte(octet), byte(octet)
+		}
+	}
+	return lowest, highest
+}
+
+// produces reports whether the pattern can produce ip
+func (pr *patternReservation) produces(ip net.IP) bool {
+	ip = ip.To4()
+	for i, octet := range pr.addr {
+		if octet >= 0 && byte(octet) != ip[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// addressIn returns an address of pool the pattern can produce, or nil if there is
+// none, walking whichever of the two sets is smaller
+func (pr *patternReservation) addressIn(pool *addressPool) net.IP {
+	lowest, highest := pr.bounds()
+	if ipToUint32(highest) < pool.base || uint64(ipToUint32(lowest)) >= uint64(pool.base)+pool.size {
+		return nil
+	}
+	variable := 0
+	for _, octet := range pr.addr {
+		if octet < 0 {
+			variable++
+		}
+	}
+	if pool.size <= uint64(1)<<(8*variable) {
+		for off := uint64(0); off < pool.size; off++ {
+			if ip := pool.ipAt(uint32(off)); !pool.excluded.has(uint32(off)) && pr.produces(ip) {
+				return ip
+			}
+		}
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for n := uint64(0); n < uint64(1)<<(8*variable); n++ {
+		v := n
+		for i := 3; i >= 0; i-- {
+			if pr.addr[i] < 0 {
+				ip[i] = byte(v)
+				v >>= 8
+			} else {
+				ip[i] = byte(pr.addr[i])
+			}
+		}
+		if off, ok := pool.offset(ip); ok && !pool.excluded.has(off) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// sharesAddresses reports whether both patterns can produce the same address
+func (pr *patternReservation) sharesAddresses(other *patternReservation) bool {
+	for i := range pr.addr {
+		if pr.addr[i] >= 0 && other.addr[i] >= 0 && pr.addr[i] != other.addr[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sharesMACs reports whether a MAC can match both patterns
+func (pr *patternReservation) sharesMACs(other *patternReservation) bool {
+	for i := range pr.mac {
+		if pr.mac[i] != -1 && other.mac[i] != -1 && pr.mac[i] != other.mac[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// patternAddressFor returns the most specific pattern reservation matching mac and
+// the address it gives mac, or nil if none applies. An address that is the network
+// or broadcast address, or statically reserved for another client, is refused and
+// logged, and the client is allocated like any other. The caller must hold s.mutex.
+func (s *DHCPServer) patternAddressFor(mac net.HardwareAddr) (*patternReservation, net.IP) {
+	for _, pr := range s.patternReservations {
+		if !pr.matches(mac) {
+			continue
+		}
+		ip := pr.address(mac)
+		if isNetworkOrBroadcast(ip, s.network) {
+			log.Printf("Warning: reservation %s gives %s the unusable address %s; allocating dynamically", pr.key, mac, ip)
+			return nil, nil
+		}
+		if s.isReservedIP(ip) {
+			log.Printf("Warning: reservation %s gives %s the address %s, which is reserved for another client; allocating dynamically", pr.key, mac, ip)
+			return nil, nil
+		}
+		return pr, ip
+	}
+	return nil, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"time"
+)
+
+// leaseData is the state a leaseBackend records
+type leaseData struct {
+	leases   map[string]Lease         // MAC string to Lease
+	declined map[string]time.Time     // Declined IP string to time of decline
+	history  map[string][]pastAddress // MAC string to addresses held before, most recent first
+}
+
+// leaseBackend durably records leases, declined addresses and address history. The
+// in-memory state of DHCPServer stays authoritative; a backend only mirrors it.
+type leaseBackend interface {
+	// load returns the saved state. Its maps may be nil when nothing was saved.
+	load() (leaseData, error)
+	// sync records the current state
+	sync(data leaseData) error
+	// compact atomically replaces everything recorded with data
+	compact(data leaseData) error
+	close() error
+}
+
+// leaseStoreVersion is the version of the format every backend writes. Version 1
+// stored whether a lease was offered instead of its state.
+const leaseStoreVersion = 2
+
+// checkStoreVersion fails for a store written by a newer server than this one
+func checkStoreVersion(store string, version int) error {
+	if version > leaseStoreVersion {
+		return fmt.Errorf("%s has format version %d, but this server only understands up to version %d; upgrade the server or move the file aside", store, version, leaseStoreVersion)
+	}
+	if version < leaseStoreVersion {
+		log.Printf("Upgrading %s from format version %d to %d", store, version, leaseStoreVersion)
+	}
+	return nil
+}
+
+// errLocked is returned by lockFile when another process holds the lock
+var errLocked = errors.New("locked by another process")
+
+// lockedBackend holds an exclusive lock beside the files of a backend, so a second
+// instance started on the same files fails instead of overwriting them
+type lockedBackend struct {
+	leaseBackend
+	lock *os.File
+}
+
+// lockBackend locks path+".lock" for the backend opened by open
+func lockBackend(path string, open func() (leaseBackend, error)) (leaseBackend, error) {
+	lock, err := lockFile(path + ".lock")
+	if errors.Is(err, errLocked) {
+		return nil, fmt.Errorf("%s is in use by another instance of the server (%s is locked)", path, path+".lock")
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := open()
+	if err != nil {
+		if lock != nil {
+			lock.Close()
+		}
+		return nil, err
+	}
+	return &lockedBackend{leaseBackend: b, lock: lock}, nil
+}
+
+// close implements leaseBackend, releasing the lock after closing the backend
+func (b *lockedBackend) close() error {
+	err := b.leaseBackend.close()
+	if b.lock != nil {
+		b.lock.Close()
+	}
+	return err
+}
+
+// openLeaseBackend returns the lease backend selected by the configuration, or nil
+// to keep leases in memory only. The files of the backend are locked against other
+// instances.
+func openLeaseBackend(config *Config) (leaseBackend, error) {
+	switch config.LeaseStore {
+	case "", "file":
+		if config.LeaseFile == "" {
+			return nil, nil
+		}
+		return lockBackend(config.LeaseFile, func() (leaseBackend, error) {
+			return &fileBackend{path: config.LeaseFile}, nil
+		})
+	case "sqlite":
+		if config.LeaseDBPath == "" {
+			return nil, fmt.Errorf("lease_db_path is required for lease_store sqlite")
+		}
+		return lockBackend(config.LeaseDBPath, func() (leaseBackend, error) {
+			return openSQLiteBackend(config.LeaseDBPath)
+		})
+	case "bolt":
+		// Bolt locks its database file itself
+		if config.LeaseDBPath == "" {
+			return nil, fmt.Errorf("lease_db_path is required for lease_store bolt")
+		}
+		return openBoltBackend(config.LeaseDBPath)
+	default:
+		return nil, fmt.Errorf("unknown lease_store %q", config.LeaseStore)
+	}
+}
+
+// loadLeases restores the leases, declined addresses and address history of every
+// subnet saved in the backend, brought up to date from the journal. It must run after
+// joinSubnets. Expired leases are moved to the history, and declined addresses whose
+// quarantine has ended are dropped.
+func (s *DHCPServer) loadLeases() error {
+	var data leaseData
+	if s.backend != nil {
+		var err error
+		if data, err = s.backend.load(); err != nil {
+			return err
+		}
+	}
+	if s.journal != nil {
+		snapshot := data.leases != nil || data.declined != nil || data.history != nil
+		if applied := replayJournal(s.journal.pending, &data, snapshot); applied > 0 {
+			log.Printf("Replayed %d lease journal record(s)", applied)
+		}
+		s.journal.pending = nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	for ipStr, declinedAt := range data.declined {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			continue
+		}
+		owner := s.ownerOf(ip)
+		if owner.quarantineEnded(ip.String(), declinedAt, now) {
+			continue
+		}
+		if pool := owner.poolFor(ip); pool != nil {
+			pool.takeIP(ip)
+		}
+		s.declined[ip.String()] = declinedAt
+	}
+
+	for macStr, past := range data.history {
+		if len(past) > s.historySize {
+			past = past[:s.historySize]
+		}
+		s.history[macStr] = past
+	}
+	s.pruneHistory(now)
+
+	restored := 0
+	for macStr, lease := range data.leases {
+		mac, err := net.ParseMAC(macStr)
+		if err != nil || lease.IP == nil {
+			continue
+		}
+		if now.After(lease.ExpiresAt) {
+			if !lease.offered() {
+				s.rememberAddress(mac.String(), lease.IP, lease.ExpiresAt)
+			}
+			continue
+		}
+		owner := s.ownerOf(lease.IP)
+		lease.MAC = mac
+		if res, exists := owner.reservations[lease.reservationKey()]; exists {
+			if !res.ip.Equal(lease.IP) {
+				continue
+			}
+		} else if owner.isExcluded(lease.IP) {
+			// Kept until it expires so the address is not reused behind the client's back
+			log.Printf("Warning: restored lease of %s on %s lies in an exclusion and will not be renewed", macStr, lease.IP)
+		} else if pool := owner.poolFor(lease.IP); pool == nil || !pool.takeIP(lease.IP) {
+			continue // Outside the pools or already restored for another client
+		}
+		s.leases.Put(&lease)
+		restored++
+	}
+	log.Printf("Restored %d lease(s) and %d declined address(es)", restored, len(s.declined))
+	return nil
+}
+
+// saveLeases records the current leases and declined addresses in the backend, if
+// one is configured. Failures are logged, the in-memory state stays authoritative.
+func (s *DHCPServer) saveLeases() {
+	if s.backend == nil {
+		return
+	}
+	s.backendMutex.Lock()
+	defer s.backendMutex.Unlock()
+
+	data, covers := s.snapshotLeases()
+	err := s.backend.sync(data)
+	s.storeWritten(err, covers)
+	if err != nil {
+		log.Printf("Failed to save leases: %v", err)
+	}
+}
+
+// snapshotLeases copies the state to record in the backend and returns it with the
+// journal position it includes
+func (s *DHCPServer) snapshotLeases() (leaseData, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var covers int64 // Journal records are appended under s.mutex, so the snapshot includes all before this
+	if s.journal != nil {
+		covers = s.journal.offset()
+	}
+	snapshot := s.leases.Snapshot()
+	leases := make(map[string]Lease, len(snapshot))
+	for mac, lease := range snapshot {
+		leases[mac] = *lease
+	}
+	declined := maps.Clone(s.declined)
+	history := make(map[string][]pastAddress, len(s.history))
+	for mac, past := range s.history {
+		history[mac] = slices.Clone(past)
+	}
+	return leaseData{leases: leases, declined: declined, history: history}, covers
+}
+
+// storeWritten records the outcome of a write of the snapshot including the journal
+// up to covers
+func (s *DHCPServer) storeWritten(err error, covers int64) {
+	s.health.recordStoreResult(err)
+	if err == nil && s.journal != nil {
+		s.journal.checkpoint(covers, s.clock.Now())
+	}
+}
+
+// errNoLeaseStore is returned by CompactLeases when leases are kept in memory only
+var errNoLeaseStore = errors.New("no lease store is configured")
+
+// CompactLeases reclaims expired leases and rewrites the lease store from scratch in
+// one atomic step, dropping whatever entries it accumulated beyond the current state.
+// It returns the number of leases kept.
+func (s *DHCPServer) CompactLeases() (int, error) {
+	if s.backend == nil {
+		return 0, errNoLeaseStore
+	}
+	s.reapExpired(s.clock.Now())
+
+	s.backendMutex.Lock()
+	defer s.backendMutex.Unlock()
+	data, covers := s.snapshotLeases()
+	err := s.backend.compact(data)
+	s.storeWritten(err, covers)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compact lease store: %w", err)
+	}
+	return len(data.leases), nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// allocationPolicy selects which free address a pool hands out next
+type allocationPolicy int
+
+const (
+	policySequential allocationPolicy = iota // In order, reusing released addresses last
+	policyRandom                             // Uniformly from the free addresses
+	policyHash                               // Derived from the client, probing forward on collision
+)
+
+// parseAllocationPolicy parses the allocation_policy setting; empty means sequential
+func parseAllocationPolicy(s string) (allocationPolicy, error) {
+	switch s {
+	case "", "sequential":
+		return policySequential, nil
+	case "random":
+		return policyRandom, nil
+	case "hash":
+		return policyHash, nil
+	default:
+		return 0, fmt.Errorf("invalid allocation_policy %q: must be sequential, random or hash", s)
+	}
+}
+
+// addressPool is a range of dynamically assignable IPv4 addresses. Addresses are
+// tracked as offsets from the start of the range in bitmaps, so a pool costs one bit
+// per address and free addresses are found a word at a time.
+type addressPool struct {
+	start     net.IP
+	end       net.IP
+	base      uint32 // start as an integer
+	size      uint64 // Number of addresses in the range
+	policy    allocationPolicy
+	taken     bitset      // Offsets that are allocated or excluded
+	excluded  bitset      // Offsets of reserved addresses and of ranges carved out for other pools
+	gaps      [][2]uint64 // Integer addresses from and up to but not including to between disjoint ranges
+	available int         // Free addresses left
+	capacity  int         // Addresses in the range that are not excluded
+	cursor    uint64      // Offsets below it were handed out in order by the sequential policy
+	released  []uint32    // Offsets below the cursor freed again, in release order. Entries taken out of order are skipped lazily.
+
+	reuseDelay    time.Duration        // How long a reclaimed address cools down before new clients get it
+	reusePressure int                  // Percentage of the pool in use at which cooling addresses are handed out early
+	cooling       map[uint32]time.Time // Reclaim times of the addresses still cooling down. They count as taken.
+	coolQueue     []cooledAddress      // Cooling addresses, oldest first. Stale entries are skipped lazily.
+
+	emergencyPercent   int           // Free share below which short leases are granted, 0 to never
+	emergencyLeaseTime time.Duration // Lease time granted in emergency mode
+	emergency          bool          // Short leases are being granted
+
+	refused     int       // Requests refused since the pool ran out, 0 while it has free addresses
+	exhaustedAt time.Time // When the pool first refused a request
+}
+
+// bitset is a set of pool offsets, one bit each
+type bitset []uint64
+
+// newBitset returns an empty set for offsets below n
+func newBitset(n uint64) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) has(i uint32) bool { return b[i/64]&(1<<(i%64)) != 0 }
+func (b bitset) set(i uint32)      { b[i/64] |= 1 << (i % 64) }
+func (b bitset) clear(i uint32)    { b[i/64] &^= 1 << (i % 64) }
+
+// nextClear returns the first offset at or after i and below n that is not in the
+// set, reporting whether there is one
+func (b bitset) nextClear(i, n uint64) (uint32, bool) {
+	for i < n {
+		if w := ^b[i/64] >> (i % 64); w != 0 {
+			if j := i + uint64(bits.TrailingZeros64(w)); j < n {
+				return uint32(j), true
+			}
+			return 0, false
+		}
+		i = (i/64 + 1) * 64
+	}
+	return 0, false
+}
+
+// parseRange parses a "start-end" address range, or a block in CIDR notation whose
+// network and broadcast addresses are left out. A /31 keeps both of its addresses, as
+// on point-to-point links, and a /32 is its single address.
+func parseRange(r string) (net.IP, net.IP, error) {
+	if strings.Contains(r, "/") {
+		return parseCIDRRange(r)
+	}
+	rangeParts := strings.Split(r, "-")
+	if len(rangeParts) != 2 {
+		return nil, nil, fmt.Errorf("invalid range format: %s", r)
+	}
+	startIP := net.ParseIP(rangeParts[0])
+	endIP := net.ParseIP(rangeParts[1])
+	if startIP == nil || endIP == nil {
+		return nil, nil, fmt.Errorf("invalid start or end IP in range: %s", r)
+	}
+	if startIP = startIP.To4(); startIP == nil {
+		return nil, nil, fmt.Errorf("start of range %s is not an IPv4 address", r)
+	}
+	if endIP = endIP.To4(); endIP == nil {
+		return nil, nil, fmt.Errorf("end of range %s is not an IPv4 address", r)
+	}
+	first, last := ipToUint32(startIP), ipToUint32(endIP)
+	if first > last {
+		return nil, nil, fmt.Errorf("range %s ends before it starts", r)
+	}
+	if uint64(last-first)+1 > maxPoolSize {
+		return nil, nil, fmt.Errorf("range %s has more than %d addresses", r, maxPoolSize)
+	}
+	return startIP, endIP, nil
+}
+
+// parseCIDRRange parses a range written as a CIDR block
+func parseCIDRRange(r string) (net.IP, net.IP, error) {
+	ip, block, err := net.ParseCIDR(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid range %s: %w", r, err)
+	}
+	if !ip.Equal(block.IP) {
+		return nil, nil, fmt.Errorf("range %s has host bits set; the block is %s", r, block)
+	}
+	if block.IP.To4() == nil {
+		return nil, nil, fmt.Errorf("range %s is not an IPv4 block", r)
+	}
+	ones, _ := block.Mask.Size()
+	if uint64(1)<<(32-ones) > maxPoolSize {
+		return nil, nil, fmt.Errorf("range %s has more than %d addresses", r, maxPoolSize)
+	}
+	first := ipToUint32(block.IP)
+	last := ipToUint32(broadcastAddress(block))
+	if ones < 31 {
+		first, last = first+1, last-1
+	}
+	return uint32ToIP(first), uint32ToIP(last), nil
+}
+
+// parseRanges parses one or more disjoint "start-end" or CIDR ranges of a single pool. It
+// returns the first and last address of all of them and the ranges in ascending
+// order; the addresses between them are gaps that are not handed out.
+func parseRanges(ranges []string) (net.IP, net.IP, [][2]net.IP, error) {
+	if len(ranges) == 0 {
+		return nil, nil, nil, fmt.Errorf("range is required")
+	}
+	parsed := make([][2]net.IP, 0, len(ranges))
+	for _, r := range ranges {
+		startIP, endIP, err := parseRange(r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		parsed = append(parsed, [2]net.IP{startIP, endIP})
+	}
+	sort.Slice(parsed, func(i, j int) bool { return ipToUint32(parsed[i][0]) < ipToUint32(parsed[j][0]) })
+	for i := 1; i < len(parsed); i++ {
+		if ipToUint32(parsed[i][0]) <= ipToUint32(parsed[i-1][1]) {
+			return nil, nil, nil, fmt.Errorf("range %s-%s overlaps range %s-%s", parsed[i][0], parsed[i][1], parsed[i-1][0], parsed[i-1][1])
+		}
+	}
+	first, last := parsed[0][0], parsed[len(parsed)-1][1]
+	if uint64(ipToUint32(last)-ipToUint32(first))+1 > maxPoolSize {
+		return nil, nil, nil, fmt.Errorf("ranges from %s to %s span more than %d addresses", first, last, maxPoolSize)
+	}
+	return first, last, parsed, nil
+}
+
+// maxPoolSize bounds the number of addresses in a range, keeping the pool bitmaps
+// of even the largest range at a few megabytes
+const maxPoolSize = 1 << 24
+
+// newAddressPool creates a pool of the addresses from start to end, excluding the
+// reserved addresses and the carved ranges of other pools
+func newAddressPool(startIP, endIP net.IP, reserved []net.IP, carved []*addressPool) *addressPool {
+	p := &addressPool{
+		start: startIP,
+		end:   endIP,
+		base:  ipToUint32(startIP),
+	}
+	if last := ipToUint32(endIP); last >= p.base {
+		p.size = uint64(last-p.base) + 1
+	}
+	p.taken = newBitset(p.size)
+	p.excluded = newBitset(p.size)
+	p.cooling = make(map[uint32]time.Time)
+	p.available = int(p.size)
+	p.capacity = p.available
+	p.reusePressure = 100
+
+	for _, c := range carved {
+		p.excludeSpan(uint64(c.base), uint64(c.base)+c.size)
+	}
+	for _, ip := range reserved {
+		if off, ok := p.offset(ip); ok {
+			p.exclude(off)
+		}
+	}
+	return p
+}
+
+// newRangesPool creates a pool of the disjoint ranges returned by parseRanges, with
+// the gaps between them excluded like carved ranges
+func newRangesPool(ranges [][2]net.IP, reserved []net.IP, carved []*addressPool) *addressPool {
+	p := newAddressPool(ranges[0][0], ranges[len(ranges)-1][1], reserved, carved)
+	for i := 1; i < len(ranges); i++ {
+		gap := [2]uint64{uint64(ipToUint32(ranges[i-1][1])) + 1, uint64(ipToUint32(ranges[i][0]))}
+		p.excludeSpan(gap[0], gap[1])
+		p.gaps = append(p.gaps, gap)
+	}
+	return p
+}
+
+// exclude removes the address at off from the pool for good
+func (p *addressPool) exclude(off uint32) {
+	if !p.excluded.has(off) {
+		p.excluded.set(off)
+		p.taken.set(off)
+		p.available--
+		p.capacity--
+	}
+}
+
+// include returns the excluded address at off to the pool's capacity. It stays taken
+// until released.
+func (p *addressPool) include(off uint32) {
+	if p.excluded.has(off) {
+		p.excluded.clear(off)
+		p.capacity++
+	}
+}
+
+// excludeSpan excludes the addresses from the integer address from up to but not
+// including to, as far as they lie in the pool
+func (p *addressPool) excludeSpan(from, to uint64) {
+	from, to = max(from, uint64(p.base)), min(to, uint64(p.base)+p.size)
+	for v := from; v < to; v++ {
+		p.exclude(uint32(v - uint64(p.base)))
+	}
+}
+
+// ipToUint32 returns the IPv4 address ip as an integer, 0 for other addresses
+func ipToUint32(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip4)
+}
+
+// uint32ToIP returns the IPv4 address of the integer v
+func uint32ToIP(v uint32) net.IP {
+	return binary.BigEndian.AppendUint32(make(net.IP, 0, net.IPv4len), v)
+}
+
+// offset returns the offset of ip in the range, reporting whether it lies inside
+func (p *addressPool) offset(ip net.IP) (uint32, bool) {
+	if ip.To4() == nil {
+		return 0, false
+	}
+	v := ipToUint32(ip)
+	if v < p.base || uint64(v-p.base) >= p.size {
+		return 0, false
+	}
+	return v - p.base, true
+}
+
+// ipAt returns the address at offset off
+func (p *addressPool) ipAt(off uint32) net.IP {
+	return uint32ToIP(p.base + off)
+}
+
+// isFree reports whether the address at off can be handed out
+func (p *addressPool) isFree(off uint32) bool {
+	return !p.taken.has(off)
+}
+
+// allocate marks the free address at off taken
+func (p *addressPool) allocate(off uint32) net.IP {
+	p.taken.set(off)
+	p.available--
+	return p.ipAt(off)
+}
+
+// contains reports whether ip lies within the pool's range
+func (p *addressPool) contains(ip net.IP) bool {
+	ip16 := ip.To16()
+	return bytes.Compare(ip16, p.start.To16()) >= 0 && bytes.Compare(ip16, p.end.To16()) <= 0
+}
+
+// inRanges reports whether ip lies in one of the pool's ranges rather than in a gap
+// between them
+func (p *addressPool) inRanges(ip net.IP) bool {
+	if !p.contains(ip) {
+		return false
+	}
+	v := uint64(ipToUint32(ip))
+	for _, gap := range p.gaps {
+		if v >= gap[0] && v < gap[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// overlaps reports whether the ranges of p and other share any address
+func (p *addressPool) overlaps(other *addressPool) bool {
+	return p.contains(other.start) || p.contains(other.end) || other.contains(p.start)
+}
+
+// take removes and returns a free address chosen by the pool's policy, or nil if the
+// pool is exhausted. key identifies the client for the hash policy. Addresses that
+// have cooled down by now are returned to the free ones first.
+func (p *addressPool) take(key string, now time.Time) net.IP {
+	p.warm(now)
+	if p.underPressure() {
+		if ip := p.takeCooling(); ip != nil {
+			return ip
+		}
+	}
+	if p.available <= 0 {
+		return nil
+	}
+	switch p.policy {
+	case policyRandom:
+		// Rejection sampling is uniform; a nearly full pool falls back to a scan
+		for range randomPickAttempts {
+			if off := uint32(rand.Uint64N(p.size)); p.isFree(off) {
+				return p.allocate(off)
+			}
+		}
+		return p.scanFrom(uint32(rand.Uint64N(p.size)))
+	case policyHash:
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return p.scanFrom(uint32(uint64(h.Sum32()) % p.size))
+	default:
+		if off, ok := p.taken.nextClear(p.cursor, p.size); ok {
+			p.cursor = uint64(off) + 1
+			return p.allocate(off)
+		}
+		p.cursor = p.size
+		for len(p.released) > 0 {
+			off := p.released[0]
+			p.released = p.released[1:]
+			if p.isFree(off) {
+				return p.allocate(off)
+			}
+		}
+		return nil
+	}
+}
+
+// randomPickAttempts bounds the random probes of the random policy before it scans
+const randomPickAttempts = 64
+
+// scanFrom takes the first free address at or after offset start, wrapping around
+func (p *addressPool) scanFrom(start uint32) net.IP {
+	off, ok := p.taken.nextClear(uint64(start), p.size)
+	if !ok {
+		off, ok = p.taken.nextClear(0, uint64(start))
+	}
+	if !ok {
+		return nil
+	}
+	return p.allocate(off)
+}
+
+// takeIP removes ip from the free addresses, reporting whether it was free
+func (p *addressPool) takeIP(ip net.IP) bool {
+	off, ok := p.offset(ip)
+	if !ok {
+		return false
+	}
+	if p.isCooling(off) {
+		p.stopCooling(off)
+		return true
+	}
+	if !p.isFree(off) {
+		return false
+	}
+	p.allocate(off)
+	return true
+}
+
+// release returns ip to the free addresses
+func (p *addressPool) release(ip net.IP) {
+	off, ok := p.offset(ip)
+	if !ok {
+		return
+	}
+	if p.excluded.has(off) || !p.taken.has(off) {
+		return
+	}
+	if p.isCooling(off) {
+		p.stopCooling(off)
+	}
+	p.taken.clear(off)
+	p.available++
+	if uint64(off) < p.cursor {
+		p.released = append(p.released, off)
+		if len(p.released) > 2*p.available+64 {
+			p.compactReleased()
+		}
+	}
+}
+
+// compactReleased drops stale and duplicate entries from the released queue
+func (p *addressPool) compactReleased() {
+	seen := make(map[uint32]struct{}, len(p.released))
+	released := make([]uint32, 0, len(p.released))
+	for _, off := range p.released {
+		if _, dup := seen[off]; dup || !p.isFree(off) {
+			continue
+		}
+		seen[off] = struct{}{}
+		released = append(released, off)
+	}
+	p.released = released
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// largeRangeConfig returns a subnet config whose range covers a whole /12
+func largeRangeConfig() SubnetConfig {
+	cfg := testSubnetConfig()
+	cfg.Network = "10.0.0.0/12"
+	cfg.Range = StringList{"10.0.0.100-10.15.255.254"}
+	return cfg
+}
+
+// largeRangeMaxAlloc bounds the bytes startup may allocate for a /12 range. Its two
+// pool bitmaps take 256 KiB, while materializing the addresses as net.IP values
+// would take tens of megabytes.
+const largeRangeMaxAlloc = 1 << 20
+
+func TestLargeRangeStartupMemory(t *testing.T) {
+	cfg := largeRangeConfig()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	s, err := NewDHCPServer(cfg)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The /12 less the 100 addresses below the range and its broadcast address
+	if want := uint64(1<<20 - 101); s.pool.size != want {
+		t.Fatalf("pool holds %d addresses, want %d", s.pool.size, want)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > largeRangeMaxAlloc {
+		t.Errorf("startup with a /12 range allocated %d bytes, want at most %d", n, largeRangeMaxAlloc)
+	}
+}
+
+func BenchmarkNewDHCPServerLargeRange(b *testing.B) {
+	cfg := largeRangeConfig()
+	b.ReportAllocs()
+	for range b.N {
+		if _, err := NewDHCPServer(cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// newLargePool returns an empty pool spanning a /12 with the given policy
+func newLargePool(policy allocationPolicy) *addressPool {
+	p := newAddressPool(net.IPv4(10, 0, 0, 0), net.IPv4(10, 15, 255, 255), nil, nil)
+	p.policy = policy
+	return p
+}
+
+// fillPool takes every free address of p
+func fillPool(p *addressPool) {
+	for p.take("", testEpoch) != nil {
+	}
+}
+
+func BenchmarkPoolTake(b *testing.B) {
+	for _, policy := range []struct {
+		name   string
+		policy allocationPolicy
+	}{
+		{"sequential", policySequential},
+		{"random", policyRandom},
+		{"hash", policyHash},
+	} {
+		b.Run(policy.name, func(b *testing.B) {
+			p := newLargePool(policy.policy)
+			for i := range b.N {
+				// Keep the pool at most half full so every policy finds room quickly
+				if uint64(p.available) <= p.size/2 {
+					b.StopTimer()
+					p = newLargePool(policy.policy)
+					b.StartTimer()
+				}
+				if p.take(strconv.Itoa(i), testEpoch) == nil {
+					b.Fatal("pool exhausted")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPoolRelease(b *testing.B) {
+	p := newLargePool(policySequential)
+	fillPool(p)
+	b.ResetTimer()
+	for i := range b.N {
+		off := uint32(uint64(i) % p.size)
+		if off == 0 && i > 0 {
+			b.StopTimer()
+			fillPool(p)
+			b.StartTimer()
+		}
+		p.release(p.ipAt(off))
+	}
+}
+
+func BenchmarkPoolContains(b *testing.B) {
+	p := newLargePool(policySequential)
+	for range p.size / 2 {
+		p.take("", testEpoch)
+	}
+	ips := make([]net.IP, 1024)
+	for i := range ips {
+		ips[i] = p.ipAt(uint32(uint64(i) * 1021 % p.size))
+	}
+	free := 0
+	b.ResetTimer()
+	for i := range b.N {
+		ip := ips[i%len(ips)]
+		off, ok := p.offset(ip)
+		if !ok || !p.contains(ip) {
+			b.Fatalf("%s is not in the pool", ip)
+		}
+		if p.isFree(off) {
+			free++
+		}
+	}
+	if b.N >= len(ips) && free == 0 {
+		b.Fatal("no probed address was free in a half-full pool")
+	}
+}
+
+// TestCIDRRangeEdges serves every address of ranges written as small CIDR blocks. A /30
+// range loses its own network and broadcast addresses while a /31 or /32 range keeps
+// them; the network and broadcast addresses of the subnet are left out in turn, except
+// in a /31 or /32 network, which has none.
+func TestCIDRRangeEdges(t *testing.T) {
+	for _, tc := range []struct {
+		network, rng string
+		gateway      StringList
+		start, end   string
+		offers       []string
+	}{
+		{network: "10.0.0.0/31", rng: "10.0.0.0/31", start: "10.0.0.0", end: "10.0.0.1", offers: []string{"10.0.0.0", "10.0.0.1"}},
+		{network: "10.0.0.0/30", rng: "10.0.0.0/30", start: "10.0.0.1", end: "10.0.0.2", offers: []string{"10.0.0.1", "10.0.0.2"}},
+		{network: "10.0.0.5/32", rng: "10.0.0.5/32", start: "10.0.0.5", end: "10.0.0.5", offers: []string{"10.0.0.5"}},
+		{network: "10.0.0.0/24", rng: "10.0.0.20/31", start: "10.0.0.20", end: "10.0.0.21", offers: []string{"10.0.0.20", "10.0.0.21"}},
+		{network: "10.0.0.0/24", rng: "10.0.0.20/30", start: "10.0.0.21", end: "10.0.0.22", offers: []string{"10.0.0.21", "10.0.0.22"}},
+		{network: "10.0.0.0/24", rng: "10.0.0.0/31", start: "10.0.0.0", end: "10.0.0.1", offers: []string{"10.0.0.1"}},
+		{network: "10.0.0.0/24", rng: "10.0.0.254/31", start: "10.0.0.254", end: "10.0.0.255", offers: []string{"10.0.0.254"}},
+		{network: "10.0.0.0/24", rng: "10.0.0.0/30", gateway: StringList{"10.0.0.1"}, start: "10.0.0.1", end: "10.0.0.2", offers: []string{"10.0.0.2"}},
+	} {
+		t.Run(tc.network+" "+tc.rng, func(t *testing.T) {
+			cfg := testSubnetConfig()
+			cfg.Network, cfg.Range, cfg.Gateway, cfg.DNSServers = tc.network, StringList{tc.rng}, tc.gateway, nil
+			s := newTestServer(t, cfg)
+			pools := s.pools()
+			if len(pools) != 1 {
+				t.Fatalf("got %d pools, want 1", len(pools))
+			}
+			if p := pools[0]; p.start.String() != tc.start || p.end.String() != tc.end || p.capacity != len(tc.offers) {
+				t.Fatalf("pool %s-%s with %d usable, want %s-%s with %d", p.start, p.end, p.capacity, tc.start, tc.end, len(tc.offers))
+			}
+			for i, want := range tc.offers {
+				offer := serve(t, s, newDiscover(t, testMAC(byte(i))))
+				if offer == nil || offer.YourIPAddr.String() != want {
+					t.Fatalf("offer %d = %v, want %s", i, offer, want)
+				}
+			}
+			if offer := serve(t, s, newDiscover(t, testMAC(byte(len(tc.offers))))); offer != nil {
+				t.Errorf("pool gave out %s after all its addresses", offer.YourIPAddr)
+			}
+		})
+	}
+}
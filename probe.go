@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// defaultPingTimeout is how long a conflict probe waits for an answer
+const defaultPingTimeout = 500 * time.Millisecond
+
+// maxProbeAttempts bounds how many conflicting addresses are skipped for one DISCOVER
+const maxProbeAttempts = 5
+
+// errProbeUnsupported is returned by arpProbe on platforms without ARP probing
+var errProbeUnsupported = errors.New("ARP probing is not supported on this platform")
+
+// probeAddress reports whether a host already answers on ip, trying ARP on iface
+// first and falling back to an ICMP echo. mac is the responder's hardware address
+// when it is known.
+func probeAddress(iface string, ip net.IP, timeout time.Duration) (inUse bool, mac net.HardwareAddr, err error) {
+	mac, inUse, err = arpProbe(iface, ip, timeout)
+	if err == nil {
+		return inUse, mac, nil
+	}
+	if !errors.Is(err, errProbeUnsupported) {
+		log.Printf("ARP probe of %s failed, falling back to ICMP: %v", ip, err)
+	}
+	inUse, err = icmpProbe(ip, timeout)
+	return inUse, nil, err
+}
+
+// icmpProbe sends an ICMP echo request to ip and reports whether a reply arrives
+// within timeout. It needs a raw socket, so the server must run as root.
+func icmpProbe(ip net.IP, timeout time.Duration) (bool, error) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false, fmt.Errorf("failed to open ICMP socket: %w", err)
+	}
+	defer conn.Close()
+
+	id := uint16(os.Getpid())
+	request := []byte{8, 0, 0, 0, 0, 0, 0, 1} // Echo request, sequence 1
+	binary.BigEndian.PutUint16(request[4:], id)
+	binary.BigEndian.PutUint16(request[2:], icmpChecksum(request))
+	if _, err := conn.WriteTo(request, &net.IPAddr{IP: ip}); err != nil {
+		return false, fmt.Errorf("failed to send ICMP echo: %w", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return false, nil
+			}
+			return false, err
+		}
+		peerAddr, ok := peer.(*net.IPAddr)
+		if !ok || !peerAddr.IP.Equal(ip) || n < 8 {
+			continue
+		}
+		// Echo reply with our identifier
+		if buf[0] == 0 && binary.BigEndian.Uint16(buf[4:]) == id {
+			return true, nil
+		}
+	}
+}
+
+// icmpChecksum computes the Internet checksum of an ICMP message
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// arpProbe broadcasts an ARP probe (RFC 5227, sender address 0.0.0.0) for ip on
+// iface and returns the hardware address of the host that answers, if any
+func arpProbe(iface string, ip net.IP, timeout time.Duration) (net.HardwareAddr, bool, error) {
+	target := ip.To4()
+	if target == nil {
+		return nil, false, fmt.Errorf("not an IPv4 address: %s", ip)
+	}
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(ifi.HardwareAddr) != 6 {
+		return nil, false, fmt.Errorf("interface %s has no Ethernet address", iface)
+	}
+
+	proto := htons(syscall.ETH_P_ARP)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(proto))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open ARP socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: ifi.Index}); err != nil {
+		return nil, false, fmt.Errorf("failed to bind ARP socket: %w", err)
+	}
+
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcast...)
+	frame = append(frame, ifi.HardwareAddr...)
+	frame = binary.BigEndian.AppendUint16(frame, syscall.ETH_P_ARP)
+	frame = append(frame, 0, 1, 8, 0, 6, 4, 0, 1) // Ethernet, IPv4, request
+	frame = append(frame, ifi.HardwareAddr...)
+	frame = append(frame, 0, 0, 0, 0) // Sender IP 0.0.0.0 for a probe
+	frame = append(frame, 0, 0, 0, 0, 0, 0)
+	frame = append(frame, target...)
+	dest := &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: ifi.Index, Halen: 6}
+	copy(dest.Addr[:], broadcast)
+	if err := syscall.Sendto(fd, frame, 0, dest); err != nil {
+		return nil, false, fmt.Errorf("failed to send ARP probe: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, false, nil
+		}
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return nil, false, err
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		// Any ARP packet sent from the probed address means it is in use
+		if n < 42 || binary.BigEndian.Uint16(buf[12:]) != syscall.ETH_P_ARP {
+			continue
+		}
+		senderMAC, senderIP := buf[22:28], buf[28:32]
+		if bytes.Equal(senderIP, target) && !bytes.Equal(senderMAC, ifi.HardwareAddr) {
+			return net.HardwareAddr(append([]byte(nil), senderMAC...)), true, nil
+		}
+	}
+}
+
+// htons converts a 16-bit value to network byte order
+func htons(v uint16) uint16 {
+	return binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v))
+}
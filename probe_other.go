@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// arpProbe is only implemented on Linux; elsewhere probeAddress falls back to ICMP
+func arpProbe(iface string, ip net.IP, timeout time.Duration) (net.HardwareAddr, bool, error) {
+	return nil, false, errProbeUnsupported
+}
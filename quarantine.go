@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// quarantineEntry describes a declined or conflicting address withheld from the pool
+type quarantineEntry struct {
+	IP         string    `json:"ip"`
+	DeclinedAt time.Time `json:"declined_at"` // Time of the latest decline or conflict
+	Declines   int       `json:"declines"`    // Declines and conflicts since the server started
+	Parked     bool      `json:"parked"`      // Declined decline_threshold times and no longer re-probed
+}
+
+// isParked reports whether ipStr was declined often enough to stay quarantined. The
+// caller must hold s.mutex.
+func (s *DHCPServer) isParked(ipStr string) bool {
+	return s.declineThreshold > 0 && s.declineCounts[ipStr] >= s.declineThreshold
+}
+
+// quarantineEnded reports whether an address declined at declinedAt may return to the
+// pool without being probed. With re-probing enabled only quarantine_max_age releases
+// it unprobed. The caller must hold s.mutex.
+func (s *DHCPServer) quarantineEnded(ipStr string, declinedAt, now time.Time) bool {
+	age := now.Sub(declinedAt)
+	if s.isParked(ipStr) || age < s.declineCooldown {
+		return false
+	}
+	if s.quarantineProbeInterval > 0 {
+		return s.quarantineMaxAge > 0 && age >= s.quarantineMaxAge
+	}
+	return true
+}
+
+// Quarantined lists the addresses of every subnet currently withheld after a decline
+// or conflict, ordered by address
+func (s *DHCPServer) Quarantined() []quarantineEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries := make([]quarantineEntry, 0, len(s.declined))
+	for ipStr, declinedAt := range s.declined {
+		entries = append(entries, quarantineEntry{
+			IP:         ipStr,
+			DeclinedAt: declinedAt,
+			Declines:   s.declineCounts[ipStr],
+			Parked:     s.ownerOf(net.ParseIP(ipStr)).isParked(ipStr),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(entries[i].IP).To16(), net.ParseIP(entries[j].IP).To16()) < 0
+	})
+	return entries
+}
+
+// RunQuarantineProber re-probes quarantined addresses every quarantine_probe_interval
+// until ctx is canceled, returning those that no longer answer to the pool. The
+// interval is re-read after every round so that a reload takes effect.
+func (s *DHCPServer) RunQuarantineProber(ctx context.Context) {
+	for {
+		s.configMutex.RLock()
+		interval := s.quarantineProbeInterval
+		s.configMutex.RUnlock()
+
+		wait := interval
+		if wait <= 0 {
+			wait = defaultReapInterval // Disabled; check again for a reload
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(wait):
+		}
+		if interval > 0 {
+			s.reprobeQuarantined()
+		}
+	}
+}
+
+// reprobeQuarantined probes every quarantined address past its cooldown that is not
+// parked and releases the ones nobody answers for
+func (s *DHCPServer) reprobeQuarantined() {
+	s.configMutex.RLock()
+	iface, timeout := s.iface, s.pingTimeout()
+	s.configMutex.RUnlock()
+
+	s.mutex.Lock()
+	now := s.clock.Now()
+	candidates := make(map[string]time.Time)
+	for ipStr, declinedAt := range s.declined {
+		if s.ownerOf(net.ParseIP(ipStr)) != s {
+			continue // Probed by the prober of its own subnet
+		}
+		if !s.isParked(ipStr) && now.Sub(declinedAt) >= s.declineCooldown {
+			candidates[ipStr] = declinedAt
+		}
+	}
+	s.mutex.Unlock()
+
+	released := 0
+	for ipStr, declinedAt := range candidates {
+		inUse, holder, err := probeAddress(iface, net.ParseIP(ipStr), timeout)
+		if err != nil {
+			log.Printf("Re-probe of quarantined %s failed: %v", ipStr, err)
+			continue
+		}
+		if inUse {
+			if holder != nil {
+				log.Printf("Quarantined %s is still in use by %s", ipStr, holder)
+			}
+			continue
+		}
+
+		s.mutex.Lock()
+		// Skip addresses declined again while the probe ran
+		if current, exists := s.declined[ipStr]; exists && current.Equal(declinedAt) {
+			s.endQuarantine(ipStr, s.clock.Now())
+			released++
+			log.Printf("Quarantined %s no longer answers; returned it to the pool", ipStr)
+			s.checkUtilization()
+		}
+		s.mutex.Unlock()
+	}
+
+	if entries := s.Quarantined(); len(entries) > 0 {
+		ips := make([]string, len(entries))
+		for i, entry := range entries {
+			ips[i] = entry.IP
+			if entry.Parked {
+				ips[i] += " (parked)"
+			}
+		}
+		log.Printf("%d address(es) quarantined: %s", len(entries), strings.Join(ips, ", "))
+	}
+	if released > 0 {
+		s.saveLeases()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultReapInterval is how often expired leases are reclaimed in the background
+const defaultReapInterval = time.Minute
+
+// RunReaper reclaims expired leases and declined addresses every interval until ctx
+// is canceled, so an idle server does not accumulate dead leases
+func (s *DHCPServer) RunReaper(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C():
+			if expired := s.reapExpired(now); len(expired) > 0 {
+				s.saveLeases()
+			}
+		}
+	}
+}
+
+// reapExpired is expireLeases for callers not holding s.mutex. It also drops address
+// history past its maximum age, forgets addresses seen longer ago than the conflict
+// recheck interval, announces leases close to expiry, lets pools that recovered leave
+// emergency mode and reports utilization changes.
+func (s *DHCPServer) reapExpired(now time.Time) []*Lease {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pruneHistory(now)
+	s.pruneSeen(now)
+	expired := s.expireLeases(now)
+	s.warnExpiring(now)
+	for _, subnet := range s.subnets {
+		for _, pool := range subnet.pools() {
+			subnet.checkEmergency(pool)
+		}
+	}
+	s.checkUtilization()
+	return expired
+}
+
+// expireLeases removes the leases of every subnet that expired before now, returning
+// their addresses to the pools unless they are reserved, after reuse_delay if one is set, and
+// reclaims declined addresses past their cooldown. It returns the removed leases. The caller must hold s.mutex.
+func (s *DHCPServer) expireLeases(now time.Time) []*Lease {
+	s.reclaimDeclined()
+	expired := s.leases.ExpireBefore(now)
+	for _, lease := range expired {
+		if !s.ownerOf(lease.IP).isReservedIP(lease.IP) {
+			s.recycleIP(lease.IP, now)
+		}
+		bound := !lease.offered()
+		s.leaseEnded("expire", lease)
+		if bound {
+			s.rememberAddress(lease.MAC.String(), lease.IP, lease.ExpiresAt)
+			log.Printf("Lease of %s on %s expired", lease.MAC, lease.IP)
+		}
+	}
+	return expired
+}
+
+// Errors returned by ExpireLease
+var (
+	errLeaseNotFound = errors.New("lease not found")
+	errLeaseReserved = errors.New("lease is reserved")
+)
+
+// ExpireLease ends the lease of mac now and returns its address, which the next
+// sweep or allocation reclaims. Leases of reserved clients cannot be expired, except
+// those held through a hostname reservation, so a replacement device can claim it.
+func (s *DHCPServer) ExpireLease(mac net.HardwareAddr) (net.IP, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	macStr := mac.String()
+	lease, exists := s.leases.Get(macStr)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", errLeaseNotFound, macStr)
+	}
+	key := lease.reservationKey()
+	if _, reserved := s.ownerOf(lease.IP).reservations[key]; reserved && !strings.HasPrefix(key, hostnameKeyPrefix) {
+		return nil, fmt.Errorf("%w: %s has a reservation for %s", errLeaseReserved, macStr, lease.IP)
+	}
+	lease.ExpiresAt = s.clock.Now()
+	log.Printf("Expired lease of %s on %s on request", macStr, lease.IP)
+	return lease.IP, nil
+}
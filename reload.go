@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Reload replaces the running configuration with that of next, which must have been
+// built by NewDHCPServer from the new config. Existing leases are kept: addresses
+// still inside a pool are taken out of it, and leases on addresses that left the
+// pools stay until they expire. It returns a summary of what changed.
+func (s *DHCPServer) Reload(next *DHCPServer) []string {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changes := diffSubnetConfig(s.subnetConfig, next.subnetConfig)
+
+	// Keep reservations added through the API that are not persisted in a file
+	configured := make(map[string]bool, len(s.subnetConfig.ReservedAddresses))
+	for key := range s.subnetConfig.ReservedAddresses {
+		if normalized, err := parseReservationKey(key); err == nil {
+			configured[normalized] = true
+		}
+	}
+	for mac, res := range s.reservations {
+		if configured[mac] {
+			continue
+		}
+		if _, exists := next.reservations[mac]; exists || next.isReservedIP(res.ip) || !next.network.Contains(res.ip) {
+			continue
+		}
+		next.reservations[mac] = res
+		if pool := next.poolFor(res.ip); pool != nil {
+			pool.takeIP(res.ip)
+		}
+	}
+
+	// Declined addresses stay out of the new pools until their quarantine ends
+	for ipStr := range s.declined {
+		if pool := next.poolFor(net.ParseIP(ipStr)); pool != nil {
+			pool.takeIP(net.ParseIP(ipStr))
+		}
+	}
+
+	// Reclaimed addresses keep cooling down in the new pools
+	for _, pool := range s.pools() {
+		for _, entry := range pool.coolingAddresses() {
+			ip := pool.ipAt(entry.off)
+			if target := next.poolFor(ip); target != nil {
+				target.recycle(ip, entry.reclaimedAt)
+			}
+		}
+	}
+
+	now := s.clock.Now()
+	for mac, lease := range s.leases.Snapshot() {
+		if owner := s.subnetFor(lease.IP); owner != nil && owner != s {
+			continue // Leased in another subnet
+		}
+		key := lease.reservationKey()
+		if res, exists := next.reservations[key]; exists && res.ip.Equal(lease.IP) {
+			continue
+		}
+		if next.isExcluded(lease.IP) {
+			if now.Before(lease.ExpiresAt) {
+				log.Printf("Warning: lease of %s on %s lies in a new exclusion and will not be renewed", mac, lease.IP)
+			}
+		} else if pool := next.poolFor(lease.IP); pool != nil {
+			pool.takeIP(lease.IP)
+		} else if now.Before(lease.ExpiresAt) && !next.isReservedIP(lease.IP) {
+			log.Printf("Lease of %s on %s is outside the new ranges and will not be renewed", lease.IP, mac)
+		}
+		for otherMac, res := range next.reservations {
+			if otherMac != key && res.ip.Equal(lease.IP) && now.Before(lease.ExpiresAt) {
+				log.Printf("Warning: %s is now reserved for %s but still leased to %s", lease.IP, otherMac, mac)
+			}
+		}
+	}
+
+	s.subnetConfig = next.subnetConfig
+	s.pool = next.pool
+	s.network = next.network
+	s.subnetMask = next.subnetMask
+	s.gateway = next.gateway
+	s.routers = next.routers
+	s.dnsServers = next.dnsServers
+	s.vendorOptions = next.vendorOptions
+	s.vivso = next.vivso
+	s.customOptions = next.customOptions
+	s.reservations = next.reservations
+	s.prefixReservations = next.prefixReservations
+	s.leaseOverrides = next.leaseOverrides
+	s.patternReservations = next.patternReservations
+	s.exclusions = next.exclusions
+	s.replySource = next.replySource
+	s.staticRoutes = next.staticRoutes
+	s.classes = next.classes
+	s.nextServer = next.nextServer
+	s.knownClients = next.knownClients
+	s.macFilter = next.macFilter
+	s.winsServers = next.winsServers
+	s.timeServers = next.timeServers
+	s.logServers = next.logServers
+	s.offerTimeout = next.offerTimeout
+	s.declineCooldown = next.declineCooldown
+	s.quarantineProbeInterval = next.quarantineProbeInterval
+	s.quarantineMaxAge = next.quarantineMaxAge
+	s.declineThreshold = next.declineThreshold
+	s.conflictDetection = next.conflictDetection
+	s.conflictRecheck = next.conflictRecheck
+	s.unknownClientPolicy = next.unknownClientPolicy
+	s.utilizationWarnings = next.utilizationWarnings
+	s.utilizationLevel = min(s.utilizationLevel, len(s.utilizationWarnings))
+	s.serverName = next.serverName
+	s.headerBootFile = next.headerBootFile
+	return changes
+}
+
+// diffSubnetConfig describes the settings that differ between old and new by their
+// YAML names, listing reservations individually
+func diffSubnetConfig(old, new SubnetConfig) []string {
+	changes := []string{}
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "reserved_addresses" || reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s changed", name))
+	}
+
+	macs := []string{}
+	for mac := range old.ReservedAddresses {
+		macs = append(macs, mac)
+	}
+	for mac := range new.ReservedAddresses {
+		if _, exists := old.ReservedAddresses[mac]; !exists {
+			macs = append(macs, mac)
+		}
+	}
+	sort.Strings(macs)
+	for _, mac := range macs {
+		oldRes, inOld := old.ReservedAddresses[mac]
+		newRes, inNew := new.ReservedAddresses[mac]
+		switch {
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("reservation %s -> %s removed", mac, oldRes.IP))
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("reservation %s -> %s added", mac, newRes.IP))
+		case !reflect.DeepEqual(oldRes, newRes):
+			changes = append(changes, fmt.Sprintf("reservation %s changed", mac))
+		}
+	}
+	return changes
+}
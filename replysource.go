@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// sourceConn sends every packet from a fixed source address via IP_PKTINFO, so
+// replies leave a multi-homed host from the address clients expect
+type sourceConn struct {
+	net.PacketConn
+	pc  *ipv4.PacketConn
+	src net.IP
+}
+
+// WriteTo implements net.PacketConn
+func (c *sourceConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, &ipv4.ControlMessage{Src: c.src}, addr)
+}
+
+// replyConn returns conn, sending from the subnet's reply_source_ip if one is set
+func (s *DHCPServer) replyConn(conn net.PacketConn) net.PacketConn {
+	if s.replySource == nil {
+		return conn
+	}
+	return &sourceConn{PacketConn: conn, pc: ipv4.NewPacketConn(conn), src: s.replySource}
+}
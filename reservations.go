@@ -0,0 +1,600 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"gopkg.in/yaml.v3"
+)
+
+// ReservationConfig is a static assignment for one client. In YAML it is either the
+// IP address alone or a mapping carrying per-host overrides of the subnet settings.
+type ReservationConfig struct {
+	IP            string               `yaml:"ip"`
+	Gateway       string               `yaml:"gateway,omitempty"`
+	DNSServers    []string             `yaml:"dns_servers,omitempty"`
+	LeaseDuration int                  `yaml:"lease_duration,omitempty"`
+	BootFile      string               `yaml:"boot_file,omitempty"`
+	Options       []CustomOptionConfig `yaml:"options,omitempty"`
+	Hostname      string               `yaml:"hostname,omitempty"` // Sent in option 12
+	Domain        string               `yaml:"domain,omitempty"`   // Overrides domain_name (option 15)
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (r *ReservationConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		r.IP = value.Value
+		return nil
+	}
+	type plain ReservationConfig
+	return value.Decode((*plain)(r))
+}
+
+// MarshalYAML implements yaml.Marshaler, writing the short form when only the IP is set
+func (r ReservationConfig) MarshalYAML() (interface{}, error) {
+	if r.Gateway == "" && r.DNSServers == nil && r.LeaseDuration == 0 && r.BootFile == "" && r.Options == nil &&
+		r.Hostname == "" && r.Domain == "" {
+		return r.IP, nil
+	}
+	type plain ReservationConfig
+	return plain(r), nil
+}
+
+// reservation is a parsed ReservationConfig
+type reservation struct {
+	ip            net.IP
+	gateway       net.IP
+	dnsServers    []net.IP
+	leaseDuration time.Duration // Zero means the subnet default
+	bootFile      string
+	options       []dhcpv4.Option
+	hostname      string // Empty to send none
+	domain        string // Empty to use the subnet domain name
+}
+
+// setOptions returns the codes of the reply options the reservation sets that custom
+// options could also set, through its settings or its options
+func (r *reservation) setOptions() map[uint8]bool {
+	codes := map[uint8]bool{}
+	if r == nil {
+		return codes
+	}
+	if r.bootFile != "" {
+		codes[dhcpv4.OptionBootfileName.Code()] = true
+	}
+	if r.hostname != "" {
+		codes[dhcpv4.OptionHostName.Code()] = true
+	}
+	if r.domain != "" {
+		codes[dhcpv4.OptionDomainName.Code()] = true
+	}
+	for _, opt := range r.options {
+		codes[opt.Code.Code()] = true
+	}
+	return codes
+}
+
+// parseReservations validates the configured reservations, keyed by MAC string.
+// Prefix and pattern reservations are left to parsePrefixReservations and
+// parsePatternReservations.
+func parseReservations(configs map[string]ReservationConfig, network *net.IPNet) (map[string]*reservation, error) {
+	reservations := make(map[string]*reservation, len(configs))
+	for key, cfg := range configs {
+		if _, isPrefix := parseMACPrefix(key); isPrefix || isMACPattern(key) {
+			continue
+		}
+		mac, err := parseReservationKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := reservations[mac]; exists {
+			return nil, fmt.Errorf("%s is reserved twice under different spellings", mac)
+		}
+		ip := net.ParseIP(cfg.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid reserved IP for %s: %q", mac, cfg.IP)
+		}
+		if cfg.LeaseDuration < 0 {
+			return nil, fmt.Errorf("reservation for %s: lease_duration must not be negative", mac)
+		}
+		options, err := parseCustomOptions(cfg.Options)
+		if err != nil {
+			return nil, fmt.Errorf("reservation for %s: %w", mac, err)
+		}
+		if cfg.Hostname != "" && sanitizeHostname(cfg.Hostname) != cfg.Hostname {
+			return nil, fmt.Errorf("reservation for %s: invalid hostname %q: use letters, digits and inner hyphens, at most %d characters", mac, cfg.Hostname, maxHostnameLength)
+		}
+		gateway, err := parseReservationGateway(cfg.Gateway, network)
+		if err != nil {
+			return nil, fmt.Errorf("reservation for %s: %w", mac, err)
+		}
+		reservations[mac] = &reservation{
+			ip:            ip,
+			gateway:       gateway,
+			dnsServers:    parseIPs(cfg.DNSServers),
+			leaseDuration: time.Duration(cfg.LeaseDuration) * time.Second,
+			bootFile:      cfg.BootFile,
+			options:       options,
+			hostname:      cfg.Hostname,
+			domain:        cfg.Domain,
+		}
+	}
+	return reservations, nil
+}
+
+// parseReservationGateway parses the gateway of a reservation, nil if none is set. It
+// must be an IPv4 address inside network.
+func parseReservationGateway(value string, network *net.IPNet) (net.IP, error) {
+	if value == "" {
+		return nil, nil
+	}
+	gateway := net.ParseIP(value).To4()
+	if gateway == nil {
+		return nil, fmt.Errorf("invalid gateway %q", value)
+	}
+	if !network.Contains(gateway) {
+		return nil, fmt.Errorf("gateway %s is outside network %s", gateway, network)
+	}
+	return gateway, nil
+}
+
+// checkReservations verifies every reserved address with checkReservedAddress and
+// that each is reserved only once
+func checkReservations(reservations map[string]*reservation, network *net.IPNet, routers []net.IP, exclusions [][2]net.IP, patterns []*patternReservation) error {
+	keys := make([]string, 0, len(reservations))
+	for key := range reservations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	owners := make(map[string]string, len(reservations))
+	for _, key := range keys {
+		ip := reservations[key].ip
+		if err := checkReservedAddress(key, ip, network, routers, exclusions, patterns); err != nil {
+			return err
+		}
+		if other, exists := owners[ip.String()]; exists {
+			return fmt.Errorf("reservation for %s: %s is already reserved for %s", key, ip, other)
+		}
+		owners[ip.String()] = key
+	}
+	return nil
+}
+
+// checkReservedAddress verifies that ip may be reserved for key: it lies inside
+// network, is neither its network nor broadcast address nor a router, lies in no
+// exclusion and is not an address a pattern reservation can produce
+func checkReservedAddress(key string, ip net.IP, network *net.IPNet, routers []net.IP, exclusions [][2]net.IP, patterns []*patternReservation) error {
+	if !network.Contains(ip) {
+		return fmt.Errorf("reservation for %s: %s is outside network %s", key, ip, network)
+	}
+	if isNetworkOrBroadcast(ip, network) {
+		return fmt.Errorf("reservation for %s: %s is the network or broadcast address of %s", key, ip, network)
+	}
+	for _, router := range routers {
+		if ip.Equal(router) {
+			return fmt.Errorf("reservation for %s: %s is the gateway", key, ip)
+		}
+	}
+	v := ipToUint32(ip)
+	for _, r := range exclusions {
+		if v >= ipToUint32(r[0]) && v <= ipToUint32(r[1]) {
+			return fmt.Errorf("reservation for %s: %s lies in the exclusion %s-%s", key, ip, r[0], r[1])
+		}
+	}
+	for _, pr := range patterns {
+		if pr.produces(ip) {
+			return fmt.Errorf("%w: reservation for %s: %s can be assigned by the pattern reservation %s", errReservationConflict, key, ip, pr.key)
+		}
+	}
+	return nil
+}
+
+// isNetworkOrBroadcast reports whether ip is the network or broadcast address of
+// network. A /31 or /32 has neither; all of its addresses are usable (RFC 3021).
+func isNetworkOrBroadcast(ip net.IP, network *net.IPNet) bool {
+	if ones, _ := network.Mask.Size(); ones >= 31 {
+		return false
+	}
+	return ip.Equal(network.IP) || ip.Equal(broadcastAddress(network))
+}
+
+// broadcastAddress returns the broadcast address of network
+func broadcastAddress(network *net.IPNet) net.IP {
+	ip := network.IP.To4()
+	broadcast := make(net.IP, len(ip))
+	for i := range ip {
+		broadcast[i] = ip[i] | ^network.Mask[i]
+	}
+	return broadcast
+}
+
+// Prefixes of reservation keys naming a client identifier (option 61) rather than a
+// MAC, in hex or as text. Both are stored under clientIDKeyPrefix and the hex form.
+const (
+	clientIDKeyPrefix     = "id:"
+	clientIDTextKeyPrefix = "id-text:"
+)
+
+// hostnameKeyPrefix starts reservation keys naming the client's hostname (option 12),
+// which are only honored with trust_hostnames
+const hostnameKeyPrefix = "hostname:"
+
+// parseReservationKey normalizes a MAC or client identifier key to lower-case
+// colon-separated hex, the latter after clientIDKeyPrefix, and a hostname key to
+// lower case
+func parseReservationKey(key string) (string, error) {
+	if name, ok := strings.CutPrefix(key, hostnameKeyPrefix); ok {
+		if name == "" || sanitizeHostname(name) != name {
+			return "", fmt.Errorf("invalid reservation key %q: use letters, digits and inner hyphens, at most %d characters", key, maxHostnameLength)
+		}
+		return hostnameKey(name), nil
+	}
+	if text, ok := strings.CutPrefix(key, clientIDTextKeyPrefix); ok {
+		if text == "" {
+			return "", fmt.Errorf("invalid reservation key %q: empty client identifier", key)
+		}
+		return clientIDKey([]byte(text)), nil
+	}
+	if hexID, ok := strings.CutPrefix(key, clientIDKeyPrefix); ok {
+		id, err := parseHex(hexID)
+		if err != nil || len(id) == 0 {
+			return "", fmt.Errorf("invalid reservation key %q: expected a client identifier in hex", key)
+		}
+		return clientIDKey(id), nil
+	}
+	mac, err := net.ParseMAC(key)
+	if err != nil || len(mac) != 6 {
+		return "", fmt.Errorf("invalid reservation key %q: expected a MAC address, a MAC prefix or pattern, id:, id-text: or hostname:", key)
+	}
+	return mac.String(), nil
+}
+
+// clientIDKey returns the reservation key of a client identifier
+func clientIDKey(id []byte) string {
+	return clientIDKeyPrefix + net.HardwareAddr(id).String()
+}
+
+// hostnameKey returns the reservation key of a sanitized hostname
+func hostnameKey(hostname string) string {
+	return hostnameKeyPrefix + strings.ToLower(hostname)
+}
+
+// reservationFor returns the reservation of the client and its key. A reservation
+// of the client identifier takes precedence over one of the MAC, and both over one
+// of the hostname, which only applies with trust_hostnames. A hostname reservation
+// whose address is actively leased to another MAC under the same hostname is refused,
+// so a second client claiming the name is allocated dynamically. The caller must hold
+// s.mutex.
+func (s *DHCPServer) reservationFor(macStr string, clientID []byte, hostname string) (*reservation, string) {
+	if len(clientID) > 0 {
+		key := clientIDKey(clientID)
+		if res, exists := s.reservations[key]; exists {
+			return res, key
+		}
+	}
+	if res, exists := s.reservations[macStr]; exists {
+		return res, macStr
+	}
+	if hostname == "" || !s.subnetConfig.TrustHostnames {
+		return nil, ""
+	}
+	key := hostnameKey(hostname)
+	res, exists := s.reservations[key]
+	if !exists {
+		return nil, ""
+	}
+	for _, lease := range s.leases.ByIP(res.ip) {
+		if lease.MAC.String() != macStr && lease.Reservation == key && s.clock.Now().Before(lease.ExpiresAt) {
+			log.Printf("Warning: %s claims hostname %s, reserved and still leased to %s; allocating dynamically", macStr, hostname, lease.MAC)
+			return nil, ""
+		}
+	}
+	return res, key
+}
+
+// prefixReservation confines the clients whose MAC starts with prefix to a range
+type prefixReservation struct {
+	prefix string       // Normalized, 3 to 5 octets
+	pool   *addressPool // Carved out of the subnet pool
+	host   *reservation // Per-host settings; ip is unused
+}
+
+// parsePrefixReservations validates the reservations keyed by a MAC prefix, whose ip
+// is a range inside network that overlaps neither the given class pools nor another
+// prefix's range. Reserved addresses are left out of the ranges. The result is
+// ordered longest prefix first, so the first match is the most specific one.
+func parsePrefixReservations(configs map[string]ReservationConfig, network *net.IPNet, reserved []net.IP, classPools []*addressPool) ([]*prefixReservation, error) {
+	prefixes := []*prefixReservation{}
+	for key, cfg := range configs {
+		prefix, isPrefix := parseMACPrefix(key)
+		if !isPrefix {
+			continue
+		}
+		startIP, endIP, err := parseRange(cfg.IP)
+		if err != nil {
+			return nil, fmt.Errorf("reservation for prefix %s: %w", key, err)
+		}
+		if !network.Contains(startIP) || !network.Contains(endIP) {
+			return nil, fmt.Errorf("reservation for prefix %s: range %s is outside network %s", key, cfg.IP, network)
+		}
+		if cfg.Hostname != "" {
+			return nil, fmt.Errorf("reservation for prefix %s: hostname can not be shared by several clients", key)
+		}
+		if cfg.LeaseDuration < 0 {
+			return nil, fmt.Errorf("reservation for prefix %s: lease_duration must not be negative", key)
+		}
+		options, err := parseCustomOptions(cfg.Options)
+		if err != nil {
+			return nil, fmt.Errorf("reservation for prefix %s: %w", key, err)
+		}
+		gateway, err := parseReservationGateway(cfg.Gateway, network)
+		if err != nil {
+			return nil, fmt.Errorf("reservation for prefix %s: %w", key, err)
+		}
+		pr := &prefixReservation{
+			prefix: prefix,
+			pool:   newAddressPool(startIP, endIP, reserved, nil),
+			host: &reservation{
+				gateway:       gateway,
+				dnsServers:    parseIPs(cfg.DNSServers),
+				leaseDuration: time.Duration(cfg.LeaseDuration) * time.Second,
+				bootFile:      cfg.BootFile,
+				options:       options,
+				domain:        cfg.Domain,
+			},
+		}
+		for _, other := range prefixes {
+			if other.prefix == prefix {
+				return nil, fmt.Errorf("prefix %s is reserved twice", prefix)
+			}
+			if other.pool.overlaps(pr.pool) {
+				return nil, fmt.Errorf("reservation for prefix %s: range %s overlaps the range of prefix %s", key, cfg.IP, other.prefix)
+			}
+		}
+		for _, pool := range classPools {
+			if pool.overlaps(pr.pool) {
+				return nil, fmt.Errorf("reservation for prefix %s: range %s overlaps a class range", key, cfg.IP)
+			}
+		}
+		prefixes = append(prefixes, pr)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if len(prefixes[i].prefix) != len(prefixes[j].prefix) {
+			return len(prefixes[i].prefix) > len(prefixes[j].prefix)
+		}
+		return prefixes[i].prefix < prefixes[j].prefix
+	})
+	return prefixes, nil
+}
+
+// prefixReservationFor returns the prefix reservation with the longest prefix of mac,
+// or nil if none matches
+func (s *DHCPServer) prefixReservationFor(mac string) *prefixReservation {
+	for _, pr := range s.prefixReservations {
+		if strings.HasPrefix(mac, pr.prefix) {
+			return pr
+		}
+	}
+	return nil
+}
+
+// leaseOverride is a lease_overrides entry
+type leaseOverride struct {
+	prefix        string // Normalized full MAC or prefix of 3 to 5 octets
+	leaseDuration time.Duration
+}
+
+// parseLeaseOverrides validates lease_overrides, ordered longest prefix first so the
+// first match is the most specific one
+func parseLeaseOverrides(configs map[string]int) ([]leaseOverride, error) {
+	overrides := make([]leaseOverride, 0, len(configs))
+	for key, seconds := range configs {
+		b, err := parseMACBytes(key)
+		if err != nil || len(b) < 3 || len(b) > 6 {
+			return nil, fmt.Errorf("invalid lease_overrides key %q: expected a MAC address or a prefix of 3 to 5 octets", key)
+		}
+		if seconds <= 0 {
+			return nil, fmt.Errorf("lease_overrides for %s: lease duration must be a positive number of seconds", key)
+		}
+		overrides = append(overrides, leaseOverride{prefix: net.HardwareAddr(b).String(), leaseDuration: time.Duration(seconds) * time.Second})
+	}
+	sort.Slice(overrides, func(i, j int) bool {
+		if len(overrides[i].prefix) != len(overrides[j].prefix) {
+			return len(overrides[i].prefix) > len(overrides[j].prefix)
+		}
+		return overrides[i].prefix < overrides[j].prefix
+	})
+	for i := 1; i < len(overrides); i++ {
+		if overrides[i].prefix == overrides[i-1].prefix {
+			return nil, fmt.Errorf("lease_overrides lists %s twice", overrides[i].prefix)
+		}
+	}
+	return overrides, nil
+}
+
+// leaseOverrideFor returns the lease duration of the most specific lease_overrides
+// entry matching mac, or 0 if none does
+func (s *DHCPServer) leaseOverrideFor(mac string) time.Duration {
+	for _, o := range s.leaseOverrides {
+		if strings.HasPrefix(mac, o.prefix) {
+			return o.leaseDuration
+		}
+	}
+	return 0
+}
+
+// errReservationConflict is returned when a reservation would collide with another client
+var errReservationConflict = errors.New("reservation conflict")
+
+// AddReservation reserves ip for mac at runtime in the subnet containing it. The
+// address must be neither reserved for nor actively leased to another client; it is
+// removed from the dynamic pool.
+func (s *DHCPServer) AddReservation(mac net.HardwareAddr, ip net.IP) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	defer s.checkUtilization()
+
+	ip = ip.To4()
+	var owner *DHCPServer
+	if ip != nil {
+		owner = s.subnetFor(ip)
+	}
+	if owner == nil {
+		if len(s.subnets) == 1 {
+			return fmt.Errorf("address is not inside network %s", s.network)
+		}
+		return fmt.Errorf("address is not inside any served network")
+	}
+	return owner.addReservation(mac, ip)
+}
+
+// addReservation is AddReservation for ip inside the network of s. The caller must
+// hold s.mutex.
+func (s *DHCPServer) addReservation(mac net.HardwareAddr, ip net.IP) error {
+	macStr := mac.String()
+	if err := checkReservedAddress(macStr, ip, s.network, s.routers, s.exclusions, s.patternReservations); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidReservation, err)
+	}
+	for otherMac, res := range s.reservations {
+		if otherMac != macStr && res.ip.Equal(ip) {
+			return fmt.Errorf("%w: %s is already reserved for %s", errReservationConflict, ip, otherMac)
+		}
+	}
+	for _, lease := range s.leases.ByIP(ip) {
+		if otherMac := lease.MAC.String(); otherMac != macStr {
+			if s.clock.Now().Before(lease.ExpiresAt) {
+				return fmt.Errorf("%w: %s is leased to %s", errReservationConflict, ip, otherMac)
+			}
+			s.leases.Delete(otherMac)
+		}
+	}
+
+	// Free the client's current dynamic address and pull the reserved one out of the pool
+	if lease, exists := s.leases.Get(macStr); exists && !lease.IP.Equal(ip) {
+		if !s.ownerOf(lease.IP).isReservedIP(lease.IP) {
+			s.releaseIP(lease.IP)
+		}
+		s.leases.Delete(macStr)
+	}
+	if pool := s.poolFor(ip); pool != nil {
+		pool.takeIP(ip)
+	}
+
+	if old, exists := s.reservations[macStr]; exists && !old.ip.Equal(ip) {
+		s.unreserveIP(old.ip)
+		s.releaseIP(old.ip)
+	}
+	s.reservations[macStr] = &reservation{ip: ip}
+	log.Printf("Added reservation %s -> %s", macStr, ip)
+	return nil
+}
+
+// RemoveReservation deletes the reservation of mac at runtime, in whichever subnet
+// holds it. An active lease on the address is kept until it expires; otherwise the
+// address returns to the pool.
+func (s *DHCPServer) RemoveReservation(mac net.HardwareAddr) (net.IP, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	defer s.checkUtilization()
+
+	macStr := mac.String()
+	var res *reservation
+	for _, subnet := range s.subnets {
+		if r, exists := subnet.reservations[macStr]; exists {
+			res = r
+			delete(subnet.reservations, macStr)
+			break
+		}
+	}
+	if res == nil {
+		return nil, false
+	}
+
+	s.ownerOf(res.ip).unreserveIP(res.ip)
+	if len(s.leases.ByIP(res.ip)) == 0 {
+		s.releaseIP(res.ip)
+	}
+	log.Printf("Removed reservation %s -> %s", macStr, res.ip)
+	return res.ip, true
+}
+
+// unreserveIP lets the address of a deleted reservation return to its pool once it
+// is released. Addresses reserved in the config were excluded from the pool at
+// startup rather than taken, so they are included again unless excluded for another
+// reason.
+func (s *DHCPServer) unreserveIP(ip net.IP) {
+	pool := s.poolFor(ip)
+	if pool == nil {
+		return
+	}
+	if off, ok := pool.offset(ip); ok && !s.isExcluded(ip) && !s.isInfrastructure(ip) {
+		pool.include(off)
+	}
+}
+
+// PinLease turns the active lease of mac into a reservation of its address, so the
+// client keeps it for good and its renewals are served as reserved. The address was
+// already taken from the dynamic pool by the lease and stays out of it. Pinning a
+// lease that is already held through a reservation of its MAC returns its address.
+func (s *DHCPServer) PinLease(mac net.HardwareAddr) (net.IP, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	defer s.checkUtilization()
+
+	macStr := mac.String()
+	lease, exists := s.leases.Get(macStr)
+	if !exists || lease.offered() || !s.clock.Now().Before(lease.ExpiresAt) {
+		return nil, fmt.Errorf("%w: %s", errLeaseNotFound, macStr)
+	}
+	owner := s.ownerOf(lease.IP)
+	if res, reserved := owner.reservations[macStr]; reserved && res.ip.Equal(lease.IP) {
+		return lease.IP, nil
+	}
+	if err := owner.addReservation(mac, lease.IP); err != nil {
+		return nil, err
+	}
+	log.Printf("Pinned lease of %s on %s", macStr, lease.IP)
+	return lease.IP, nil
+}
+
+// loadReservationsFile reads reservations saved at runtime. A missing file is not an error.
+func loadReservationsFile(path string) (map[string]ReservationConfig, error) {
+	reservations := make(map[string]ReservationConfig)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return reservations, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reservations file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &reservations); err != nil {
+		return nil, fmt.Errorf("failed to parse reservations file: %w", err)
+	}
+	if reservations == nil {
+		reservations = make(map[string]ReservationConfig)
+	}
+	return reservations, nil
+}
+
+// saveReservationsFile atomically replaces the reservations file
+func saveReservationsFile(path string, reservations map[string]ReservationConfig) error {
+	data, err := yaml.Marshal(reservations)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write reservations file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write reservations file: %w", err)
+	}
+	return nil
+}
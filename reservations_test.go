@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBrokenReservations checks that startup fails on every broken reservation with
+// an error naming the offending entry
+func TestBrokenReservations(t *testing.T) {
+	const mac, other = "aa:bb:cc:00:00:01", "aa:bb:cc:00:00:02"
+	for _, tc := range []struct {
+		name         string
+		reservations map[string]ReservationConfig
+		want         []string // Substrings of the error, the first naming the entry
+	}{
+		{"outside the network", map[string]ReservationConfig{mac: {IP: "10.1.0.5"}}, []string{mac, "outside network"}},
+		{"IPv6 address", map[string]ReservationConfig{mac: {IP: "fe80::1"}}, []string{mac, "outside network"}},
+		{"network address", map[string]ReservationConfig{mac: {IP: "10.0.0.0"}}, []string{mac, "network or broadcast"}},
+		{"broadcast address", map[string]ReservationConfig{mac: {IP: "10.0.255.255"}}, []string{mac, "network or broadcast"}},
+		{"gateway address", map[string]ReservationConfig{mac: {IP: "10.0.0.1"}}, []string{mac, "is the gateway"}},
+		{"excluded address", map[string]ReservationConfig{mac: {IP: "10.0.0.205"}}, []string{mac, "exclusion 10.0.0.201-10.0.0.210"}},
+		{"pattern address", map[string]ReservationConfig{mac: {IP: "10.0.5.30"}, "02:00:00:aa:bb:*": {IP: "10.0.5.<byte6>"}}, []string{mac, "pattern reservation"}},
+		{"unparsable address", map[string]ReservationConfig{mac: {IP: "10.0.0.300"}}, []string{mac, "invalid reserved IP"}},
+		{"duplicate address", map[string]ReservationConfig{mac: {IP: "10.0.0.20"}, other: {IP: "10.0.0.20"}}, []string{other, "already reserved for " + mac}},
+		{"duplicate address across a client-id", map[string]ReservationConfig{mac: {IP: "10.0.0.20"}, "id:01:02:03": {IP: "10.0.0.20"}}, []string{"id:01:02:03", "already reserved for " + mac}},
+		{"same MAC spelled twice", map[string]ReservationConfig{mac: {IP: "10.0.0.20"}, "AA-BB-CC-00-00-01": {IP: "10.0.0.21"}}, []string{mac, "reserved twice"}},
+		{"garbage key", map[string]ReservationConfig{"not-a-mac": {IP: "10.0.0.20"}}, []string{"not-a-mac", "invalid reservation key"}},
+		{"EUI-64 key", map[string]ReservationConfig{"aa:bb:cc:dd:ee:ff:00:11": {IP: "10.0.0.20"}}, []string{"aa:bb:cc:dd:ee:ff:00:11", "invalid reservation key"}},
+		{"client-id not in hex", map[string]ReservationConfig{"id:zz": {IP: "10.0.0.20"}}, []string{"id:zz", "client identifier in hex"}},
+		{"empty text client-id", map[string]ReservationConfig{"id-text:": {IP: "10.0.0.20"}}, []string{"id-text:", "empty client identifier"}},
+		{"negative lease duration", map[string]ReservationConfig{mac: {IP: "10.0.0.20", LeaseDuration: -1}}, []string{mac, "lease_duration"}},
+		{"invalid hostname", map[string]ReservationConfig{mac: {IP: "10.0.0.20", Hostname: "bad_host"}}, []string{mac, "invalid hostname"}},
+		{"gateway outside the network", map[string]ReservationConfig{mac: {IP: "10.0.0.20", Gateway: "10.1.0.1"}}, []string{mac, "outside network"}},
+		{"managed option", map[string]ReservationConfig{mac: {IP: "10.0.0.20", Options: []CustomOptionConfig{{Code: 53, Value: StringList{"1"}}}}}, []string{mac, "managed by the server"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testSubnetConfig()
+			cfg.Network = "10.0.0.0/16"
+			cfg.Exclusions = []string{"10.0.0.201-10.0.0.210"}
+			cfg.ReservedAddresses = tc.reservations
+			_, err := NewDHCPServer(cfg)
+			if err == nil {
+				t.Fatal("startup succeeded")
+			}
+			if !errors.Is(err, ErrInvalidReservation) {
+				t.Errorf("error %q does not wrap ErrInvalidReservation", err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+// TestSentinelErrors checks that errors.Is finds the sentinel errors through the
+// details wrapped around them in the config, reservation and allocation paths, and
+// only there
+func TestSentinelErrors(t *testing.T) {
+	newServer := func() *DHCPServer {
+		cfg := testSubnetConfig()
+		cfg.Network = "10.0.0.0/16"
+		cfg.Range = StringList{"10.0.0.10-10.0.0.11"}
+		cfg.ReservedAddresses = map[string]ReservationConfig{
+			testMAC(1).String(): {IP: "10.0.0.20"},
+			"02:00:00:aa:bb:*":  {IP: "10.0.5.<byte6>"},
+		}
+		return newTestServer(t, cfg)
+	}
+	for _, tc := range []struct {
+		name      string
+		err       func() error
+		exhausted bool
+		invalid   bool
+		conflict  bool
+	}{
+		{
+			name: "pool exhausted",
+			err: func() error {
+				s := newServer()
+				s.AllocateFor(testMAC(2))
+				s.AllocateFor(testMAC(3))
+				_, err := s.AllocateFor(testMAC(4))
+				return err
+			},
+			exhausted: true,
+		},
+		{
+			name: "reservation outside the network at allocation",
+			err: func() error {
+				s := newServer()
+				s.mutex.Lock()
+				s.reservations[testMAC(1).String()].ip = net.IPv4(10, 1, 0, 5).To4()
+				s.mutex.Unlock()
+				_, err := s.AllocateFor(testMAC(1))
+				return err
+			},
+			invalid: true,
+		},
+		{
+			name: "broken reservation in the config",
+			err: func() error {
+				cfg := testSubnetConfig()
+				cfg.ReservedAddresses = map[string]ReservationConfig{testMAC(1).String(): {IP: "10.0.0.1"}}
+				_, err := NewDHCPServer(cfg)
+				return err
+			},
+			invalid: true,
+		},
+		{
+			name: "other config error",
+			err: func() error {
+				cfg := testSubnetConfig()
+				cfg.Range = StringList{"10.0.0.200-10.0.0.10"}
+				_, err := NewDHCPServer(cfg)
+				return err
+			},
+		},
+		{
+			name:    "runtime reservation of the gateway",
+			err:     func() error { return newServer().AddReservation(testMAC(2), net.IPv4(10, 0, 0, 1)) },
+			invalid: true,
+		},
+		{
+			name:     "runtime reservation of a pattern address",
+			err:      func() error { return newServer().AddReservation(testMAC(2), net.IPv4(10, 0, 5, 30)) },
+			invalid:  true,
+			conflict: true,
+		},
+		{
+			name:     "runtime reservation of a reserved address",
+			err:      func() error { return newServer().AddReservation(testMAC(2), net.IPv4(10, 0, 0, 20)) },
+			conflict: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.err()
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if errors.Is(err, ErrPoolExhausted) != tc.exhausted {
+				t.Errorf("errors.Is(%q, ErrPoolExhausted) = %v", err, !tc.exhausted)
+			}
+			if errors.Is(err, ErrInvalidReservation) != tc.invalid {
+				t.Errorf("errors.Is(%q, ErrInvalidReservation) = %v", err, !tc.invalid)
+			}
+			if errors.Is(err, errReservationConflict) != tc.conflict {
+				t.Errorf("errors.Is(%q, errReservationConflict) = %v", err, !tc.conflict)
+			}
+		})
+	}
+}
+
+// TestRemoveReservationFreesAddress removes a reservation from the config of a pool
+// that has no other free address and allocates the address to another client
+func TestRemoveReservationFreesAddress(t *testing.T) {
+	reserved := net.IPv4(10, 0, 0, 11).To4()
+	for _, leased := range []bool{false, true} {
+		cfg := testSubnetConfig()
+		cfg.Range = StringList{"10.0.0.10-10.0.0.11"}
+		cfg.ReservedAddresses = map[string]ReservationConfig{testMAC(1).String(): {IP: reserved.String()}}
+		s, clock := newClockedServer(t, cfg)
+		if leased {
+			bind(t, s, testMAC(1), reserved)
+		}
+		if _, err := s.AllocateFor(testMAC(2)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.AllocateFor(testMAC(3)); !errors.Is(err, ErrPoolExhausted) {
+			t.Fatalf("leased %v: allocated past the reserved address: %v", leased, err)
+		}
+
+		if ip, ok := s.RemoveReservation(testMAC(1)); !ok || !ip.Equal(reserved) {
+			t.Fatalf("leased %v: removed %s, %v", leased, ip, ok)
+		}
+		if leased {
+			// The lease keeps the address until it ends
+			if _, err := s.AllocateFor(testMAC(3)); !errors.Is(err, ErrPoolExhausted) {
+				t.Fatalf("got the address of an active lease: %v", err)
+			}
+			clock.Advance(time.Hour + time.Second)
+			s.reapExpired(clock.Now())
+		}
+		ip, err := s.AllocateFor(testMAC(3))
+		if err != nil {
+			t.Fatalf("leased %v: allocating after the removal: %v", leased, err)
+		}
+		if !ip.Equal(reserved) {
+			t.Errorf("leased %v: allocated %s, want %s", leased, ip, reserved)
+		}
+	}
+}
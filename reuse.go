@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// cooledAddress is a reclaimed pool address waiting out reuse_delay
+type cooledAddress struct {
+	off         uint32
+	reclaimedAt time.Time
+}
+
+// recycle returns ip to the pool after the pool's reuse delay, so it is not handed
+// to a new client right after its previous lease ended. Until then only takeIP, used
+// for clients returning to their own address, or a pool under pressure can claim it.
+// Without a reuse delay it is the same as release.
+func (p *addressPool) recycle(ip net.IP, reclaimedAt time.Time) {
+	if p.reuseDelay <= 0 {
+		p.release(ip)
+		return
+	}
+	off, ok := p.offset(ip)
+	if !ok || p.excluded.has(off) || p.isCooling(off) {
+		return
+	}
+	if !p.taken.has(off) {
+		p.allocate(off)
+	}
+	p.cooling[off] = reclaimedAt
+	p.coolQueue = append(p.coolQueue, cooledAddress{off: off, reclaimedAt: reclaimedAt})
+}
+
+// isCooling reports whether the address at off is cooling down
+func (p *addressPool) isCooling(off uint32) bool {
+	_, cooling := p.cooling[off]
+	return cooling
+}
+
+// current reports whether entry still describes a cooling address; entries go stale
+// when their address is claimed, and a later reclaim queues a new entry
+func (p *addressPool) current(entry cooledAddress) bool {
+	at, cooling := p.cooling[entry.off]
+	return cooling && at.Equal(entry.reclaimedAt)
+}
+
+// warm returns the addresses that have cooled down by now to the free ones
+func (p *addressPool) warm(now time.Time) {
+	for len(p.coolQueue) > 0 {
+		entry := p.coolQueue[0]
+		current := p.current(entry)
+		if current && now.Sub(entry.reclaimedAt) < p.reuseDelay {
+			return
+		}
+		p.coolQueue = p.coolQueue[1:]
+		if current {
+			p.release(p.ipAt(entry.off))
+		}
+	}
+}
+
+// underPressure reports whether so much of the pool is in use that cooling addresses
+// are handed out before the reuse delay ends
+func (p *addressPool) underPressure() bool {
+	if len(p.cooling) == 0 {
+		return false
+	}
+	return p.available == 0 || (p.capacity-p.available)*100 >= p.reusePressure*p.capacity
+}
+
+// takeCooling takes the address that has been cooling down longest, or nil if none is
+func (p *addressPool) takeCooling() net.IP {
+	for len(p.coolQueue) > 0 {
+		entry := p.coolQueue[0]
+		p.coolQueue = p.coolQueue[1:]
+		if p.current(entry) {
+			p.stopCooling(entry.off)
+			return p.ipAt(entry.off)
+		}
+	}
+	return nil
+}
+
+// stopCooling hands the cooling address at off out again; it stays taken
+func (p *addressPool) stopCooling(off uint32) {
+	delete(p.cooling, off)
+}
+
+// coolingAddresses returns the pool's cooling addresses, oldest first
+func (p *addressPool) coolingAddresses() []cooledAddress {
+	cooling := make([]cooledAddress, 0, len(p.cooling))
+	for _, entry := range p.coolQueue {
+		if p.current(entry) {
+			cooling = append(cooling, entry)
+		}
+	}
+	return cooling
+}
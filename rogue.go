@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+)
+
+// rogueProbeTimeout is how long detectRogueServers waits for OFFERs
+const rogueProbeTimeout = 3 * time.Second
+
+// detectRogueServers broadcasts a DISCOVER from a random locally administered MAC on
+// iface and returns the server identifiers of every OFFER received other than self.
+// It must run before the server binds port 67, since it listens on the client port.
+func detectRogueServers(iface string, self net.IP, timeout time.Duration) ([]net.IP, error) {
+	mac := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(mac); err != nil {
+		return nil, err
+	}
+	mac[0] = (mac[0] | 0x02) &^ 0x01 // Locally administered, unicast
+
+	discover, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithBroadcast(true))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := server4.NewIPv4UDPConn(iface, &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open client socket on %s: %w", iface, err)
+	}
+	defer conn.Close()
+
+	dest := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ServerPort}
+	if _, err := conn.WriteTo(discover.ToBytes(), dest); err != nil {
+		return nil, fmt.Errorf("failed to send probe DISCOVER: %w", err)
+	}
+
+	rogues := []net.IP{}
+	seen := make(map[string]struct{})
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return rogues, nil
+			}
+			return nil, err
+		}
+		offer, err := dhcpv4.FromBytes(buf[:n])
+		if err != nil || offer.TransactionID != discover.TransactionID || offer.MessageType() != dhcpv4.MessageTypeOffer {
+			continue
+		}
+
+		serverID := offer.ServerIdentifier()
+		if serverID == nil {
+			if udpPeer, ok := peer.(*net.UDPAddr); ok {
+				serverID = udpPeer.IP
+			}
+		}
+		if serverID == nil || serverID.Equal(self) {
+			continue
+		}
+		if _, exists := seen[serverID.String()]; exists {
+			continue
+		}
+		seen[serverID.String()] = struct{}{}
+		log.Printf("Warning: another DHCP server %s offered %s on %s", serverID, offer.YourIPAddr, iface)
+		rogues = append(rogues, serverID)
+	}
+}
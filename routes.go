@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// StaticRouteConfig defines a route advertised to clients in option 121
+type StaticRouteConfig struct {
+	Destination string `yaml:"destination"`
+	Gateway     string `yaml:"gateway"`
+}
+
+// parseStaticRoutes validates the configured static routes
+func parseStaticRoutes(configs []StaticRouteConfig) ([]*dhcpv4.Route, error) {
+	routes := []*dhcpv4.Route{}
+	for _, cfg := range configs {
+		_, dest, err := net.ParseCIDR(cfg.Destination)
+		if err != nil || dest.IP.To4() == nil {
+			return nil, fmt.Errorf("static route: invalid IPv4 destination %q", cfg.Destination)
+		}
+		router := net.ParseIP(cfg.Gateway).To4()
+		if router == nil {
+			return nil, fmt.Errorf("static route to %s: invalid IPv4 gateway %q", cfg.Destination, cfg.Gateway)
+		}
+		routes = append(routes, &dhcpv4.Route{Dest: dest, Router: router})
+	}
+	return routes, nil
+}
+
+// classlessRoutes returns the routes to send in option 121. Clients that accept
+// option 121 ignore option 3 (RFC 3442), so a default route via gateway is added
+// unless the configured routes already contain one.
+func classlessRoutes(routes []*dhcpv4.Route, gateway net.IP) []*dhcpv4.Route {
+	if gateway == nil || gateway.To4() == nil {
+		return routes
+	}
+	for _, route := range routes {
+		if ones, _ := route.Dest.Mask.Size(); ones == 0 {
+			return routes
+		}
+	}
+	defaultRoute := &dhcpv4.Route{
+		Dest:   &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		Router: gateway.To4(),
+	}
+	return append(append([]*dhcpv4.Route{}, routes...), defaultRoute)
+}
+
+// classfulRoutes encodes the host (/32) routes as option 33 destination/router pairs,
+// returning nil if there are none. Option 33 cannot express other prefix lengths.
+func classfulRoutes(routes []*dhcpv4.Route) []byte {
+	var data []byte
+	for _, route := range routes {
+		if ones, _ := route.Dest.Mask.Size(); ones == 32 {
+			data = append(data, route.Dest.IP.To4()...)
+			data = append(data, route.Router.To4()...)
+		}
+	}
+	return data
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// TestClasslessRoutesRoundTrip serves a configured route in option 121 and decodes it
+// from the reply bytes. Each route is also compared against its hand-encoded RFC 3442
+// descriptor: the prefix length, then only the significant octets of the destination,
+// then the router.
+func TestClasslessRoutesRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		route  StaticRouteConfig
+		wire   []byte
+		routes []string // Decoded as destination via router
+	}{
+		{
+			name:   "prefix 0",
+			route:  StaticRouteConfig{Destination: "0.0.0.0/0", Gateway: "10.0.0.254"},
+			wire:   []byte{0, 10, 0, 0, 254},
+			routes: []string{"0.0.0.0/0 via 10.0.0.254"},
+		},
+		{
+			name:   "prefix 24",
+			route:  StaticRouteConfig{Destination: "192.168.5.0/24", Gateway: "10.0.0.2"},
+			wire:   []byte{24, 192, 168, 5, 10, 0, 0, 2, 0, 10, 0, 0, 1},
+			routes: []string{"192.168.5.0/24 via 10.0.0.2", "0.0.0.0/0 via 10.0.0.1"},
+		},
+		{
+			name:   "prefix 32",
+			route:  StaticRouteConfig{Destination: "172.16.1.9/32", Gateway: "10.0.0.3"},
+			wire:   []byte{32, 172, 16, 1, 9, 10, 0, 0, 3, 0, 10, 0, 0, 1},
+			routes: []string{"172.16.1.9/32 via 10.0.0.3", "0.0.0.0/0 via 10.0.0.1"},
+		},
+		{
+			name:   "prefix 12 keeps two octets",
+			route:  StaticRouteConfig{Destination: "172.16.0.0/12", Gateway: "10.0.0.4"},
+			wire:   []byte{12, 172, 16, 10, 0, 0, 4, 0, 10, 0, 0, 1},
+			routes: []string{"172.16.0.0/12 via 10.0.0.4", "0.0.0.0/0 via 10.0.0.1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testSubnetConfig()
+			cfg.StaticRoutes = []StaticRouteConfig{tc.route}
+			s := newTestServer(t, cfg)
+			offer := serve(t, s, newDiscover(t, testMAC(1)))
+			if offer == nil {
+				t.Fatal("got no OFFER")
+			}
+			reply, err := dhcpv4.FromBytes(offer.ToBytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wire := reply.Options.Get(dhcpv4.OptionClasslessStaticRoute)
+			if !bytes.Equal(wire, tc.wire) {
+				t.Errorf("option 121 is % d, want % d", wire, tc.wire)
+			}
+			var routes dhcpv4.Routes
+			if err := routes.FromBytes(wire); err != nil {
+				t.Fatalf("decoding option 121: %v", err)
+			}
+			if len(routes) != len(tc.routes) {
+				t.Fatalf("decoded %v, want %v", routes, tc.routes)
+			}
+			for i, route := range routes {
+				if got := route.Dest.String() + " via " + route.Router.String(); got != tc.routes[i] {
+					t.Errorf("route %d is %s, want %s", i, got, tc.routes[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefixes of secret values kept outside the config file
+const (
+	secretEnvPrefix  = "env:"
+	secretFilePrefix = "file:"
+)
+
+// resolveSecret returns value, or for "env:VAR" the environment variable VAR and for
+// "file:/path" the contents of the file without trailing newlines. A variable that is
+// unset or empty and a file that can not be read are errors naming field.
+func resolveSecret(field, value string) (string, error) {
+	if name, ok := strings.CutPrefix(value, secretEnvPrefix); ok {
+		secret := os.Getenv(name)
+		if secret == "" {
+			return "", fmt.Errorf("%s: environment variable %s is not set", field, name)
+		}
+		return secret, nil
+	}
+	if path, ok := strings.CutPrefix(value, secretFilePrefix); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s: failed to read secret: %w", field, err)
+		}
+		secret := strings.TrimRight(string(data), "\r\n")
+		if secret == "" {
+			return "", fmt.Errorf("%s: secret file %s is empty", field, path)
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+// resolveSecrets replaces the env: and file: references of the sensitive fields with
+// the secrets they name
+func (c *Config) resolveSecrets() error {
+	var err error
+	if c.APIToken, err = resolveSecret("api_token", c.APIToken); err != nil {
+		return err
+	}
+	if c.WebhookURL, err = resolveSecret("webhook_url", c.WebhookURL); err != nil {
+		return err
+	}
+	if c.DDNS != nil && c.DDNS.Key != nil {
+		if c.DDNS.Key.Secret, err = resolveSecret("ddns key secret", c.DDNS.Key.Secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema holds the current bindings, the lease history, declined addresses and
+// the addresses each client held before, most recent at position 0. Times are Unix
+// seconds.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS leases (
+	mac         TEXT PRIMARY KEY,
+	ip          TEXT NOT NULL,
+	expires_at  INTEGER NOT NULL,
+	class       TEXT NOT NULL DEFAULT '',
+	offered     INTEGER NOT NULL DEFAULT 0,
+	fingerprint TEXT NOT NULL DEFAULT '',
+	hostname    TEXT NOT NULL DEFAULT '',
+	fqdn        TEXT NOT NULL DEFAULT '',
+	started_at  INTEGER NOT NULL DEFAULT 0,
+	lease_time  INTEGER NOT NULL DEFAULT 0,
+	reservation TEXT NOT NULL DEFAULT '',
+	state       TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS lease_history (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	mac        TEXT NOT NULL,
+	ip         TEXT NOT NULL,
+	event      TEXT NOT NULL,
+	at         INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS lease_history_mac ON lease_history (mac);
+CREATE INDEX IF NOT EXISTS lease_history_ip ON lease_history (ip);
+CREATE TABLE IF NOT EXISTS declined (
+	ip          TEXT PRIMARY KEY,
+	declined_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS address_history (
+	mac         TEXT NOT NULL,
+	position    INTEGER NOT NULL,
+	ip          TEXT NOT NULL,
+	released_at INTEGER NOT NULL,
+	PRIMARY KEY (mac, position)
+);
+`
+
+// sqliteBackend keeps leases in a SQLite database. Each sync writes only the
+// bindings that changed since the previous one and appends them to the history.
+type sqliteBackend struct {
+	db              *sql.DB
+	upsertLease     *sql.Stmt
+	deleteLease     *sql.Stmt
+	insertHistory   *sql.Stmt
+	upsertDeclined  *sql.Stmt
+	deleteDeclined  *sql.Stmt
+	insertPast      *sql.Stmt
+	deletePast      *sql.Stmt
+	written         map[string]Lease         // Leases as of the last sync
+	writtenDeclined map[string]time.Time     // Declined addresses as of the last sync
+	writtenHistory  map[string][]pastAddress // Address history as of the last sync
+}
+
+// openSQLiteBackend opens or creates the database at path
+func openSQLiteBackend(path string) (*sqliteBackend, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lease database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if err := checkSQLiteVersion(db, path); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec("PRAGMA journal_mode = WAL; PRAGMA synchronous = NORMAL;" + sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize lease database: %w", err)
+	}
+	// Leases of version 1 have no state column; it is added and derived from offered on load
+	if err := addMissingColumns(db, "leases", sqliteLeaseColumns); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to upgrade lease database: %w", err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", leaseStoreVersion)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to upgrade lease database: %w", err)
+	}
+
+	b := &sqliteBackend{db: db}
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&b.upsertLease, `INSERT INTO leases (mac, ip, expires_at, class, offered, fingerprint, hostname, fqdn, started_at, lease_time, reservation, state)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (mac) DO UPDATE SET ip = excluded.ip, expires_at = excluded.expires_at,
+				class = excluded.class, offered = excluded.offered, fingerprint = excluded.fingerprint,
+				hostname = excluded.hostname, fqdn = excluded.fqdn, started_at = excluded.started_at,
+				lease_time = excluded.lease_time, reservation = excluded.reservation, state = excluded.state`},
+		{&b.deleteLease, `DELETE FROM leases WHERE mac = ?`},
+		{&b.insertHistory, `INSERT INTO lease_history (mac, ip, event, at, expires_at) VALUES (?, ?, ?, ?, ?)`},
+		{&b.upsertDeclined, `INSERT INTO declined (ip, declined_at) VALUES (?, ?)
+			ON CONFLICT (ip) DO UPDATE SET declined_at = excluded.declined_at`},
+		{&b.deleteDeclined, `DELETE FROM declined WHERE ip = ?`},
+		{&b.insertPast, `INSERT INTO address_history (mac, position, ip, released_at) VALUES (?, ?, ?, ?)`},
+		{&b.deletePast, `DELETE FROM address_history WHERE mac = ?`},
+	}
+	for _, s := range statements {
+		if *s.stmt, err = db.Prepare(s.query); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to prepare lease database statement: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// load implements leaseBackend
+func (b *sqliteBackend) load() (leaseData, error) {
+	leases := make(map[string]Lease)
+	rows, err := b.db.Query(`SELECT mac, ip, expires_at, class, offered, fingerprint, hostname, fqdn, started_at, lease_time, reservation, state FROM leases`)
+	if err != nil {
+		return leaseData{}, fmt.Errorf("failed to read leases: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mac, ip string
+		var expiresAt, startedAt int64
+		var offered bool
+		var lease Lease
+		if err := rows.Scan(&mac, &ip, &expiresAt, &lease.Class, &offered, &lease.Fingerprint, &lease.Hostname, &lease.FQDN,
+			&startedAt, &lease.LeaseTime, &lease.Reservation, &lease.State); err != nil {
+			return leaseData{}, fmt.Errorf("failed to read leases: %w", err)
+		}
+		if lease.State == "" {
+			// Written before the state was stored
+			lease.State = StateBound
+			if offered {
+				lease.State = StateOffered
+			}
+		}
+		lease.IP = net.ParseIP(ip)
+		lease.ExpiresAt = time.Unix(expiresAt, 0)
+		if startedAt != 0 {
+			lease.StartedAt = time.Unix(startedAt, 0)
+		}
+		leases[mac] = lease
+	}
+	if err := rows.Err(); err != nil {
+		return leaseData{}, fmt.Errorf("failed to read leases: %w", err)
+	}
+
+	declined := make(map[string]time.Time)
+	declinedRows, err := b.db.Query(`SELECT ip, declined_at FROM declined`)
+	if err != nil {
+		return leaseData{}, fmt.Errorf("failed to read declined addresses: %w", err)
+	}
+	defer declinedRows.Close()
+	for declinedRows.Next() {
+		var ip string
+		var declinedAt int64
+		if err := declinedRows.Scan(&ip, &declinedAt); err != nil {
+			return leaseData{}, fmt.Errorf("failed to read declined addresses: %w", err)
+		}
+		declined[ip] = time.Unix(declinedAt, 0)
+	}
+	if err := declinedRows.Err(); err != nil {
+		return leaseData{}, fmt.Errorf("failed to read declined addresses: %w", err)
+	}
+
+	history := make(map[string][]pastAddress)
+	historyRows, err := b.db.Query(`SELECT mac, ip, released_at FROM address_history ORDER BY mac, position`)
+	if err != nil {
+		return leaseData{}, fmt.Errorf("failed to read address history: %w", err)
+	}
+	defer historyRows.Close()
+	for historyRows.Next() {
+		var mac, ip string
+		var releasedAt int64
+		if err := historyRows.Scan(&mac, &ip, &releasedAt); err != nil {
+			return leaseData{}, fmt.Errorf("failed to read address history: %w", err)
+		}
+		history[mac] = append(history[mac], pastAddress{IP: net.ParseIP(ip), ReleasedAt: time.Unix(releasedAt, 0)})
+	}
+	if err := historyRows.Err(); err != nil {
+		return leaseData{}, fmt.Errorf("failed to read address history: %w", err)
+	}
+
+	b.written = leases
+	b.writtenDeclined = declined
+	b.writtenHistory = history
+	return leaseData{leases: leases, declined: declined, history: history}, nil
+}
+
+// sync implements leaseBackend, writing the changes since the last sync in one transaction
+func (b *sqliteBackend) sync(state leaseData) error {
+	leases, declined, history := state.leases, state.declined, state.history
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	upsertLease, deleteLease, insertHistory := tx.Stmt(b.upsertLease), tx.Stmt(b.deleteLease), tx.Stmt(b.insertHistory)
+	for mac, lease := range leases {
+		old, exists := b.written[mac]
+		if exists && reflect.DeepEqual(old, lease) {
+			continue
+		}
+		if _, err := upsertLease.Exec(mac, lease.IP.String(), lease.ExpiresAt.Unix(), lease.Class, lease.offered(),
+			lease.Fingerprint, lease.Hostname, lease.FQDN, unixOrZero(lease.StartedAt), lease.LeaseTime, lease.Reservation, lease.State); err != nil {
+			return fmt.Errorf("failed to write lease of %s: %w", mac, err)
+		}
+		event := "renewed"
+		switch {
+		case lease.offered():
+			event = "offered"
+		case !exists || old.offered() || !old.IP.Equal(lease.IP):
+			event = "bound"
+		case old.ExpiresAt.Equal(lease.ExpiresAt):
+			continue // Only client details changed
+		}
+		if _, err := insertHistory.Exec(mac, lease.IP.String(), event, now.Unix(), lease.ExpiresAt.Unix()); err != nil {
+			return fmt.Errorf("failed to write lease history of %s: %w", mac, err)
+		}
+	}
+	for mac, old := range b.written {
+		if _, exists := leases[mac]; exists {
+			continue
+		}
+		if _, err := deleteLease.Exec(mac); err != nil {
+			return fmt.Errorf("failed to delete lease of %s: %w", mac, err)
+		}
+		event := "removed"
+		if now.After(old.ExpiresAt) {
+			event = "expired"
+		}
+		if _, err := insertHistory.Exec(mac, old.IP.String(), event, now.Unix(), old.ExpiresAt.Unix()); err != nil {
+			return fmt.Errorf("failed to write lease history of %s: %w", mac, err)
+		}
+	}
+
+	upsertDeclined, deleteDeclined := tx.Stmt(b.upsertDeclined), tx.Stmt(b.deleteDeclined)
+	for ip, declinedAt := range declined {
+		if old, exists := b.writtenDeclined[ip]; exists && old.Equal(declinedAt) {
+			continue
+		}
+		if _, err := upsertDeclined.Exec(ip, declinedAt.Unix()); err != nil {
+			return fmt.Errorf("failed to write declined address %s: %w", ip, err)
+		}
+	}
+	for ip := range b.writtenDeclined {
+		if _, exists := declined[ip]; !exists {
+			if _, err := deleteDeclined.Exec(ip); err != nil {
+				return fmt.Errorf("failed to delete declined address %s: %w", ip, err)
+			}
+		}
+	}
+
+	insertPast, deletePast := tx.Stmt(b.insertPast), tx.Stmt(b.deletePast)
+	for mac, past := range history {
+		if old, exists := b.writtenHistory[mac]; exists && reflect.DeepEqual(old, past) {
+			continue
+		}
+		if _, err := deletePast.Exec(mac); err != nil {
+			return fmt.Errorf("failed to write address history of %s: %w", mac, err)
+		}
+		for i, entry := range past {
+			if _, err := insertPast.Exec(mac, i, entry.IP.String(), entry.ReleasedAt.Unix()); err != nil {
+				return fmt.Errorf("failed to write address history of %s: %w", mac, err)
+			}
+		}
+	}
+	for mac := range b.writtenHistory {
+		if _, exists := history[mac]; !exists {
+			if _, err := deletePast.Exec(mac); err != nil {
+				return fmt.Errorf("failed to delete address history of %s: %w", mac, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	b.written = leases
+	b.writtenDeclined = declined
+	b.writtenHistory = history
+	return nil
+}
+
+// close implements leaseBackend
+func (b *sqliteBackend) close() error {
+	return b.db.Close()
+}
+
+// checkSQLiteVersion fails for a database written by a newer server. The format
+// version is kept in user_version, which is 0 in new databases and in version 1.
+func checkSQLiteVersion(db *sql.DB, path string) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read lease database version: %w", err)
+	}
+	if version == 0 {
+		var tables int
+		if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'leases'").Scan(&tables); err != nil {
+			return fmt.Errorf("failed to read lease database version: %w", err)
+		}
+		version = leaseStoreVersion // A new database
+		if tables > 0 {
+			version = 1
+		}
+	}
+	return checkStoreVersion("lease database "+path, version)
+}
+
+// compact implements leaseBackend, replacing the leases, declined addresses and
+// address history in one transaction and then reclaiming the freed space. The lease
+// history is kept as the audit log it is.
+func (b *sqliteBackend) compact(state leaseData) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"leases", "declined", "address_history"} {
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+			return fmt.Errorf("failed to clear %s: %w", table, err)
+		}
+	}
+	upsertLease, upsertDeclined, insertPast := tx.Stmt(b.upsertLease), tx.Stmt(b.upsertDeclined), tx.Stmt(b.insertPast)
+	for mac, lease := range state.leases {
+		if _, err := upsertLease.Exec(mac, lease.IP.String(), lease.ExpiresAt.Unix(), lease.Class, lease.offered(),
+			lease.Fingerprint, lease.Hostname, lease.FQDN, unixOrZero(lease.StartedAt), lease.LeaseTime, lease.Reservation, lease.State); err != nil {
+			return fmt.Errorf("failed to write lease of %s: %w", mac, err)
+		}
+	}
+	for ip, declinedAt := range state.declined {
+		if _, err := upsertDeclined.Exec(ip, declinedAt.Unix()); err != nil {
+			return fmt.Errorf("failed to write declined address %s: %w", ip, err)
+		}
+	}
+	for mac, past := range state.history {
+		for i, entry := range past {
+			if _, err := insertPast.Exec(mac, i, entry.IP.String(), entry.ReleasedAt.Unix()); err != nil {
+				return fmt.Errorf("failed to write address history of %s: %w", mac, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	b.written = state.leases
+	b.writtenDeclined = state.declined
+	b.writtenHistory = state.history
+	if _, err := b.db.Exec("VACUUM"); err != nil {
+		log.Printf("Warning: failed to vacuum lease database: %v", err)
+	}
+	return nil
+}
+
+// sqliteLeaseColumns are the columns of the leases table added after it was first
+// created, with their definitions
+var sqliteLeaseColumns = [][2]string{
+	{"started_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"lease_time", "INTEGER NOT NULL DEFAULT 0"},
+	{"reservation", "TEXT NOT NULL DEFAULT ''"},
+	{"state", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// addMissingColumns adds the columns a database created by an older version lacks
+func addMissingColumns(db *sql.DB, table string, columns [][2]string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if existing[column[0]] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column[0], column[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unixOrZero returns t in Unix seconds, 0 for the zero time
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+)
+
+// leaseState is the lease bookkeeping shared by every subnet of one process, so a
+// client is tracked once however many interfaces or relays it is seen through
+type leaseState struct {
+	mutex         sync.Mutex // Guards leases, declined addresses and the pools and reservations of every subnet
+	leases        LeaseStore
+	declined      map[string]time.Time     // Declined IP string to time of decline
+	declineCounts map[string]int           // Declines and conflicts per IP string since startup
+	history       map[string][]pastAddress // MAC string to addresses held before, most recent first
+	historySize   int                      // Addresses remembered per client
+	historyMaxAge time.Duration            // How long an address is remembered, 0 for no limit
+	backend       leaseBackend             // Where leases are persisted, nil to keep them in memory only
+	backendMutex  sync.Mutex               // Serializes writes to backend
+	subnets       []*DHCPServer            // Every subnet sharing this state, the primary first
+	ddns          *ddnsUpdater             // Dynamic DNS updates, nil if disabled
+	webhook       *webhookNotifier         // Lease event notifications, nil if disabled
+	expiryWarning float64                  // Fraction of a lease term after which it is announced as expiring, 0 to disable
+	warnedExpiry  map[string]time.Time     // MAC string to the expiry already announced
+	addressSeen   map[string]time.Time     // IP string to when it was last bound, released or probed clear
+	health        healthState
+	events        leaseEvents   // Subscribers of lease events
+	clock         Clock         // Source of the current time for every subnet
+	journal       *leaseJournal // Lease event journal, nil if disabled
+}
+
+// newLeaseState returns an empty in-memory lease state
+func newLeaseState() *leaseState {
+	clock := Clock(realClock{})
+	return &leaseState{
+		clock:         clock,
+		health:        healthState{startedAt: clock.Now()},
+		leases:        newMemoryLeaseStore(),
+		declined:      make(map[string]time.Time),
+		declineCounts: make(map[string]int),
+		warnedExpiry:  make(map[string]time.Time),
+		addressSeen:   make(map[string]time.Time),
+		history:       make(map[string][]pastAddress),
+		historySize:   defaultAddressHistorySize,
+		historyMaxAge: defaultAddressHistoryMaxAge,
+	}
+}
+
+// joinSubnets makes the servers share the lease state of the first one. It fails if
+// two of them serve overlapping networks, since addresses must have a single owner.
+func joinSubnets(servers []*DHCPServer) error {
+	if err := checkOverlap(servers); err != nil {
+		return err
+	}
+	state := servers[0].leaseState
+	for _, server := range servers[1:] {
+		server.leaseState = state
+	}
+	state.subnets = servers
+	return nil
+}
+
+// checkOverlap fails if two of the servers serve overlapping networks
+func checkOverlap(servers []*DHCPServer) error {
+	for i, server := range servers {
+		for _, other := range servers[:i] {
+			if server.network.Contains(other.network.IP) || other.network.Contains(server.network.IP) {
+				return fmt.Errorf("subnets %s and %s overlap", other.network, server.network)
+			}
+		}
+	}
+	return nil
+}
+
+// subnetFor returns the subnet whose network contains ip, or nil if none does. The
+// caller must hold s.mutex or the subnets' configMutex.
+func (s *DHCPServer) subnetFor(ip net.IP) *DHCPServer {
+	for _, subnet := range s.subnets {
+		if subnet.network.Contains(ip) {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// ownerOf is subnetFor falling back to s for addresses outside every network, such
+// as leases left over from before a reload. The caller must hold s.mutex.
+func (s *DHCPServer) ownerOf(ip net.IP) *DHCPServer {
+	if subnet := s.subnetFor(ip); subnet != nil {
+		return subnet
+	}
+	return s
+}
+
+// servesIP reports whether ip is inside the network of s
+func (s *DHCPServer) servesIP(ip net.IP) bool {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.network.Contains(ip)
+}
+
+// subnetHandler dispatches the packets of one listener to the subnet they belong to:
+// relayed packets by their giaddr, the others to local, the subnet of the interface's
+// own address. With a single subnet every packet goes to it.
+func subnetHandler(iface string, subnets []*DHCPServer, local *DHCPServer) server4.Handler {
+	return func(conn net.PacketConn, peer net.Addr, p *dhcpv4.DHCPv4) {
+		defer recoverPacket(peer)
+		if !acceptPacket(peer, p) {
+			return
+		}
+		if len(subnets) == 1 {
+			subnets[0].ServeDHCP(conn, peer, p)
+			return
+		}
+
+		target := local
+		if p.GatewayIPAddr != nil && !p.GatewayIPAddr.IsUnspecified() {
+			target = nil
+			for _, subnet := range subnets {
+				if subnet.servesIP(p.GatewayIPAddr) {
+					target = subnet
+					break
+				}
+			}
+			if target == nil {
+				log.Printf("Ignoring %s from %s relayed by %s on %s: no subnet contains the relay address",
+					p.MessageType(), p.ClientHWAddr, p.GatewayIPAddr, iface)
+				return
+			}
+		}
+		if target == nil {
+			log.Printf("Ignoring %s from %s on %s: no subnet matches the interface", p.MessageType(), p.ClientHWAddr, iface)
+			return
+		}
+		target.ServeDHCP(conn, peer, p)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// defaultUtilizationWarnings are the percentages of a subnet's pools in use at which
+// a warning is logged
+var defaultUtilizationWarnings = []int{80, 95}
+
+// parseUtilizationWarnings validates utilization_warnings, returning the defaults
+// when none are configured
+func parseUtilizationWarnings(percents []int) ([]int, error) {
+	if len(percents) == 0 {
+		return defaultUtilizationWarnings, nil
+	}
+	for i, percent := range percents {
+		if percent < 1 || percent > 100 {
+			return nil, fmt.Errorf("utilization_warnings must be between 1 and 100, got %d", percent)
+		}
+		if i > 0 && percent <= percents[i-1] {
+			return nil, fmt.Errorf("utilization_warnings must be in ascending order")
+		}
+	}
+	return percents, nil
+}
+
+// utilization returns the addresses in use and the addresses in total over the
+// subnet's pools. Cooling addresses count as free since they can still be handed out.
+func (s *DHCPServer) utilization() (used, total int) {
+	for _, pool := range s.pools() {
+		used += pool.capacity - pool.available - len(pool.cooling)
+		total += pool.capacity
+	}
+	return used, total
+}
+
+// checkUtilization logs every subnet whose utilization crossed a warning threshold
+// since the last check and every pool that has free addresses again after refusing
+// clients. It derives the numbers from the pools, so they cannot drift. The caller
+// must hold s.mutex.
+func (s *DHCPServer) checkUtilization() {
+	for _, subnet := range s.subnets {
+		subnet.checkSubnetUtilization()
+	}
+}
+
+// checkSubnetUtilization is checkUtilization for the subnet of s
+func (s *DHCPServer) checkSubnetUtilization() {
+	used, total := s.utilization()
+	percent := 0
+	if total > 0 {
+		percent = used * 100 / total
+	}
+	level := 0
+	for i, threshold := range s.utilizationWarnings {
+		if percent >= threshold {
+			level = i + 1
+		}
+	}
+	switch {
+	case level > s.utilizationLevel:
+		log.Printf("Warning: %s is %d%% in use (%d of %d addresses), above the %d%% threshold",
+			s.network, percent, used, total, s.utilizationWarnings[level-1])
+	case level < s.utilizationLevel:
+		log.Printf("%s is down to %d%% in use (%d of %d addresses), below the %d%% threshold",
+			s.network, percent, used, total, s.utilizationWarnings[level])
+	}
+	s.utilizationLevel = level
+
+	for _, pool := range s.pools() {
+		if pool.refused > 0 && pool.available+len(pool.cooling) > 0 {
+			log.Printf("%s-%s has free addresses again after refusing %d requests since %s",
+				pool.start, pool.end, pool.refused, pool.exhaustedAt.Format(time.RFC3339))
+			pool.refused = 0
+		}
+	}
+}
+
+// refuse counts a request pool could not serve and logs the refusals since the pool
+// ran out. The caller must hold s.mutex.
+func (s *DHCPServer) refuse(pool *addressPool) {
+	if pool.refused == 0 {
+		pool.exhaustedAt = s.clock.Now()
+	}
+	pool.refused++
+	log.Printf("Error: %s-%s in %s is exhausted; %d requests refused since %s",
+		pool.start, pool.end, s.network, pool.refused, pool.exhaustedAt.Format(time.RFC3339))
+}
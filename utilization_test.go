@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUtilizationCounters scripts offers, acks, a release, an expiry, a decline and
+// reservations against a pool of ten addresses until it is exhausted, checking the
+// addresses in use after every step and the lines logged as utilization crosses its
+// thresholds and requests are refused
+func TestUtilizationCounters(t *testing.T) {
+	cfg := testSubnetConfig()
+	cfg.Range = StringList{"10.0.0.10-10.0.0.19"}
+	cfg.UtilizationWarnings = []int{50, 80}
+	cfg.ReuseDelay = 600
+	cfg.DeclineCooldown = 300
+	s, clock := newClockedServer(t, cfg)
+	logs := captureLog(t)
+	ip := func(n byte) net.IP { return net.IPv4(10, 0, 0, n).To4() }
+
+	step := func(name string, used, total int, logged string) {
+		t.Helper()
+		s.mutex.Lock()
+		gotUsed, gotTotal := s.utilization()
+		s.mutex.Unlock()
+		if gotUsed != used || gotTotal != total {
+			t.Fatalf("after %s: %d of %d addresses in use, want %d of %d", name, gotUsed, gotTotal, used, total)
+		}
+		if out := logs.String(); logged != "" && !strings.Contains(out, logged) || logged == "" && strings.Contains(out, "threshold") {
+			t.Fatalf("after %s: logged %q, want %q", name, out, logged)
+		}
+		logs.Reset()
+	}
+	step("start", 0, 10, "")
+
+	serve(t, s, newDiscover(t, testMAC(1), withRequestedIP(ip(10))))
+	step("offer", 1, 10, "")
+	serve(t, s, newRequest(t, testMAC(1), ip(10), testServerIP))
+	step("ack", 1, 10, "")
+	for n := byte(2); n <= 4; n++ {
+		bind(t, s, testMAC(n), ip(9+n))
+	}
+	step("three more acks", 4, 10, "")
+	bind(t, s, testMAC(5), ip(14))
+	step("fifth ack", 5, 10, "is 50% in use (5 of 10 addresses), above the 50% threshold")
+
+	serve(t, s, newRelease(t, testMAC(2), ip(11)))
+	step("release", 4, 10, "is down to 40% in use (4 of 10 addresses), below the 50% threshold")
+
+	// Renew every lease but that of 10.0.0.12, then let it expire. Its address cools
+	// down for reuse_delay but counts as free.
+	clock.Advance(3000 * time.Second)
+	for _, n := range []byte{1, 4, 5} {
+		serve(t, s, newRequest(t, testMAC(n), ip(9+n), testServerIP))
+	}
+	step("renewals", 4, 10, "")
+	clock.Advance(700 * time.Second)
+	if expired := s.reapExpired(clock.Now()); len(expired) != 1 || !expired[0].IP.Equal(ip(12)) {
+		t.Fatalf("reaped %v, want only 10.0.0.12", expired)
+	}
+	step("expiry", 3, 10, "")
+
+	// A declined address leaves its lease but stays in use while quarantined
+	serve(t, s, newDecline(t, testMAC(5), ip(14)))
+	step("decline", 3, 10, "")
+	clock.Advance(300 * time.Second)
+	s.reapExpired(clock.Now())
+	step("end of quarantine", 2, 10, "")
+
+	// A free address reserved at runtime counts as in use until the reservation goes
+	if err := s.AddReservation(testMAC(6), ip(18)); err != nil {
+		t.Fatal(err)
+	}
+	step("reservation", 3, 10, "")
+	if _, ok := s.RemoveReservation(testMAC(6)); !ok {
+		t.Fatal("reservation not removed")
+	}
+	step("removed reservation", 2, 10, "")
+
+	// Offers exhaust the pool, handing out the cooling address last
+	for n := byte(10); n < 18; n++ {
+		if offer := serve(t, s, newDiscover(t, testMAC(n))); offer == nil {
+			t.Fatalf("no offer for client %d", n)
+		}
+	}
+	step("offers", 10, 10, "is 80% in use (8 of 10 addresses), above the 80% threshold")
+	for n := byte(18); n < 20; n++ {
+		if offer := serve(t, s, newDiscover(t, testMAC(n))); offer != nil {
+			t.Fatalf("exhausted pool offered %s", offer.YourIPAddr)
+		}
+	}
+	if out := logs.String(); !strings.Contains(out, "is exhausted; 2 requests refused since") {
+		t.Fatalf("logged %q, want 2 refusals", out)
+	}
+	step("refusals", 10, 10, "")
+	serve(t, s, newRelease(t, testMAC(1), ip(10)))
+	step("release after exhaustion", 9, 10, "has free addresses again after refusing 2 requests")
+}
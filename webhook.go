@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Limits of the webhook notifier
+const (
+	webhookTimeout   = 5 * time.Second
+	webhookAttempts  = 3
+	webhookRetryWait = time.Second // Doubled after every failed attempt
+	webhookQueueSize = 128
+)
+
+// leaseEvent is the JSON body posted to webhook_url
+type leaseEvent struct {
+	Event     string    `json:"event"` // ack, expiring, release, decline or expire
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip"`
+	Hostname  string    `json:"hostname,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// webhookNotifier posts lease events to a URL one at a time from a bounded queue, so
+// a slow or failing endpoint never holds up DHCP
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+	queue  chan leaseEvent
+	clock  Clock // Times the pauses between attempts
+}
+
+// newWebhookNotifier validates rawURL and returns a notifier posting to it, pausing
+// between attempts by clock
+func newWebhookNotifier(rawURL string, clock Clock) (*webhookNotifier, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook_url %q: must be an http or https URL", rawURL)
+	}
+	return &webhookNotifier{
+		url:    rawURL,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan leaseEvent, webhookQueueSize),
+		clock:  clock,
+	}, nil
+}
+
+// Run posts queued events until ctx is canceled
+func (w *webhookNotifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-w.queue:
+			if err := w.deliver(ctx, event); err != nil {
+				log.Printf("Dropping %s webhook for %s (%s): %v", event.Event, event.MAC, event.IP, err)
+			}
+		}
+	}
+}
+
+// enqueue queues event without blocking, dropping it if the queue is full
+func (w *webhookNotifier) enqueue(event leaseEvent) {
+	select {
+	case w.queue <- event:
+	default:
+		log.Printf("Webhook queue full, dropping %s event for %s (%s)", event.Event, event.MAC, event.IP)
+	}
+}
+
+// deliver posts event, retrying failed attempts with a growing pause
+func (w *webhookNotifier) deliver(ctx context.Context, event leaseEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	wait := webhookRetryWait
+	for attempt := 1; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		log.Printf("Webhook attempt %d for %s failed: %v", attempt, event.MAC, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.clock.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// post sends one request, treating any non-2xx status as a failure
+func (w *webhookNotifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyLease queues event for lease if a webhook is configured. The caller must
+// hold s.mutex.
+func (s *DHCPServer) notifyLease(event string, lease *Lease) {
+	if s.webhook == nil {
+		return
+	}
+	s.webhook.enqueue(leaseEvent{
+		Event:     event,
+		MAC:       lease.MAC.String(),
+		IP:        lease.IP.String(),
+		Hostname:  s.leaseHostname(lease),
+		ExpiresAt: lease.ExpiresAt,
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dhcp_server/internal/testutil"
+)
+
+func TestWebhookRetryWaitsOnClock(t *testing.T) {
+	var attempts atomic.Int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer endpoint.Close()
+
+	clock := fakeClock{testutil.NewFakeClock(testEpoch)}
+	w, err := newWebhookNotifier(endpoint.URL, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- w.deliver(context.Background(), leaseEvent{Event: "ack", MAC: "02:00:00:00:00:01"}) }()
+
+	// The failed first attempt waits webhookRetryWait on the fake clock
+	clock.BlockUntil(1)
+	select {
+	case err := <-done:
+		t.Fatalf("delivery ended before the retry wait: %v", err)
+	default:
+	}
+	clock.Advance(webhookRetryWait)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("delivery failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery did not retry after the wait")
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("%d attempts, want 2", n)
+	}
+}